@@ -0,0 +1,202 @@
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	userPrefix     = "account:user"
+	emailPrefix    = "account:email"
+	verifiedPrefix = "account:verified"
+	throttlePrefix = "account:throttle"
+)
+
+var (
+	ErrNotFound    = errors.New("用户不存在")
+	ErrTooFrequent = errors.New("发送太频繁,请稍后再试")
+	ErrDailyLimit  = errors.New("今日发送次数已达上限")
+)
+
+//Profile logic服务中的用户资料快照,用于重置密码时补全UpdateUser请求
+type Profile struct {
+	Id     int32  `json:"id"`
+	Email  string `json:"email"`
+	Phone  string `json:"phone"`
+	Name   string `json:"name"`
+	School string `json:"school"`
+	Sex    int32  `json:"sex"`
+	Face   string `json:"face"`
+}
+
+func userKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", userPrefix, uid)
+}
+
+func emailKey(email string) string {
+	return fmt.Sprintf("%s:%s", emailPrefix, NormalizeEmail(email))
+}
+
+func verifiedKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", verifiedPrefix, uid)
+}
+
+//NormalizeEmail 邮箱忽略大小写和首尾空白
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+//SaveUser 记录用户资料和邮箱到用户id的映射
+func SaveUser(ctx context.Context, user *proto.User) error {
+	p := &Profile{
+		Id:     user.GetId(),
+		Email:  user.GetEmail(),
+		Phone:  user.GetPhone(),
+		Name:   user.GetName(),
+		School: user.GetSchool(),
+		Sex:    user.GetSex(),
+		Face:   user.GetFace(),
+	}
+	return SaveProfile(ctx, p)
+}
+
+//RefreshUser 资料快照缺失或与登录信息不一致时更新快照。
+//logic服务不能按邮箱查找用户,找回和重置密码依赖快照中的资料和邮箱映射
+func RefreshUser(ctx context.Context, user *proto.User) error {
+	p, err := GetProfile(ctx, user.GetId())
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if p != nil && p.Email == user.GetEmail() && p.Phone == user.GetPhone() && p.Name == user.GetName() &&
+		p.School == user.GetSchool() && p.Sex == user.GetSex() && (user.GetFace() == "" || p.Face == user.GetFace()) {
+		return nil
+	}
+	return SaveUser(ctx, user)
+}
+
+//SaveProfile 保存资料快照,邮箱变化时删除旧邮箱的映射,未填写的头像沿用旧值
+func SaveProfile(ctx context.Context, p *Profile) error {
+	old, err := GetProfile(ctx, p.Id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if old != nil {
+		if p.Face == "" {
+			p.Face = old.Face
+		}
+	}
+	val, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	if old != nil && NormalizeEmail(old.Email) != NormalizeEmail(p.Email) {
+		pipe.Del(ctx, emailKey(old.Email))
+	}
+	pipe.Set(ctx, userKey(p.Id), val, 0)
+	pipe.Set(ctx, emailKey(p.Email), p.Id, 0)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//GetProfile 获取用户资料快照
+func GetProfile(ctx context.Context, uid int32) (*Profile, error) {
+	val, err := db.RedisClient.Get(ctx, userKey(uid)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p Profile
+	if err = json.Unmarshal(val, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+//Uids 遍历有资料快照的用户id,用于数据迁移
+func Uids(ctx context.Context) ([]int32, error) {
+	var uids []int32
+	iter := db.RedisClient.Scan(ctx, 0, userPrefix+":*", 500).Iterator()
+	for iter.Next(ctx) {
+		id, err := strconv.ParseInt(strings.TrimPrefix(iter.Val(), userPrefix+":"), 10, 32)
+		if err != nil {
+			continue
+		}
+		uids = append(uids, int32(id))
+	}
+	return uids, iter.Err()
+}
+
+//SetFace 更新快照中的头像,没有快照时忽略
+func SetFace(ctx context.Context, uid int32, face string) error {
+	p, err := GetProfile(ctx, uid)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p.Face = face
+	return SaveProfile(ctx, p)
+}
+
+//UidByEmail 根据邮箱查找用户
+func UidByEmail(ctx context.Context, email string) (int32, error) {
+	uid, err := db.RedisClient.Get(ctx, emailKey(email)).Int()
+	if err == redis.Nil {
+		return 0, ErrNotFound
+	}
+	return int32(uid), err
+}
+
+//SetVerified 标记邮箱已验证
+func SetVerified(ctx context.Context, uid int32, email string) error {
+	return db.RedisClient.Set(ctx, verifiedKey(uid), NormalizeEmail(email), 0).Err()
+}
+
+//IsVerified 用户当前邮箱是否已验证,更换邮箱后需要重新验证
+func IsVerified(ctx context.Context, uid int32, email string) (bool, error) {
+	val, err := db.RedisClient.Get(ctx, verifiedKey(uid)).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return val == NormalizeEmail(email), nil
+}
+
+//Throttle 限制发送频率,interval内只能发送一次,每天最多limit次
+func Throttle(ctx context.Context, scene, target string, interval time.Duration, limit int) error {
+	key := fmt.Sprintf("%s:%s:%s", throttlePrefix, scene, target)
+	ok, err := db.RedisClient.SetNX(ctx, key+":lock", 1, interval).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTooFrequent
+	}
+	dayKey := fmt.Sprintf("%s:%s", key, time.Now().Format("20060102"))
+	n, err := db.RedisClient.Incr(ctx, dayKey).Result()
+	if err != nil {
+		return err
+	}
+	if n == 1 {
+		db.RedisClient.Expire(ctx, dayKey, 24*time.Hour)
+	}
+	if limit > 0 && n > int64(limit) {
+		return ErrDailyLimit
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	deletionKey   = "account:deletion"
+	deletedPrefix = "account:deleted"
+)
+
+func deletedKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", deletedPrefix, uid)
+}
+
+//ScheduleDeletion 申请注销,at之后执行,重复申请时覆盖执行时间
+func ScheduleDeletion(ctx context.Context, uid int32, at time.Time) error {
+	return db.RedisClient.ZAdd(ctx, deletionKey, &redis.Z{Score: float64(at.Unix()), Member: uid}).Err()
+}
+
+//CancelDeletion 撤销注销申请,没有申请时返回false
+func CancelDeletion(ctx context.Context, uid int32) (bool, error) {
+	n, err := db.RedisClient.ZRem(ctx, deletionKey, uid).Result()
+	return n > 0, err
+}
+
+//DeletionTime 注销执行时间,没有申请时返回0
+func DeletionTime(ctx context.Context, uid int32) (int64, error) {
+	score, err := db.RedisClient.ZScore(ctx, deletionKey, strconv.Itoa(int(uid))).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return int64(score), err
+}
+
+//DueDeletions 已到执行时间的注销申请
+func DueDeletions(ctx context.Context, now time.Time, limit int64) ([]int32, error) {
+	vals, err := db.RedisClient.ZRangeByScore(ctx, deletionKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: limit,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	uids := make([]int32, 0, len(vals))
+	for _, v := range vals {
+		uid, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		uids = append(uids, int32(uid))
+	}
+	return uids, nil
+}
+
+//ClaimDeletion 多个实例同时处理时只有一个能取到申请
+func ClaimDeletion(ctx context.Context, uid int32) (bool, error) {
+	return CancelDeletion(ctx, uid)
+}
+
+//MarkDeleted 标记账号已注销,之后的请求都会被拒绝
+func MarkDeleted(ctx context.Context, uid int32) error {
+	return db.RedisClient.Set(ctx, deletedKey(uid), time.Now().Unix(), 0).Err()
+}
+
+//IsDeleted 账号是否已注销
+func IsDeleted(ctx context.Context, uid int32) (bool, error) {
+	n, err := db.RedisClient.Exists(ctx, deletedKey(uid)).Result()
+	return n > 0, err
+}
+
+//Purge 删除账号在本服务保存的个人数据
+func Purge(ctx context.Context, uid int32, email string) error {
+	keys := []string{userKey(uid), verifiedKey(uid), phoneVerifiedKey(uid), smsLoginKey(uid), privacyKey(uid)}
+	if email != "" {
+		keys = append(keys, emailKey(email))
+	}
+	return db.RedisClient.Del(ctx, keys...).Err()
+}
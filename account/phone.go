@@ -0,0 +1,53 @@
+package account
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	phoneVerifiedPrefix = "account:phoneVerified"
+	smsLoginPrefix      = "account:smsLogin"
+)
+
+func phoneVerifiedKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", phoneVerifiedPrefix, uid)
+}
+
+func smsLoginKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", smsLoginPrefix, uid)
+}
+
+//SetPhoneVerified 标记手机号已验证
+func SetPhoneVerified(ctx context.Context, uid int32, phone string) error {
+	return db.RedisClient.Set(ctx, phoneVerifiedKey(uid), phone, 0).Err()
+}
+
+//IsPhoneVerified 用户当前手机号是否已验证
+func IsPhoneVerified(ctx context.Context, uid int32, phone string) (bool, error) {
+	val, err := db.RedisClient.Get(ctx, phoneVerifiedKey(uid)).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return val == phone, nil
+}
+
+//SetSmsLogin 开启或关闭登录短信验证
+func SetSmsLogin(ctx context.Context, uid int32, enable bool) error {
+	if !enable {
+		return db.RedisClient.Del(ctx, smsLoginKey(uid)).Err()
+	}
+	return db.RedisClient.Set(ctx, smsLoginKey(uid), 1, 0).Err()
+}
+
+//SmsLoginEnabled 登录时是否需要短信验证码
+func SmsLoginEnabled(ctx context.Context, uid int32) (bool, error) {
+	n, err := db.RedisClient.Exists(ctx, smsLoginKey(uid)).Result()
+	return n > 0, err
+}
@@ -0,0 +1,57 @@
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	privacyPrefix = "account:privacy"
+)
+
+//Privacy 公开主页中各字段是否对其他用户可见,昵称始终可见
+type Privacy struct {
+	Face     bool `json:"face"`
+	School   bool `json:"school"`
+	Badges   bool `json:"badges"`
+	Listings bool `json:"listings"`
+	Rating   bool `json:"rating"`
+}
+
+func privacyKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", privacyPrefix, uid)
+}
+
+//DefaultPrivacy 默认全部公开
+func DefaultPrivacy() *Privacy {
+	return &Privacy{Face: true, School: true, Badges: true, Listings: true, Rating: true}
+}
+
+//GetPrivacy 获取隐私设置,未设置的字段使用默认值
+func GetPrivacy(ctx context.Context, uid int32) (*Privacy, error) {
+	p := DefaultPrivacy()
+	val, err := db.RedisClient.Get(ctx, privacyKey(uid)).Bytes()
+	if err == redis.Nil {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(val, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//SetPrivacy 保存隐私设置
+func SetPrivacy(ctx context.Context, uid int32, p *Privacy) error {
+	val, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return db.RedisClient.Set(ctx, privacyKey(uid), val, 0).Err()
+}
@@ -0,0 +1,118 @@
+package account
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/dopamine-joker/zu_web_server/misc"
+)
+
+// token用途
+const (
+	PurposeVerify      = "verify"
+	PurposeReset       = "reset"
+	PurposeChangeEmail = "changeEmail"
+)
+
+const (
+	tokenPrefix = "account:token"
+)
+
+var (
+	ErrBadToken  = errors.New("链接无效")
+	ErrExpired   = errors.New("链接已过期")
+	ErrTokenUsed = errors.New("链接已使用")
+)
+
+//Claims 邮件链接中携带的信息
+type Claims struct {
+	Purpose string `json:"p"`
+	Uid     int32  `json:"u"`
+	Email   string `json:"e"`
+	Exp     int64  `json:"x"`
+	Nonce   string `json:"n"`
+}
+
+func tokenKey(purpose, nonce string) string {
+	return fmt.Sprintf("%s:%s:%s", tokenPrefix, purpose, nonce)
+}
+
+//IssueToken 签发一次性token,有效期内只能使用一次
+func IssueToken(ctx context.Context, purpose string, uid int32, email string, expire time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	claims := &Claims{
+		Purpose: purpose,
+		Uid:     uid,
+		Email:   email,
+		Exp:     time.Now().Add(expire).Unix(),
+		Nonce:   hex.EncodeToString(b),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	if err = db.RedisClient.Set(ctx, tokenKey(purpose, claims.Nonce), uid, expire).Err(); err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(sign(payload)), nil
+}
+
+//ConsumeToken 校验并作废token
+func ConsumeToken(ctx context.Context, purpose, token string) (*Claims, error) {
+	claims, err := parseToken(purpose, token)
+	if err != nil {
+		return nil, err
+	}
+	n, err := db.RedisClient.Del(ctx, tokenKey(purpose, claims.Nonce)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrTokenUsed
+	}
+	return claims, nil
+}
+
+func parseToken(purpose, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrBadToken
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrBadToken
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, sign(payload)) {
+		return nil, ErrBadToken
+	}
+	var claims Claims
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.Purpose != purpose {
+		return nil, ErrBadToken
+	}
+	if time.Now().Unix() > claims.Exp {
+		return nil, ErrExpired
+	}
+	return &claims, nil
+}
+
+func sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(misc.Conf.Account.Secret))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
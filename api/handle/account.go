@@ -0,0 +1,272 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/account"
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/mail"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// 发送频率限制的场景
+const (
+	throttleVerify = "verify"
+	throttleReset  = "reset"
+)
+
+//ResendVerifyEmail 重新发送邮箱验证邮件
+func ResendVerifyEmail(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	user, err := utils.GetContextUser(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	verified, err := account.IsVerified(ctx, user.GetId(), user.GetEmail())
+	if err != nil {
+		misc.Logger.Error("get email verified err", zap.Error(err))
+		utils.FailWithMsg(c, "发送失败")
+		return
+	}
+	if verified {
+		utils.FailWithMsg(c, "邮箱已验证")
+		return
+	}
+
+	if err = throttleMail(ctx, throttleVerify, user.GetEmail()); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if err = sendVerifyMail(ctx, user.GetId(), user.GetEmail()); err != nil {
+		misc.Logger.Error("send verify mail err", zap.Error(err), zap.Int32("uid", user.GetId()))
+		utils.FailWithMsg(c, "发送失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(user.GetId())),
+	)
+
+	utils.SuccessWithMsg(c, "send verify email success", nil)
+}
+
+//VerifyEmail 使用邮件中的token完成邮箱验证
+func VerifyEmail(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form VerifyEmailForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle verify email bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	ctx := c.Request.Context()
+	claims, err := account.ConsumeToken(ctx, account.PurposeVerify, form.Token)
+	if err != nil {
+		utils.FailWithMsg(c, tokenErrMsg(err))
+		return
+	}
+	if profile, err := account.GetProfile(ctx, claims.Uid); err == nil &&
+		account.NormalizeEmail(profile.Email) != account.NormalizeEmail(claims.Email) {
+		utils.FailWithMsg(c, "邮箱已变更,请重新发送验证邮件")
+		return
+	}
+	if err = account.SetVerified(ctx, claims.Uid, claims.Email); err != nil {
+		misc.Logger.Error("set email verified err", zap.Error(err))
+		utils.FailWithMsg(c, "验证失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(claims.Uid)),
+	)
+
+	utils.SuccessWithMsg(c, "verify email success", nil)
+}
+
+//ForgotPassword 发送重置密码邮件,邮箱未注册时同样返回成功
+func ForgotPassword(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ForgotPasswordForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle forgot password bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err = throttleMail(ctx, throttleReset, form.Email); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	// 没有快照的邮箱可能不存在,也可能是快照上线后一直没有登录过,
+	// 不区分两种情况,避免泄露邮箱是否注册
+	uid, err := account.UidByEmail(ctx, form.Email)
+	if err != nil {
+		if errors.Is(err, account.ErrNotFound) {
+			misc.Logger.Info("forgot password email without snapshot")
+		} else {
+			misc.Logger.Error("get uid by email err", zap.Error(err))
+		}
+		utils.SuccessWithMsg(c, "forgot password success", nil)
+		return
+	}
+
+	if err = sendResetMail(ctx, uid, form.Email); err != nil {
+		misc.Logger.Error("send reset mail err", zap.Error(err), zap.Int32("uid", uid))
+		utils.FailWithMsg(c, "发送失败")
+		return
+	}
+
+	utils.SuccessWithMsg(c, "forgot password success", nil)
+}
+
+//ResetPassword 使用邮件中的token重置密码
+func ResetPassword(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ResetPasswordForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle reset password bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	ctx := c.Request.Context()
+	claims, err := account.ConsumeToken(ctx, account.PurposeReset, form.Token)
+	if err != nil {
+		utils.FailWithMsg(c, tokenErrMsg(err))
+		return
+	}
+	profile, err := account.GetProfile(ctx, claims.Uid)
+	if err != nil {
+		misc.Logger.Error("reset password get profile err", zap.Error(err))
+		utils.FailWithMsg(c, "重置失败")
+		return
+	}
+	if account.NormalizeEmail(profile.Email) != account.NormalizeEmail(claims.Email) {
+		utils.FailWithMsg(c, "邮箱已变更,请重新申请")
+		return
+	}
+
+	if err = saveUser(ctx, profile, form.Password); err != nil {
+		misc.Logger.Error("reset password update user err", zap.Error(err))
+		utils.FailWithMsg(c, "重置失败")
+		return
+	}
+	// 能收到重置邮件说明邮箱有效
+	if err = account.SetVerified(ctx, profile.Id, profile.Email); err != nil {
+		misc.Logger.Error("set email verified err", zap.Error(err))
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(profile.Id)),
+	)
+
+	utils.SuccessWithMsg(c, "reset password success", nil)
+}
+
+//throttleMail 限制同一邮箱的发送频率
+func throttleMail(ctx context.Context, scene, email string) error {
+	cfg := misc.Conf.Account
+	err := account.Throttle(ctx, scene, account.NormalizeEmail(email), time.Duration(cfg.ResendInterval)*time.Second, cfg.DailyLimit)
+	if err != nil && !errors.Is(err, account.ErrTooFrequent) && !errors.Is(err, account.ErrDailyLimit) {
+		misc.Logger.Error("throttle mail err", zap.Error(err))
+		return errors.New("发送失败")
+	}
+	return err
+}
+
+func sendVerifyMail(ctx context.Context, uid int32, email string) error {
+	expire := time.Duration(misc.Conf.Account.VerifyExpire) * time.Second
+	token, err := account.IssueToken(ctx, account.PurposeVerify, uid, email, expire)
+	if err != nil {
+		return err
+	}
+	return mail.Default.Send(ctx, &mail.Mail{
+		To:      email,
+		Subject: "验证你的邮箱",
+		Body: fmt.Sprintf("请在%d小时内打开以下链接完成邮箱验证:\n\n%s?token=%s\n\n如果不是你本人操作,请忽略本邮件。",
+			int(expire.Hours()), misc.Conf.Account.VerifyUrl, token),
+	})
+}
+
+func sendResetMail(ctx context.Context, uid int32, email string) error {
+	expire := time.Duration(misc.Conf.Account.ResetExpire) * time.Second
+	token, err := account.IssueToken(ctx, account.PurposeReset, uid, email, expire)
+	if err != nil {
+		return err
+	}
+	return mail.Default.Send(ctx, &mail.Mail{
+		To:      email,
+		Subject: "重置密码",
+		Body: fmt.Sprintf("请在%d分钟内打开以下链接重置密码:\n\n%s?token=%s\n\n如果不是你本人操作,请忽略本邮件,你的密码不会被修改。",
+			int(expire.Minutes()), misc.Conf.Account.ResetUrl, token),
+	})
+}
+
+//onRegistered 注册成功后登录一次以获取用户id,记录资料并发送验证邮件
+func onRegistered(ctx context.Context, email, password string) {
+	code, token, user, err := rpc.Login(ctx, &proto.LoginRequest{Email: email, Password: password})
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("register rpc login err", zap.Error(err))
+		return
+	}
+	if code, err = rpc.Logout(ctx, &proto.LogoutRequest{Token: token}); err != nil || code == misc.CodeFail {
+		misc.Logger.Error("register rpc logout err", zap.Error(err))
+	}
+	if err = account.SaveUser(ctx, user); err != nil {
+		misc.Logger.Error("save account err", zap.Error(err))
+		return
+	}
+	if err = throttleMail(ctx, throttleVerify, email); err != nil {
+		return
+	}
+	if err = sendVerifyMail(ctx, user.GetId(), user.GetEmail()); err != nil {
+		misc.Logger.Error("send verify mail err", zap.Error(err), zap.Int32("uid", user.GetId()))
+	}
+}
+
+//emailVerified 登录返回用户时附带邮箱验证状态,同时刷新资料快照
+func emailVerified(ctx context.Context, user *proto.User) bool {
+	if err := account.SaveUser(ctx, user); err != nil {
+		misc.Logger.Error("save account err", zap.Error(err))
+	}
+	verified, err := account.IsVerified(ctx, user.GetId(), user.GetEmail())
+	if err != nil {
+		misc.Logger.Error("get email verified err", zap.Error(err))
+	}
+	return verified
+}
+
+func tokenErrMsg(err error) string {
+	if errors.Is(err, account.ErrBadToken) || errors.Is(err, account.ErrExpired) || errors.Is(err, account.ErrTokenUsed) {
+		return err.Error()
+	}
+	misc.Logger.Error("consume token err", zap.Error(err))
+	return "链接无效"
+}
@@ -0,0 +1,112 @@
+package handle
+
+import (
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/rbac"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+//GetUserRole 查询用户角色
+func GetUserRole(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form UserRoleForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle get role bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	role, err := rbac.GetRole(c.Request.Context(), form.Uid)
+	if err != nil {
+		misc.Logger.Error("get role err", zap.Error(err))
+		utils.FailWithMsg(c, "获取角色失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"uid":  form.Uid,
+		"role": role,
+	}
+
+	utils.SuccessWithMsg(c, "get role success", data)
+}
+
+//SetUserRole 分配用户角色
+func SetUserRole(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form SetUserRoleForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle set role bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	role, err := rbac.ParseRole(form.Role)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if uid == form.Uid {
+		utils.FailWithMsg(c, "不能修改自己的角色")
+		return
+	}
+
+	if err = rbac.SetRole(c.Request.Context(), form.Uid, role); err != nil {
+		misc.Logger.Error("set role err", zap.Error(err))
+		utils.FailWithMsg(c, "设置角色失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("adminId", int64(uid)),
+		attribute.Int64("userId", int64(form.Uid)),
+		attribute.String("role", string(role)),
+	)
+
+	utils.SuccessWithMsg(c, "set role success", nil)
+}
+
+//ListAuditLogs 查看管理操作日志
+func ListAuditLogs(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ListAuditForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle list audit bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	list, err := rbac.AuditLogs(c.Request.Context(), *form.Page, *form.Count)
+	if err != nil {
+		misc.Logger.Error("list audit logs err", zap.Error(err))
+		utils.FailWithMsg(c, "获取日志失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"len":  len(list),
+		"data": list,
+	}
+
+	utils.SuccessWithMsg(c, "list audit logs success", data)
+}
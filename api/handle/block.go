@@ -0,0 +1,176 @@
+package handle
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dopamine-joker/zu_web_server/account"
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/block"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+var errBlocked = errors.New("你与对方存在拉黑关系,无法进行此操作")
+
+//BlockUser 拉黑用户,拉黑后双方不能下单、回复和私信
+func BlockUser(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form BlockUserForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle block user bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	if form.Uid != uid {
+		exists, err := userExists(c.Request.Context(), form.Uid)
+		if err != nil {
+			misc.Logger.Error("block user check target err", zap.Error(err))
+			utils.FailWithMsg(c, "拉黑失败")
+			return
+		}
+		if !exists {
+			utils.FailWithMsg(c, account.ErrNotFound.Error())
+			return
+		}
+	}
+
+	if err = block.Block(c.Request.Context(), uid, form.Uid); err != nil {
+		if errors.Is(err, block.ErrSelf) || errors.Is(err, block.ErrTooMany) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		misc.Logger.Error("block user err", zap.Error(err))
+		utils.FailWithMsg(c, "拉黑失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+		attribute.Int64("target", int64(form.Uid)),
+	)
+
+	utils.SuccessWithMsg(c, "block user success", nil)
+}
+
+//UnblockUser 取消拉黑
+func UnblockUser(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form BlockUserForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle unblock user bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	removed, err := block.Unblock(c.Request.Context(), uid, form.Uid)
+	if err != nil {
+		misc.Logger.Error("unblock user err", zap.Error(err))
+		utils.FailWithMsg(c, "取消拉黑失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+		attribute.Int64("target", int64(form.Uid)),
+		attribute.Bool("removed", removed),
+	)
+
+	utils.SuccessWithMsg(c, "unblock user success", nil)
+}
+
+//GetBlockList 获取黑名单,附带对方昵称和头像
+func GetBlockList(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	list, err := block.List(ctx, uid)
+	if err != nil {
+		misc.Logger.Error("get block list err", zap.Error(err))
+		utils.FailWithMsg(c, "获取黑名单失败")
+		return
+	}
+
+	dataList := make([]map[string]interface{}, 0, len(list))
+	for _, e := range list {
+		m := map[string]interface{}{
+			"uid":  e.Uid,
+			"time": e.Time,
+		}
+		if p, err := account.GetProfile(ctx, e.Uid); err == nil {
+			m["name"] = p.Name
+			m["face"] = p.Face
+		}
+		dataList = append(dataList, m)
+	}
+
+	data := map[string]interface{}{
+		"len":  len(dataList),
+		"data": dataList,
+	}
+
+	utils.SuccessWithMsg(c, "get block list success", data)
+}
+
+//checkBlocked uid与others之间存在拉黑关系时返回errBlocked
+func checkBlocked(ctx context.Context, uid int32, others ...int32) error {
+	blocked, err := block.Between(ctx, uid, others...)
+	if err != nil {
+		misc.Logger.Error("check blocked err", zap.Error(err))
+		return errors.New("内部数据库错误")
+	}
+	if blocked {
+		return errBlocked
+	}
+	return nil
+}
+
+//userExists 用户是否存在。logic服务不能按id查询用户,有资料快照或发布过物品的视为存在
+func userExists(ctx context.Context, uid int32) (bool, error) {
+	_, err := account.GetProfile(ctx, uid)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, account.ErrNotFound) {
+		return false, err
+	}
+	code, list, err := rpc.GetUserGoods(ctx, &proto.GetUserGoodsListRequest{Uid: uid})
+	if err = rpcErr(code, err); err != nil {
+		return false, err
+	}
+	return len(list) > 0, nil
+}
@@ -0,0 +1,168 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dopamine-joker/zu_web_server/account"
+	"github.com/dopamine-joker/zu_web_server/campus"
+	"github.com/dopamine-joker/zu_web_server/mail"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	throttleSchool = "school"
+)
+
+//SendSchoolCode 向学校邮箱发送认证验证码
+func SendSchoolCode(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form SendSchoolCodeForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle send school code bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	school, err := campus.SchoolByEmail(form.Email)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err = campus.CheckEmail(ctx, uid, form.Email); err != nil {
+		if !errors.Is(err, campus.ErrEmailUsed) {
+			misc.Logger.Error("check school email err", zap.Error(err))
+			err = errors.New("发送失败")
+		}
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if err = throttleMail(ctx, throttleSchool, form.Email); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	email := account.NormalizeEmail(form.Email)
+	code, err := campus.IssueCode(ctx, uid, school, email)
+	if err != nil {
+		misc.Logger.Error("issue school code err", zap.Error(err))
+		utils.FailWithMsg(c, "发送失败")
+		return
+	}
+	err = mail.Default.Send(ctx, &mail.Mail{
+		To:      email,
+		Subject: "学校认证验证码",
+		Body: fmt.Sprintf("你正在认证 %s 的学生身份,验证码为 %s,%d分钟内有效。\n\n如果不是你本人操作,请忽略本邮件。",
+			school, code, misc.Conf.Campus.CodeExpire/60),
+	})
+	if err != nil {
+		misc.Logger.Error("send school code mail err", zap.Error(err), zap.Int32("uid", uid))
+		utils.FailWithMsg(c, "发送失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+		attribute.String("school", school),
+	)
+
+	data := map[string]interface{}{
+		"school": school,
+	}
+
+	utils.SuccessWithMsg(c, "send school code success", data)
+}
+
+//VerifySchool 校验验证码,通过后获得学校认证
+func VerifySchool(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form VerifySchoolForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle verify school bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	badge, err := campus.Verify(c.Request.Context(), uid, form.Code)
+	if err != nil {
+		if errors.Is(err, campus.ErrNoCode) || errors.Is(err, campus.ErrWrongCode) || errors.Is(err, campus.ErrTooMany) ||
+			errors.Is(err, campus.ErrEmailUsed) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		misc.Logger.Error("verify school err", zap.Error(err))
+		utils.FailWithMsg(c, "认证失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+		attribute.String("school", badge.School),
+	)
+
+	utils.SuccessWithMsg(c, "verify school success", badge)
+}
+
+//GetSchoolBadge 获取当前用户的学校认证
+func GetSchoolBadge(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	badge, err := campus.GetBadge(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("get school badge err", zap.Error(err))
+		utils.FailWithMsg(c, "获取认证失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"verified": badge != nil,
+		"badge":    badge,
+	}
+
+	utils.SuccessWithMsg(c, "get school badge success", data)
+}
+
+//checkSchool 校验用户是否通过了school的认证
+func checkSchool(ctx context.Context, uid int32, school string) error {
+	err := campus.CheckSchool(ctx, uid, school)
+	if err == nil || errors.Is(err, campus.ErrNotVerified) || errors.Is(err, campus.ErrOtherSchool) {
+		return err
+	}
+	misc.Logger.Error("check school err", zap.Error(err))
+	return errors.New("学校认证校验失败")
+}
@@ -0,0 +1,222 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/dopamine-joker/zu_web_server/category"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+//GetCategories 获取启用的分类树,名称按Accept-Language本地化,不需要登录
+func GetCategories(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	all, err := category.All(c.Request.Context())
+	if err != nil {
+		misc.Logger.Error("get categories err", zap.Error(err))
+		utils.FailWithMsg(c, "获取分类失败")
+		return
+	}
+
+	locale := requestLocale(c)
+	span.SetAttributes(
+		attribute.String("locale", locale),
+	)
+
+	data := map[string]interface{}{
+		"locale": locale,
+		"data":   category.Tree(all, locale, false),
+	}
+
+	utils.SuccessWithMsg(c, "get categories success", data)
+}
+
+//ListCategories 获取包括已停用分类在内的完整分类树
+func ListCategories(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	all, err := category.All(c.Request.Context())
+	if err != nil {
+		misc.Logger.Error("list categories err", zap.Error(err))
+		utils.FailWithMsg(c, "获取分类失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"len":  len(all),
+		"data": category.Tree(all, category.DefaultLocale, true),
+	}
+
+	utils.SuccessWithMsg(c, "list categories success", data)
+}
+
+//AddCategory 新增分类
+func AddCategory(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form AddCategoryForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle add category bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	cat := &category.Category{
+		Id:         form.Id,
+		Parent:     form.Parent,
+		Names:      form.Names,
+		Icon:       form.Icon,
+		Attributes: categoryAttributes(form.Attributes),
+		Sort:       form.Sort,
+		Disabled:   form.Disabled,
+	}
+	if err = category.Create(c.Request.Context(), cat); err != nil {
+		utils.FailWithMsg(c, categoryErrMsg(err, "新增分类失败"))
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("categoryId", int64(cat.Id)),
+		attribute.Int64("parent", int64(cat.Parent)),
+	)
+
+	utils.SuccessWithMsg(c, "add category success", cat)
+}
+
+//UpdateCategory 修改分类,停用后不能再发布到该分类下,已发布的物品不受影响
+func UpdateCategory(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form UpdateCategoryForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle update category bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	cat := &category.Category{
+		Id:         form.Id,
+		Parent:     form.Parent,
+		Names:      form.Names,
+		Icon:       form.Icon,
+		Attributes: categoryAttributes(form.Attributes),
+		Sort:       form.Sort,
+		Disabled:   form.Disabled,
+	}
+	if err = category.Update(c.Request.Context(), cat); err != nil {
+		utils.FailWithMsg(c, categoryErrMsg(err, "修改分类失败"))
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("categoryId", int64(cat.Id)),
+		attribute.Int64("parent", int64(cat.Parent)),
+		attribute.Bool("disabled", cat.Disabled),
+	)
+
+	utils.SuccessWithMsg(c, "update category success", cat)
+}
+
+//DeleteCategory 删除没有子分类且没有物品使用的分类
+func DeleteCategory(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form DeleteCategoryForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle delete category bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	if err = category.Delete(c.Request.Context(), form.Id, categoryInUse); err != nil {
+		utils.FailWithMsg(c, categoryErrMsg(err, "删除分类失败"))
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("categoryId", int64(form.Id)),
+	)
+
+	utils.SuccessWithMsg(c, "delete category success", nil)
+}
+
+//errFound 找到使用分类的物品后提前结束遍历
+var errFound = errors.New("found")
+
+//categoryInUse 遍历物品检查是否有物品使用该分类,logic服务不能按type查询物品
+func categoryInUse(ctx context.Context, id int32) (bool, error) {
+	err := eachGoodsSummary(ctx, func(goods *proto.Goods) error {
+		if goods.Type == id {
+			return errFound
+		}
+		return nil
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, err
+}
+
+//checkCategory 校验发布物品时选择的分类
+func checkCategory(ctx context.Context, id int32) error {
+	err := category.Check(ctx, id)
+	if err == nil {
+		return nil
+	}
+	return errors.New(categoryErrMsg(err, "内部数据库错误"))
+}
+
+func categoryAttributes(forms []*CategoryAttributeForm) []*category.Attribute {
+	attrs := make([]*category.Attribute, 0, len(forms))
+	for _, f := range forms {
+		attrs = append(attrs, &category.Attribute{
+			Key:      f.Key,
+			Names:    f.Names,
+			Type:     f.Type,
+			Options:  f.Options,
+			Required: f.Required,
+		})
+	}
+	return attrs
+}
+
+//categoryErrMsg 分类校验错误直接返回给用户,其他错误记录日志后返回fallback
+func categoryErrMsg(err error, fallback string) string {
+	for _, e := range []error{category.ErrNotFound, category.ErrExists, category.ErrParent, category.ErrCycle, category.ErrDepth,
+		category.ErrHasChildren, category.ErrName, category.ErrAttribute, category.ErrNotLeaf, category.ErrDisabled, category.ErrInUse} {
+		if errors.Is(err, e) {
+			return e.Error()
+		}
+	}
+	misc.Logger.Error("category err", zap.Error(err))
+	return fallback
+}
+
+//requestLocale 取Accept-Language中优先级最高的语言
+func requestLocale(c *gin.Context) string {
+	lang := c.GetHeader("Accept-Language")
+	if i := strings.IndexAny(lang, ",;"); i >= 0 {
+		lang = lang[:i]
+	}
+	lang = strings.TrimSpace(lang)
+	if lang == "" || lang == "*" {
+		return category.DefaultLocale
+	}
+	return lang
+}
@@ -0,0 +1,333 @@
+package handle
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/chat"
+	"github.com/dopamine-joker/zu_web_server/gateway"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/moderation"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	eventMessage = "message"
+)
+
+//CreateConversation 创建订单或物品的会话,会话已存在时直接返回
+func CreateConversation(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form CreateConversationForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle create conversation bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	conv, err := newConversation(c.Request.Context(), uid, form.Scope, form.Id)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if err = checkBlocked(c.Request.Context(), uid, conv.Members...); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	conv, err = chat.Default.CreateConversation(c.Request.Context(), conv)
+	if err != nil {
+		misc.Logger.Error("create conversation err", zap.Error(err))
+		utils.FailWithMsg(c, "创建会话失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("convId", conv.Id),
+	)
+
+	utils.SuccessWithMsg(c, "create conversation success", conv)
+}
+
+//SendMessage 发送消息,实时推送给会话的其他成员
+func SendMessage(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form SendMessageForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle send message bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	conv, err := getMemberConversation(c.Request.Context(), uid, form.ConvId)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if err = checkBlocked(c.Request.Context(), uid, conv.Members...); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	content, err := moderateText(moderation.KindMessage, form.Content)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	msg := &chat.Message{
+		Sender:  uid,
+		Content: content,
+	}
+	if err = chat.Default.AddMessage(c.Request.Context(), conv, msg); err != nil {
+		misc.Logger.Error("add message err", zap.Error(err))
+		utils.FailWithMsg(c, "发送失败")
+		return
+	}
+
+	for _, member := range conv.Members {
+		publishEvent(c.Request.Context(), gateway.UserChannel(member), &gateway.Event{Type: eventMessage, Data: msg})
+	}
+
+	span.SetAttributes(
+		attribute.String("convId", conv.Id),
+		attribute.Int64("messageId", msg.Id),
+	)
+
+	utils.SuccessWithMsg(c, "send message success", msg)
+}
+
+//GetMessages 分页获取会话消息,before为上一页最早一条消息的id
+func GetMessages(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ListMessageForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle get messages bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	if _, err = getMemberConversation(c.Request.Context(), uid, form.ConvId); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	list, err := chat.Default.Messages(c.Request.Context(), form.ConvId, form.Before, form.Count)
+	if err != nil {
+		misc.Logger.Error("get messages err", zap.Error(err))
+		utils.FailWithMsg(c, "获取消息失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"len":  len(list),
+		"data": list,
+	}
+
+	utils.SuccessWithMsg(c, "get messages success", data)
+}
+
+//GetConversations 获取用户的会话列表及未读数
+func GetConversations(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ListConversationForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle get conversations bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	list, err := chat.Default.ListConversations(c.Request.Context(), uid, *form.Page, *form.Count)
+	if err != nil {
+		misc.Logger.Error("list conversations err", zap.Error(err))
+		utils.FailWithMsg(c, "获取会话失败")
+		return
+	}
+	unread, err := chat.Default.Unread(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("get chat unread err", zap.Error(err))
+		utils.FailWithMsg(c, "获取会话失败")
+		return
+	}
+
+	var dataList []map[string]interface{}
+	for _, conv := range list {
+		dataList = append(dataList, map[string]interface{}{
+			"id":          conv.Id,
+			"scope":       conv.Scope,
+			"scopeId":     conv.ScopeId,
+			"members":     conv.Members,
+			"updateTime":  conv.UpdateTime,
+			"lastMessage": conv.LastMessage,
+			"unread":      unread[conv.Id],
+		})
+	}
+
+	data := map[string]interface{}{
+		"len":  len(dataList),
+		"data": dataList,
+	}
+
+	utils.SuccessWithMsg(c, "get conversations success", data)
+}
+
+//ReadConversation 将会话标记为已读
+func ReadConversation(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ReadConversationForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle read conversation bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	if _, err = getMemberConversation(c.Request.Context(), uid, form.ConvId); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if err = chat.Default.MarkRead(c.Request.Context(), form.ConvId, uid); err != nil {
+		misc.Logger.Error("mark conversation read err", zap.Error(err))
+		utils.FailWithMsg(c, "操作失败")
+		return
+	}
+
+	utils.SuccessWithMsg(c, "read conversation success", nil)
+}
+
+//GetChatUnread 获取所有会话的未读消息总数
+func GetChatUnread(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	unread, err := chat.Default.Unread(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("get chat unread err", zap.Error(err))
+		utils.FailWithMsg(c, "获取未读数失败")
+		return
+	}
+	var total int64
+	for _, n := range unread {
+		total += n
+	}
+
+	data := map[string]interface{}{
+		"total": total,
+		"data":  unread,
+	}
+
+	utils.SuccessWithMsg(c, "get chat unread success", data)
+}
+
+//newConversation 订单会话的成员为买卖双方,物品会话的成员为当前用户和发布者
+func newConversation(ctx context.Context, uid int32, scope string, id int32) (*chat.Conversation, error) {
+	switch scope {
+	case chat.ScopeOrder:
+		order, err := findSellOrder(ctx, uid, id)
+		if errors.Is(err, errOrderNotFound) {
+			order, err = findBuyOrder(ctx, uid, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &chat.Conversation{
+			Id:      chat.ConversationId(scope, id, order.Buyid),
+			Scope:   scope,
+			ScopeId: id,
+			Members: []int32{order.Buyid, order.Sellid},
+		}, nil
+	case chat.ScopeGoods:
+		code, goodsDetail, _, err := rpc.PicList(ctx, &proto.GetGoodsDetailRequest{Gid: id})
+		if err != nil || code == misc.CodeFail {
+			misc.Logger.Error("create conversation rpc goods detail err", zap.Error(err))
+			return nil, errors.New("物品不存在")
+		}
+		if goodsDetail.Uid == uid {
+			return nil, errors.New("不能和自己发起会话")
+		}
+		return &chat.Conversation{
+			Id:      chat.ConversationId(scope, id, uid),
+			Scope:   scope,
+			ScopeId: id,
+			Members: []int32{uid, goodsDetail.Uid},
+		}, nil
+	}
+	return nil, errors.New("会话类型错误")
+}
+
+//getMemberConversation 获取用户参与的会话
+func getMemberConversation(ctx context.Context, uid int32, id string) (*chat.Conversation, error) {
+	conv, err := chat.Default.GetConversation(ctx, id)
+	if err != nil {
+		if errors.Is(err, chat.ErrNotFound) {
+			return nil, err
+		}
+		misc.Logger.Error("get conversation err", zap.Error(err))
+		return nil, errors.New("获取会话失败")
+	}
+	if !conv.IsMember(uid) {
+		return nil, chat.ErrNotMember
+	}
+	return conv, nil
+}
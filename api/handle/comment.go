@@ -1,9 +1,18 @@
 package handle
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/comment"
 	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/moderation"
+	"github.com/dopamine-joker/zu_web_server/notify"
 	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/rating"
 	"github.com/dopamine-joker/zu_web_server/utils"
 
 	"github.com/gin-gonic/gin"
@@ -12,6 +21,10 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	reviewReserveExpire = 30 * time.Second
+)
+
 func AddComment(c *gin.Context) {
 	span := trace.SpanFromContext(c.Request.Context())
 	defer span.End()
@@ -31,17 +44,67 @@ func AddComment(c *gin.Context) {
 		return
 	}
 
+	// 只有已完成订单的买家才能对对应物品评分
+	order, err := findBuyOrder(c.Request.Context(), uid, form.OId)
+	if err != nil {
+		misc.Logger.Error("add comment find order err", zap.Error(err))
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if order.GId != form.GId {
+		utils.FailWithMsg(c, "订单与物品不匹配")
+		return
+	}
+	if order.Status != misc.OrderStatusFinished {
+		utils.FailWithMsg(c, "订单完成后才能评价")
+		return
+	}
+
+	action, texts, reasons := moderation.Default.CheckAll(moderation.KindComment, form.Content)
+	if action == moderation.ActionReject {
+		misc.Logger.Info("comment rejected by moderation", zap.Int32("uid", uid), zap.Strings("reasons", reasons))
+		utils.FailWithMsg(c, "评价包含违规内容")
+		return
+	}
+
+	// 进入人工审核的评价在排队期间占用订单名额,审核驳回或内容过期后释放
+	reserveExpire := reviewReserveExpire
+	if action == moderation.ActionReview {
+		reserveExpire = queuedReviewExpire(time.Now().Unix())
+	}
+	if err = comment.ReserveOrder(c.Request.Context(), order.Id, reserveExpire); err != nil {
+		misc.Logger.Error("reserve order review err", zap.Error(err))
+		if errors.Is(err, comment.ErrOrderReviewed) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		utils.FailWithMsg(c, "添加失败")
+		return
+	}
+
 	req := &proto.AddCommentRequest{
 		Uid:     uid,
 		Gid:     form.GId,
 		Oid:     form.OId,
 		Level:   form.Level,
-		Content: form.Content,
+		Content: texts[0],
 	}
 
-	code, cid, err := rpc.AddComment(c.Request.Context(), req)
-	if err != nil || code == misc.CodeFail {
-		misc.Logger.Error("rpc add comment err", zap.Error(err))
+	if action == moderation.ActionReview {
+		if err = enqueueModeration(c.Request.Context(), moderation.KindComment, uid, order.Sellid, texts, reasons, req); err != nil {
+			misc.Logger.Error("enqueue comment moderation err", zap.Error(err))
+			if err = comment.ReleaseOrder(c.Request.Context(), order.Id); err != nil {
+				misc.Logger.Error("release order review err", zap.Error(err))
+			}
+			utils.FailWithMsg(c, "添加失败")
+			return
+		}
+		utils.SuccessWithMsg(c, "comment is waiting for review", map[string]interface{}{"queued": true})
+		return
+	}
+
+	cid, err := submitComment(c.Request.Context(), req, order.Sellid)
+	if err != nil {
 		utils.FailWithMsg(c, "添加失败")
 		return
 	}
@@ -51,12 +114,13 @@ func AddComment(c *gin.Context) {
 		attribute.Int64("goodsId", int64(form.GId)),
 		attribute.Int64("orderId", int64(form.OId)),
 		attribute.Int64("level", int64(form.Level)),
-		attribute.String("content", form.Content),
-		attribute.Int64("code", int64(code)),
+		attribute.String("content", req.Content),
+		attribute.String("moderation", action.String()),
 	)
 
 	data := map[string]interface{}{
-		"cid": cid,
+		"cid":    cid,
+		"queued": false,
 	}
 
 	utils.SuccessWithMsg(c, "add comment success", data)
@@ -81,21 +145,13 @@ func DeleteComment(c *gin.Context) {
 		return
 	}
 
-	req := &proto.DeleteCommentRequest{
-		Uid: uid,
-		Cid: form.CId,
-	}
-
-	code, err := rpc.DeleteComment(c.Request.Context(), req)
-	if err != nil || code == misc.CodeFail {
-		misc.Logger.Error("rpc delete comment err", zap.Error(err))
-		utils.FailWithMsg(c, "删除失败")
+	if err = removeComment(c.Request.Context(), uid, form.CId); err != nil {
+		utils.FailWithMsg(c, err.Error())
 		return
 	}
 
 	span.SetAttributes(
 		attribute.Int64("commentId", int64(form.CId)),
-		attribute.Int64("code", int64(code)),
 	)
 
 	utils.SuccessWithMsg(c, "delete comment success", nil)
@@ -123,20 +179,34 @@ func GetCommentByUserId(c *gin.Context) {
 		return
 	}
 
+	cids := make([]int32, 0, len(protoList))
+	for _, userComment := range protoList {
+		cids = append(cids, userComment.Id)
+	}
+	reviews, err := comment.Reviews(c.Request.Context(), cids)
+	if err != nil {
+		misc.Logger.Error("get comment reviews err", zap.Error(err))
+		utils.FailWithMsg(c, "获取评论失败")
+		return
+	}
+
 	var list []map[string]interface{}
 
-	for _, comment := range protoList {
+	for _, userComment := range protoList {
+		if r, ok := reviews[userComment.Id]; ok && r.EditTime > 0 {
+			userComment.Level, userComment.Content = r.Level, r.Content
+		}
 		list = append(list, map[string]interface{}{
-			"id":        comment.Id,
-			"uid":       comment.Uid,
-			"gid":       comment.Gid,
-			"oid":       comment.Oid,
-			"content":   comment.Content,
-			"level":     comment.Level,
-			"time":      comment.Time,
-			"goodsName": comment.Name,
-			"price":     comment.Price,
-			"cover":     comment.Cover,
+			"id":        userComment.Id,
+			"uid":       userComment.Uid,
+			"gid":       userComment.Gid,
+			"oid":       userComment.Oid,
+			"content":   userComment.Content,
+			"level":     userComment.Level,
+			"time":      userComment.Time,
+			"goodsName": userComment.Name,
+			"price":     userComment.Price,
+			"cover":     userComment.Cover,
 		})
 	}
 
@@ -176,19 +246,67 @@ func GetCommentByGoodsId(c *gin.Context) {
 		return
 	}
 
+	cids := make([]int32, 0, len(protoList))
+	for _, goodsComment := range protoList {
+		cids = append(cids, goodsComment.Id)
+	}
+	reviews, err := comment.Reviews(c.Request.Context(), cids)
+	if err != nil {
+		misc.Logger.Error("get comment reviews err", zap.Error(err))
+		utils.FailWithMsg(c, "获取评论失败")
+		return
+	}
+	tombstones, err := comment.Tombstones(c.Request.Context(), form.GId)
+	if err != nil {
+		misc.Logger.Error("get comment tombstones err", zap.Error(err))
+		utils.FailWithMsg(c, "获取评论失败")
+		return
+	}
+	for _, t := range tombstones {
+		cids = append(cids, t.Cid)
+	}
+	trees, err := replyTrees(c.Request.Context(), cids)
+	if err != nil {
+		misc.Logger.Error("get comment replies err", zap.Error(err), zap.Int32("gid", form.GId))
+		utils.FailWithMsg(c, "获取评论失败")
+		return
+	}
+
 	var list []map[string]interface{}
 
-	for _, comment := range protoList {
+	for _, goodsComment := range protoList {
+		var editTime int64
+		if r, ok := reviews[goodsComment.Id]; ok && r.EditTime > 0 {
+			goodsComment.Level, goodsComment.Content, editTime = r.Level, r.Content, r.EditTime
+		}
 		list = append(list, map[string]interface{}{
-			"id":       comment.Id,
-			"uid":      comment.Uid,
-			"gid":      comment.Gid,
-			"oid":      comment.Oid,
-			"content":  comment.Content,
-			"level":    comment.Level,
-			"time":     comment.Time,
-			"userName": comment.Uname,
-			"userFace": comment.Uface,
+			"id":       goodsComment.Id,
+			"uid":      goodsComment.Uid,
+			"gid":      goodsComment.Gid,
+			"oid":      goodsComment.Oid,
+			"content":  goodsComment.Content,
+			"level":    goodsComment.Level,
+			"time":     goodsComment.Time,
+			"userName": goodsComment.Uname,
+			"userFace": goodsComment.Uface,
+			"editTime": editTime,
+			"deleted":  false,
+			"replies":  trees[goodsComment.Id],
+		})
+	}
+
+	for _, t := range tombstones {
+		replies := trees[t.Cid]
+		if len(replies) == 0 {
+			continue
+		}
+		list = append(list, map[string]interface{}{
+			"id":      t.Cid,
+			"gid":     t.Gid,
+			"oid":     t.Oid,
+			"time":    t.Time,
+			"deleted": true,
+			"replies": replies,
 		})
 	}
 
@@ -204,3 +322,354 @@ func GetCommentByGoodsId(c *gin.Context) {
 
 	utils.SuccessWithMsg(c, "get goods comments success", data)
 }
+
+//AddCommentReply 回复评价或评价下的回复,物品卖家对每条评价只能回复一次
+func AddCommentReply(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form AddReplyForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle add reply bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	user, err := utils.GetContextUser(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	content, err := moderateText(moderation.KindReply, form.Content)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	goodsComment, err := findGoodsComment(ctx, form.GId, form.CId)
+	if err != nil {
+		misc.Logger.Error("add reply find comment err", zap.Error(err))
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	code, goodsDetail, _, err := rpc.PicList(ctx, &proto.GetGoodsDetailRequest{Gid: form.GId})
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("add reply rpc goods detail err", zap.Error(err))
+		utils.FailWithMsg(c, "回复失败")
+		return
+	}
+
+	// 只限制回复,评价本身不受拉黑影响,避免卖家拉黑买家来屏蔽差评
+	others := []int32{goodsComment.Uid, goodsDetail.GetUid()}
+	if form.Parent != 0 {
+		if parent, err := comment.GetReply(ctx, form.Parent); err == nil {
+			others = append(others, parent.Uid)
+		}
+	}
+	if err = checkBlocked(ctx, user.GetId(), others...); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	reply := &comment.Reply{
+		Cid:     form.CId,
+		Gid:     form.GId,
+		Parent:  form.Parent,
+		Uid:     user.GetId(),
+		Uname:   user.GetName(),
+		Uface:   user.GetFace(),
+		Content: content,
+		Seller:  goodsDetail.GetUid() == user.GetId(),
+	}
+	if err = comment.AddReply(ctx, reply); err != nil {
+		misc.Logger.Error("add reply err", zap.Error(err))
+		if errors.Is(err, comment.ErrSellerReply) || errors.Is(err, comment.ErrParentReply) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		utils.FailWithMsg(c, "回复失败")
+		return
+	}
+
+	notifyReply(ctx, goodsComment.Uid, reply)
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(reply.Uid)),
+		attribute.Int64("commentId", int64(reply.Cid)),
+		attribute.Int64("replyId", reply.Id),
+		attribute.Bool("seller", reply.Seller),
+	)
+
+	data := map[string]interface{}{
+		"rid": reply.Id,
+	}
+
+	utils.SuccessWithMsg(c, "add reply success", data)
+}
+
+//DeleteCommentReply 删除自己的回复
+func DeleteCommentReply(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form DeleteReplyForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle delete reply bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	if err = comment.DeleteReply(c.Request.Context(), uid, form.RId); err != nil {
+		misc.Logger.Error("delete reply err", zap.Error(err))
+		if errors.Is(err, comment.ErrNotFound) || errors.Is(err, comment.ErrNotReplyUser) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		utils.FailWithMsg(c, "删除失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("replyId", form.RId),
+	)
+
+	utils.SuccessWithMsg(c, "delete reply success", nil)
+}
+
+//removeComment 删除uid发表的评论,同时清理评分记录,有回复时保留占位
+func removeComment(ctx context.Context, uid, cid int32) error {
+	userComment, err := findUserComment(ctx, uid, cid)
+	if err != nil {
+		misc.Logger.Error("delete comment find comment err", zap.Error(err))
+		return err
+	}
+
+	req := &proto.DeleteCommentRequest{
+		Uid: uid,
+		Cid: cid,
+	}
+
+	code, err := rpc.DeleteComment(ctx, req)
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("rpc delete comment err", zap.Error(err))
+		return errors.New("删除失败")
+	}
+
+	review, err := comment.DeleteReview(ctx, cid)
+	if err != nil {
+		misc.Logger.Error("delete review err", zap.Error(err))
+	}
+	if review != nil {
+		if err = rating.Remove(ctx, review.Gid, review.SellId, review.Level, review.CreateTime); err != nil {
+			misc.Logger.Error("remove rating err", zap.Error(err), zap.Int32("cid", review.Cid))
+		}
+	}
+
+	// 评价下已有回复时保留占位,回复仍然挂在原楼层下
+	hasReplies, err := comment.HasReplies(ctx, cid)
+	if err != nil {
+		misc.Logger.Error("check comment replies err", zap.Error(err))
+	}
+	if hasReplies {
+		tombstone := &comment.Tombstone{
+			Cid:  userComment.Id,
+			Gid:  userComment.Gid,
+			Oid:  userComment.Oid,
+			Time: userComment.Time,
+		}
+		if err = comment.AddTombstone(ctx, tombstone); err != nil {
+			misc.Logger.Error("add comment tombstone err", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+//submitComment 调用rpc添加评价并记录评分,失败时撤回评价并释放订单名额
+func submitComment(ctx context.Context, req *proto.AddCommentRequest, sellId int32) (int32, error) {
+	code, cid, err := rpc.AddComment(ctx, req)
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("rpc add comment err", zap.Error(err))
+		if err := comment.ReleaseOrder(ctx, req.Oid); err != nil {
+			misc.Logger.Error("release order review err", zap.Error(err))
+		}
+		return -1, errors.New("添加失败")
+	}
+
+	review := &comment.Review{
+		Cid:     cid,
+		Oid:     req.Oid,
+		Gid:     req.Gid,
+		Uid:     req.Uid,
+		SellId:  sellId,
+		Level:   req.Level,
+		Content: req.Content,
+	}
+	if err = comment.SaveReview(ctx, review); err != nil {
+		misc.Logger.Error("save review err", zap.Error(err), zap.Int32("cid", cid))
+		// 没有评价记录就无法限制一单一评,撤回已发表的评价
+		code, err := rpc.DeleteComment(ctx, &proto.DeleteCommentRequest{Uid: req.Uid, Cid: cid})
+		if err != nil || code == misc.CodeFail {
+			misc.Logger.Error("rollback comment err", zap.Error(err), zap.Int32("cid", cid), zap.Int32("oid", req.Oid))
+		} else if err = comment.ReleaseOrder(ctx, req.Oid); err != nil {
+			misc.Logger.Error("release order review err", zap.Error(err))
+		}
+		return -1, errors.New("添加失败")
+	}
+	if err = rating.Add(ctx, review.Gid, review.SellId, review.Level, review.CreateTime); err != nil {
+		misc.Logger.Error("add rating err", zap.Error(err), zap.Int32("cid", cid))
+	}
+
+	sendNotification(ctx, &notify.Notification{
+		Uid:     sellId,
+		Type:    notify.TypeComment,
+		Title:   "收到新的评价",
+		Content: fmt.Sprintf("买家给出了%d星评价", req.Level),
+		Data: map[string]interface{}{
+			"cid":   cid,
+			"gid":   req.Gid,
+			"oid":   req.Oid,
+			"level": req.Level,
+		},
+	})
+	return cid, nil
+}
+
+//EditComment 在修改时间窗口内修改自己的评价
+func EditComment(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form EditCommentForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle edit comment bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	content, err := moderateText(moderation.KindComment, form.Content)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	window := time.Duration(misc.Conf.Comment.EditWindow) * time.Second
+	review, oldLevel, err := comment.EditReview(c.Request.Context(), uid, form.CId, form.Level, content, window)
+	if err != nil {
+		misc.Logger.Error("edit review err", zap.Error(err))
+		if errors.Is(err, comment.ErrNotReview) || errors.Is(err, comment.ErrEditExpired) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		utils.FailWithMsg(c, "修改失败")
+		return
+	}
+
+	if oldLevel != review.Level {
+		if err = rating.Remove(c.Request.Context(), review.Gid, review.SellId, oldLevel, review.CreateTime); err != nil {
+			misc.Logger.Error("remove rating err", zap.Error(err), zap.Int32("cid", review.Cid))
+		} else if err = rating.Add(c.Request.Context(), review.Gid, review.SellId, review.Level, review.CreateTime); err != nil {
+			misc.Logger.Error("add rating err", zap.Error(err), zap.Int32("cid", review.Cid))
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+		attribute.Int64("commentId", int64(form.CId)),
+		attribute.Int64("level", int64(form.Level)),
+	)
+
+	data := map[string]interface{}{
+		"cid":      review.Cid,
+		"editTime": review.EditTime,
+	}
+
+	utils.SuccessWithMsg(c, "edit comment success", data)
+}
+
+//findUserComment 从用户发表的评论中查找评论
+func findUserComment(ctx context.Context, uid, cid int32) (*proto.UserComment, error) {
+	code, list, err := rpc.GetCommentByUserId(ctx, &proto.GetCommentByUserIdRequest{Uid: uid})
+	if err != nil || code == misc.CodeFail {
+		return nil, errors.New("获取评论失败")
+	}
+	for _, userComment := range list {
+		if userComment.Id == cid {
+			return userComment, nil
+		}
+	}
+	return nil, errors.New("评论不存在")
+}
+
+//findGoodsComment 从物品的评论中查找评论
+func findGoodsComment(ctx context.Context, gid, cid int32) (*proto.GoodsComment, error) {
+	code, list, err := rpc.GetCommentByGoodsId(ctx, &proto.GetCommentByGoodsIdRequest{Gid: gid})
+	if err != nil || code == misc.CodeFail {
+		return nil, errors.New("获取评论失败")
+	}
+	for _, goodsComment := range list {
+		if goodsComment.Id == cid {
+			return goodsComment, nil
+		}
+	}
+	return nil, errors.New("评论不存在")
+}
+
+//notifyReply 通知被回复的评价作者和上级回复的作者
+func notifyReply(ctx context.Context, author int32, reply *comment.Reply) {
+	to := []int32{author}
+	if reply.Parent != 0 {
+		if parent, err := comment.GetReply(ctx, reply.Parent); err == nil && parent.Uid != author {
+			to = append(to, parent.Uid)
+		}
+	}
+	for _, uid := range to {
+		if uid == reply.Uid {
+			continue
+		}
+		sendNotification(ctx, &notify.Notification{
+			Uid:     uid,
+			Type:    notify.TypeReply,
+			Title:   "收到新的回复",
+			Content: fmt.Sprintf("%s 回复了你: %s", reply.Uname, reply.Content),
+			Data: map[string]interface{}{
+				"cid": reply.Cid,
+				"gid": reply.Gid,
+				"rid": reply.Id,
+			},
+		})
+	}
+}
+
+//replyTrees 批量获取评价的回复树
+func replyTrees(ctx context.Context, cids []int32) (map[int32][]*comment.Node, error) {
+	replies, err := comment.Replies(ctx, cids)
+	if err != nil {
+		return nil, err
+	}
+	trees := make(map[int32][]*comment.Node, len(replies))
+	for cid, list := range replies {
+		trees[cid] = comment.BuildTree(list)
+	}
+	return trees, nil
+}
@@ -0,0 +1,350 @@
+package handle
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/account"
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/block"
+	"github.com/dopamine-joker/zu_web_server/campus"
+	"github.com/dopamine-joker/zu_web_server/chat"
+	"github.com/dopamine-joker/zu_web_server/comment"
+	"github.com/dopamine-joker/zu_web_server/favorite"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/notify"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/rbac"
+	"github.com/dopamine-joker/zu_web_server/totp"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/dopamine-joker/zu_web_server/watch"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	deletionInterval = time.Minute
+	deletionBatch    = 100
+	// 还有进行中的订单或处理失败时推迟的时间
+	deletionRetry = 24 * time.Hour
+
+	deletedName = "已注销用户"
+)
+
+//DeleteAccount 重新验证身份后申请注销,宽限期内可以撤销
+func DeleteAccount(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form DeleteAccountForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle delete account bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	user, err := utils.GetContextUser(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err = reauthenticate(ctx, user, form.Password, form.Code); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	open, _, err := userOrders(ctx, user.GetId())
+	if err != nil {
+		misc.Logger.Error("delete account get orders err", zap.Error(err))
+		utils.FailWithMsg(c, "申请失败")
+		return
+	}
+	if len(open) > 0 {
+		data := map[string]interface{}{
+			"orders": orderIds(open),
+		}
+		utils.ResponseWithCode(c, misc.CodeFail, "请先完成进行中的订单", data)
+		return
+	}
+
+	deleteAt := time.Now().Add(time.Duration(misc.Conf.Account.DeleteGrace) * time.Second)
+	if err = account.ScheduleDeletion(ctx, user.GetId(), deleteAt); err != nil {
+		misc.Logger.Error("schedule deletion err", zap.Error(err))
+		utils.FailWithMsg(c, "申请失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(user.GetId())),
+		attribute.Int64("deleteAt", deleteAt.Unix()),
+	)
+
+	data := map[string]interface{}{
+		"deleteAt": deleteAt.Unix(),
+	}
+
+	utils.SuccessWithMsg(c, "delete account success", data)
+}
+
+//CancelDeleteAccount 宽限期内撤销注销申请
+func CancelDeleteAccount(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ok, err := account.CancelDeletion(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("cancel deletion err", zap.Error(err))
+		utils.FailWithMsg(c, "撤销失败")
+		return
+	}
+	if !ok {
+		utils.FailWithMsg(c, "没有待处理的注销申请")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+	)
+
+	utils.SuccessWithMsg(c, "cancel delete account success", nil)
+}
+
+//GetDeleteStatus 获取注销申请的执行时间,没有申请时为0
+func GetDeleteStatus(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	deleteAt, err := account.DeletionTime(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("get deletion time err", zap.Error(err))
+		utils.FailWithMsg(c, "获取失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"deleteAt": deleteAt,
+	}
+
+	utils.SuccessWithMsg(c, "get delete status success", data)
+}
+
+//RunAccountDeletion 定期执行宽限期已过的注销申请,ctx结束后退出
+func RunAccountDeletion(ctx context.Context) {
+	ticker := time.NewTicker(deletionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			processDeletions(ctx)
+		}
+	}
+}
+
+func processDeletions(ctx context.Context) {
+	uids, err := account.DueDeletions(ctx, time.Now(), deletionBatch)
+	if err != nil {
+		misc.Logger.Error("get due deletions err", zap.Error(err))
+		return
+	}
+	for _, uid := range uids {
+		claimed, err := account.ClaimDeletion(ctx, uid)
+		if err != nil || !claimed {
+			continue
+		}
+		if err = deleteAccount(ctx, uid); err != nil {
+			misc.Logger.Error("delete account err", zap.Error(err), zap.Int32("uid", uid))
+			if err = account.ScheduleDeletion(ctx, uid, time.Now().Add(deletionRetry)); err != nil {
+				misc.Logger.Error("reschedule deletion err", zap.Error(err), zap.Int32("uid", uid))
+			}
+		}
+	}
+}
+
+//deleteAccount 取消待确认的订单,删除物品和收藏,匿名化logic服务中的用户并清理本服务的数据,
+//包括回复、会话消息、收藏夹、通知和角色
+//logic服务没有删除用户的接口,只能把资料改为匿名并设置随机密码
+func deleteAccount(ctx context.Context, uid int32) error {
+	profile, err := account.GetProfile(ctx, uid)
+	if err != nil {
+		return err
+	}
+	open, created, err := userOrders(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if len(open) > 0 {
+		sendNotification(ctx, &notify.Notification{
+			Uid:     uid,
+			Type:    notify.TypeAccount,
+			Title:   "账号注销已推迟",
+			Content: "你还有进行中的订单,订单完成后将继续注销",
+			Data: map[string]interface{}{
+				"orders": orderIds(open),
+			},
+		})
+		return account.ScheduleDeletion(ctx, uid, time.Now().Add(deletionRetry))
+	}
+	if err = account.MarkDeleted(ctx, uid); err != nil {
+		return err
+	}
+
+	for _, order := range created {
+		code, err := rpc.UpdateOrder(ctx, &proto.UpdateOrderRequest{Id: order.Id, Uid: uid, Status: misc.OrderStatusCanceled})
+		if err = rpcErr(code, err); err != nil {
+			return fmt.Errorf("cancel order %d: %w", order.Id, err)
+		}
+		notifyOrderStatus(ctx, order, misc.OrderStatusCanceled, uid)
+	}
+
+	code, goods, err := rpc.GetUserGoods(ctx, &proto.GetUserGoodsListRequest{Uid: uid})
+	if err = rpcErr(code, err); err != nil {
+		return err
+	}
+	for _, g := range goods {
+		code, err := rpc.DeleteGoods(ctx, &proto.DeleteGoodsRequest{Uid: uid, Gid: g.Gid})
+		if err = rpcErr(code, err); err != nil {
+			return fmt.Errorf("delete goods %d: %w", g.Gid, err)
+		}
+		changeAvailability(ctx, g.Gid, g.Name, false, uid)
+	}
+
+	code, favorites, err := rpc.GetUserFavorites(ctx, &proto.GetUserFavoritesRequest{Uid: uid})
+	if err = rpcErr(code, err); err != nil {
+		return err
+	}
+	for _, f := range favorites {
+		code, err := rpc.DeleteFavorites(ctx, &proto.DeleteFavoritesRequest{Uid: uid, Fid: f.Id})
+		if err = rpcErr(code, err); err != nil {
+			return fmt.Errorf("delete favorites %d: %w", f.Id, err)
+		}
+		if _, err = favorite.Unclaim(ctx, uid, f.Gid); err != nil {
+			return err
+		}
+		if err = watch.Unsubscribe(ctx, uid, f.Gid); err != nil {
+			return err
+		}
+	}
+
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return err
+	}
+	anonymous := &proto.UpdateUserRequest{
+		Uid:      uid,
+		Email:    fmt.Sprintf("deleted-%d@deleted.invalid", uid),
+		Name:     deletedName,
+		Password: hex.EncodeToString(b),
+	}
+	code, err = rpc.UpdateUser(ctx, anonymous)
+	if err = rpcErr(code, err); err != nil {
+		return err
+	}
+
+	if err = totp.Disable(ctx, uid); err != nil {
+		return err
+	}
+	if err = campus.RemoveBadge(ctx, uid); err != nil {
+		return err
+	}
+	if err = block.Clear(ctx, uid); err != nil {
+		return err
+	}
+	if err = comment.PurgeUser(ctx, uid); err != nil {
+		return err
+	}
+	if err = chat.Default.Purge(ctx, uid); err != nil {
+		return err
+	}
+	if err = favorite.Purge(ctx, uid); err != nil {
+		return err
+	}
+	if err = notify.Purge(ctx, uid); err != nil {
+		return err
+	}
+	if err = rbac.SetRole(ctx, uid, rbac.RoleUser); err != nil {
+		return err
+	}
+	if err = account.Purge(ctx, uid, profile.Email); err != nil {
+		return err
+	}
+	misc.Logger.Info("account deleted", zap.Int32("uid", uid))
+	return nil
+}
+
+//reauthenticate 敏感操作前重新校验密码,开启两步验证时还需要动态验证码
+func reauthenticate(ctx context.Context, user *proto.User, password, code string) error {
+	rpcCode, token, _, err := rpc.Login(ctx, &proto.LoginRequest{Email: user.GetEmail(), Password: password})
+	if err != nil || rpcCode == misc.CodeFail {
+		return errors.New("密码错误")
+	}
+	revokeToken(ctx, token)
+	enabled, err := totp.Enabled(ctx, user.GetId())
+	if err != nil {
+		misc.Logger.Error("get totp enabled err", zap.Error(err))
+		return errors.New("验证失败")
+	}
+	if !enabled {
+		return nil
+	}
+	if code == "" {
+		return errors.New("请输入两步验证码")
+	}
+	if err = totp.Check(ctx, user.GetId(), code); err != nil {
+		return errors.New(totpErrMsg(err, "验证失败"))
+	}
+	return nil
+}
+
+//userOrders 用户作为买家和卖家的订单中,进行中的订单和待卖家确认的订单
+func userOrders(ctx context.Context, uid int32) (open, created []*proto.Order, err error) {
+	code, buy, err := rpc.GetBuyOrder(ctx, &proto.GetBuyOrderRequest{Buyid: uid})
+	if err = rpcErr(code, err); err != nil {
+		return nil, nil, err
+	}
+	code, sell, err := rpc.GetSellOrder(ctx, &proto.GetSellOrderRequest{Sellid: uid})
+	if err = rpcErr(code, err); err != nil {
+		return nil, nil, err
+	}
+	for _, order := range append(buy, sell...) {
+		switch order.Status {
+		case misc.OrderStatusCreated:
+			created = append(created, order)
+		case misc.OrderStatusAccepted, misc.OrderStatusPaid, misc.OrderStatusDisputed:
+			open = append(open, order)
+		}
+	}
+	return open, created, nil
+}
+
+func orderIds(orders []*proto.Order) []int32 {
+	ids := make([]int32, 0, len(orders))
+	for _, order := range orders {
+		ids = append(ids, order.Id)
+	}
+	return ids
+}
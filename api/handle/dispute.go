@@ -0,0 +1,511 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/dispute"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/payment"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/rbac"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	uploadEvidenceKey = "evidence"
+)
+
+//OpenDispute 买家或卖家对订单发起纠纷,multipart/form-data,凭证图片字段为evidence
+func OpenDispute(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form OpenDisputeForm
+	var err error
+	if err = c.ShouldBind(&form); err != nil {
+		misc.Logger.Error("handle open dispute bind err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	order, err := findOrder(c.Request.Context(), uid, form.OId)
+	if err != nil {
+		misc.Logger.Error("open dispute find order err", zap.Error(err))
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	// 只有已支付的订单才有可退还的款项
+	if order.Status != misc.OrderStatusPaid {
+		utils.FailWithMsg(c, "订单当前状态无法发起纠纷")
+		return
+	}
+
+	multipartForm, err := c.MultipartForm()
+	if err != nil {
+		misc.Logger.Error("open dispute multipartForm err", zap.Error(err))
+		utils.FailWithMsg(c, "请求出错")
+		return
+	}
+	headers := multipartForm.File[uploadEvidenceKey]
+	if len(headers) > misc.Conf.Dispute.MaxEvidence {
+		utils.FailWithMsg(c, "凭证图片过多")
+		return
+	}
+	for _, h := range headers {
+		if err = dispute.CheckEvidenceName(h.Filename); err != nil {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+	}
+	files, err := readFormFiles(multipartForm, uploadEvidenceKey)
+	if err != nil {
+		misc.Logger.Error("evidence file read err", zap.Error(err))
+		utils.FailWithMsg(c, "图片解码出现问题")
+		return
+	}
+
+	evidenceDir := misc.Conf.Dispute.EvidenceDir
+	var evidence []string
+	for _, file := range files {
+		fileName, err := dispute.SaveEvidence(evidenceDir, file.Name, file.Content)
+		if err != nil {
+			misc.Logger.Error("save evidence err", zap.Error(err))
+			dispute.RemoveEvidence(evidenceDir, evidence)
+			utils.FailWithMsg(c, "凭证保存失败")
+			return
+		}
+		evidence = append(evidence, fileName)
+	}
+
+	d := &dispute.Dispute{
+		Oid:      order.Id,
+		Gid:      order.GId,
+		BuyId:    order.Buyid,
+		SellId:   order.Sellid,
+		Creator:  uid,
+		Reason:   form.Reason,
+		Evidence: evidence,
+	}
+	if err = dispute.Create(c.Request.Context(), d); err != nil {
+		misc.Logger.Error("create dispute err", zap.Error(err))
+		dispute.RemoveEvidence(evidenceDir, evidence)
+		if errors.Is(err, dispute.ErrExist) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		utils.FailWithMsg(c, "发起纠纷失败")
+		return
+	}
+
+	req := &proto.UpdateOrderRequest{
+		Id:     order.Id,
+		Uid:    uid,
+		Status: misc.OrderStatusDisputed,
+	}
+	code, err := rpc.UpdateOrder(c.Request.Context(), req)
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("dispute rpc update order err", zap.Error(err), zap.Int32("oid", order.Id))
+		// 订单没有进入纠纷状态时撤销纠纷,避免订单在纠纷之外继续流转
+		if err = dispute.Remove(c.Request.Context(), d); err != nil {
+			misc.Logger.Error("remove dispute err", zap.Error(err), zap.Int64("did", d.Id))
+		}
+		dispute.RemoveEvidence(evidenceDir, evidence)
+		utils.FailWithMsg(c, "发起纠纷失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("disputeId", d.Id),
+		attribute.Int64("orderId", int64(order.Id)),
+		attribute.Int("evidence", len(evidence)),
+	)
+
+	data := map[string]interface{}{
+		"did": d.Id,
+	}
+
+	utils.SuccessWithMsg(c, "open dispute success", data)
+}
+
+//AddDisputeMessage 当事人或管理员补充说明
+func AddDisputeMessage(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form DisputeMessageForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle dispute message bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	d, err := getVisibleDispute(c.Request.Context(), uid, utils.HasPermission(c, rbac.PermDispute), form.DId)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if d.Status != dispute.StatusOpen {
+		utils.FailWithMsg(c, dispute.ErrClosed.Error())
+		return
+	}
+
+	msg := &dispute.Message{
+		Uid:     uid,
+		Content: form.Content,
+		Time:    time.Now().Unix(),
+	}
+	if err = dispute.AddMessage(c.Request.Context(), d.Id, msg); err != nil {
+		misc.Logger.Error("add dispute message err", zap.Error(err))
+		utils.FailWithMsg(c, "添加失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("disputeId", d.Id),
+	)
+
+	utils.SuccessWithMsg(c, "add dispute message success", nil)
+}
+
+//GetDisputeDetail 纠纷详情及沟通记录
+func GetDisputeDetail(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form DisputeDetailForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle dispute detail bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	d, err := getVisibleDispute(c.Request.Context(), uid, utils.HasPermission(c, rbac.PermDispute), form.DId)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	messages, err := dispute.Messages(c.Request.Context(), d.Id)
+	if err != nil {
+		misc.Logger.Error("get dispute messages err", zap.Error(err))
+		utils.FailWithMsg(c, "获取纠纷失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("disputeId", d.Id),
+	)
+
+	data := map[string]interface{}{
+		"dispute":  d,
+		"messages": messages,
+	}
+
+	utils.SuccessWithMsg(c, "get dispute detail success", data)
+}
+
+//GetDisputeEvidence 下载凭证图片,仅当事人和管理员可见
+func GetDisputeEvidence(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form DisputeEvidenceForm
+	var err error
+	if err = c.ShouldBindQuery(&form); err != nil {
+		misc.Logger.Error("handle dispute evidence bind query err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	d, err := getVisibleDispute(c.Request.Context(), uid, utils.HasPermission(c, rbac.PermDispute), form.DId)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if !utils.IsContain(d.Evidence, form.Name) {
+		utils.FailWithMsg(c, "凭证不存在")
+		return
+	}
+	path, err := dispute.EvidencePath(misc.Conf.Dispute.EvidenceDir, form.Name)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	c.File(path)
+}
+
+//GetUserDisputes 用户参与的纠纷
+func GetUserDisputes(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	list, err := dispute.ListUser(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("list user dispute err", zap.Error(err))
+		utils.FailWithMsg(c, "获取纠纷失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"len":  len(list),
+		"data": list,
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+	)
+
+	utils.SuccessWithMsg(c, "get user disputes success", data)
+}
+
+//ListOpenDisputes 管理员查看待处理纠纷
+func ListOpenDisputes(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ListDisputeForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle list dispute bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	list, err := dispute.ListOpen(c.Request.Context(), *form.Page, *form.Count)
+	if err != nil {
+		misc.Logger.Error("list open dispute err", zap.Error(err))
+		utils.FailWithMsg(c, "获取纠纷失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"len":  len(list),
+		"data": list,
+	}
+
+	utils.SuccessWithMsg(c, "list open disputes success", data)
+}
+
+//ResolveDispute 管理员处理纠纷,按结果退还押金并结束订单
+func ResolveDispute(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ResolveDisputeForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle resolve dispute bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	d, err := dispute.Get(ctx, form.DId)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if d.Status == dispute.StatusResolved {
+		utils.FailWithMsg(c, dispute.ErrClosed.Error())
+		return
+	}
+	if form.Result == dispute.ResultPartial && form.Amount <= 0 {
+		utils.FailWithMsg(c, "部分退款需要填写金额")
+		return
+	}
+
+	order, err := findSellOrder(ctx, d.SellId, d.Oid)
+	if err != nil {
+		misc.Logger.Error("resolve dispute find order err", zap.Error(err))
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	// 处理中的纠纷在重试前可能已经推进了订单状态
+	if d.Status == dispute.StatusOpen && order.Status != misc.OrderStatusDisputed {
+		utils.FailWithMsg(c, "订单当前状态无法处理纠纷")
+		return
+	}
+
+	var refundFrom int64
+	if form.Result != dispute.ResultReject {
+		intent, err := payment.GetOrderIntent(ctx, order.Id)
+		if err != nil {
+			misc.Logger.Error("resolve dispute get order intent err", zap.Error(err), zap.Int32("oid", order.Id))
+			utils.FailWithMsg(c, "订单没有支付记录")
+			return
+		}
+		refundFrom = intent.Refunded
+	}
+	amount := form.Amount
+	if form.Result != dispute.ResultPartial {
+		amount = 0
+	}
+	// 先记录处理结果再退款,重试时沿用记录的结果和退款,不会重复退款
+	d, err = dispute.BeginResolve(ctx, d.Id, form.Result, amount, form.Remark, refundFrom)
+	if errors.Is(err, dispute.ErrResolving) || errors.Is(err, dispute.ErrClosed) {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if err != nil {
+		misc.Logger.Error("begin resolve dispute err", zap.Error(err))
+		utils.FailWithMsg(c, "处理失败")
+		return
+	}
+
+	status := int32(misc.OrderStatusFinished)
+	if d.Result != dispute.ResultReject {
+		intent, err := disputeRefund(ctx, d, order)
+		if err != nil {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		if intent.Status == payment.IntentRefunded {
+			status = misc.OrderStatusRefunded
+		}
+	}
+
+	// 全额退款时refundOrder已经尝试推进订单状态,重新获取后只补做未完成的变更
+	if order, err = findSellOrder(ctx, d.SellId, d.Oid); err != nil {
+		misc.Logger.Error("resolve dispute find order err", zap.Error(err))
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if order.Status != status {
+		req := &proto.UpdateOrderRequest{
+			Id:     order.Id,
+			Uid:    order.Sellid,
+			Status: status,
+		}
+		code, err := rpc.UpdateOrder(ctx, req)
+		if err != nil || code == misc.CodeFail {
+			misc.Logger.Error("resolve dispute rpc update order err", zap.Error(err), zap.Int32("oid", order.Id))
+			utils.FailWithMsg(c, "订单状态更新失败,请重试")
+			return
+		}
+		if status == misc.OrderStatusFinished {
+			recordFinishedOrder(ctx, order)
+		}
+	}
+
+	if err = dispute.Resolve(ctx, d); err != nil {
+		misc.Logger.Error("resolve dispute err", zap.Error(err))
+		utils.FailWithMsg(c, "处理失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("adminId", int64(uid)),
+		attribute.Int64("disputeId", d.Id),
+		attribute.String("result", d.Result),
+		attribute.Int64("refund", d.Refund),
+	)
+
+	utils.SuccessWithMsg(c, "resolve dispute success", d)
+}
+
+//disputeRefund 按纠纷记录的结果退款并记录退款单号。
+//上次请求退款成功后中断时,支付单的已退金额会超过处理前的金额,直接沿用支付单上的退款
+func disputeRefund(ctx context.Context, d *dispute.Dispute, order *proto.Order) (*payment.Intent, error) {
+	intent, err := payment.GetOrderIntent(ctx, order.Id)
+	if err != nil {
+		misc.Logger.Error("dispute refund get order intent err", zap.Error(err), zap.Int32("oid", order.Id))
+		return nil, errors.New("订单没有支付记录")
+	}
+	if d.RefundId != "" {
+		return intent, nil
+	}
+	if intent.Refunded > d.RefundFrom {
+		d.RefundId, d.Refund = intent.LastRefund, intent.Refunded-d.RefundFrom
+	} else {
+		var refund *payment.Refund
+		if intent, refund, err = refundOrder(ctx, order, d.Refund); err != nil {
+			return nil, err
+		}
+		d.RefundId, d.Refund = refund.Id, refund.Amount
+	}
+	_, err = dispute.Update(ctx, d.Id, func(cur *dispute.Dispute) error {
+		cur.RefundId, cur.Refund = d.RefundId, d.Refund
+		return nil
+	})
+	if err != nil {
+		misc.Logger.Error("record dispute refund err", zap.Error(err), zap.Int64("did", d.Id))
+		return nil, errors.New("处理失败")
+	}
+	return intent, nil
+}
+
+//findOrder 查找用户作为买家或卖家的订单
+func findOrder(ctx context.Context, uid, oid int32) (*proto.Order, error) {
+	order, err := findBuyOrder(ctx, uid, oid)
+	if err == nil || !errors.Is(err, errOrderNotFound) {
+		return order, err
+	}
+	return findSellOrder(ctx, uid, oid)
+}
+
+//getVisibleDispute 获取当事人或纠纷处理人员可见的纠纷
+func getVisibleDispute(ctx context.Context, uid int32, privileged bool, did int64) (*dispute.Dispute, error) {
+	d, err := dispute.Get(ctx, did)
+	if err != nil {
+		if !errors.Is(err, dispute.ErrNotFound) {
+			misc.Logger.Error("get dispute err", zap.Error(err))
+		}
+		return nil, dispute.ErrNotFound
+	}
+	if !d.IsParty(uid) && !privileged {
+		return nil, dispute.ErrNotFound
+	}
+	return d, nil
+}
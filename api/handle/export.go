@@ -0,0 +1,246 @@
+package handle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/account"
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/chat"
+	"github.com/dopamine-joker/zu_web_server/comment"
+	"github.com/dopamine-joker/zu_web_server/dispute"
+	"github.com/dopamine-joker/zu_web_server/favorite"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/notify"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	throttleExport = "export"
+	exportPageSize = 100
+)
+
+//exportPart 导出数据的一部分
+type exportPart func(ctx context.Context, uid int32) (interface{}, error)
+
+var exportParts = map[string]exportPart{
+	"goods": func(ctx context.Context, uid int32) (interface{}, error) {
+		code, list, err := rpc.GetUserGoods(ctx, &proto.GetUserGoodsListRequest{Uid: uid})
+		return list, rpcErr(code, err)
+	},
+	"buyOrders": func(ctx context.Context, uid int32) (interface{}, error) {
+		code, list, err := rpc.GetBuyOrder(ctx, &proto.GetBuyOrderRequest{Buyid: uid})
+		return list, rpcErr(code, err)
+	},
+	"sellOrders": func(ctx context.Context, uid int32) (interface{}, error) {
+		code, list, err := rpc.GetSellOrder(ctx, &proto.GetSellOrderRequest{Sellid: uid})
+		return list, rpcErr(code, err)
+	},
+	"comments": func(ctx context.Context, uid int32) (interface{}, error) {
+		code, list, err := rpc.GetCommentByUserId(ctx, &proto.GetCommentByUserIdRequest{Uid: uid})
+		return list, rpcErr(code, err)
+	},
+	"favorites": func(ctx context.Context, uid int32) (interface{}, error) {
+		code, list, err := rpc.GetUserFavorites(ctx, &proto.GetUserFavoritesRequest{Uid: uid})
+		return list, rpcErr(code, err)
+	},
+	"favoriteFolders": func(ctx context.Context, uid int32) (interface{}, error) {
+		return favorite.Folders(ctx, uid)
+	},
+	"reviews": func(ctx context.Context, uid int32) (interface{}, error) {
+		code, list, err := rpc.GetCommentByUserId(ctx, &proto.GetCommentByUserIdRequest{Uid: uid})
+		if err = rpcErr(code, err); err != nil {
+			return nil, err
+		}
+		cids := make([]int32, 0, len(list))
+		for _, c := range list {
+			cids = append(cids, c.Id)
+		}
+		reviews, err := comment.Reviews(ctx, cids)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]*comment.Review, 0, len(reviews))
+		for _, cid := range cids {
+			if r, ok := reviews[cid]; ok {
+				res = append(res, r)
+			}
+		}
+		return res, nil
+	},
+	"replies": func(ctx context.Context, uid int32) (interface{}, error) {
+		return comment.UserReplies(ctx, uid)
+	},
+	"chats":         exportChats,
+	"disputes":      exportDisputes,
+	"notifications": exportNotifications,
+}
+
+//exportChat 一个会话及其全部消息
+type exportChat struct {
+	*chat.Conversation
+	Messages []*chat.Message `json:"messages"`
+}
+
+func exportChats(ctx context.Context, uid int32) (interface{}, error) {
+	var res []*exportChat
+	for page := int64(0); ; page++ {
+		list, err := chat.Default.ListConversations(ctx, uid, page, exportPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, conv := range list {
+			item := &exportChat{Conversation: conv}
+			for before := int64(0); ; {
+				msgs, err := chat.Default.Messages(ctx, conv.Id, before, exportPageSize)
+				if err != nil {
+					return nil, err
+				}
+				item.Messages = append(item.Messages, msgs...)
+				if int64(len(msgs)) < exportPageSize {
+					break
+				}
+				before = msgs[len(msgs)-1].Id
+			}
+			res = append(res, item)
+		}
+		if int64(len(list)) < exportPageSize {
+			return res, nil
+		}
+	}
+}
+
+//exportDispute 一个纠纷及其全部留言
+type exportDispute struct {
+	*dispute.Dispute
+	Messages []*dispute.Message `json:"messages"`
+}
+
+func exportDisputes(ctx context.Context, uid int32) (interface{}, error) {
+	list, err := dispute.ListUser(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*exportDispute, 0, len(list))
+	for _, d := range list {
+		msgs, err := dispute.Messages(ctx, d.Id)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &exportDispute{Dispute: d, Messages: msgs})
+	}
+	return res, nil
+}
+
+func exportNotifications(ctx context.Context, uid int32) (interface{}, error) {
+	var res []*notify.Notification
+	for page := int64(0); ; page++ {
+		list, err := notify.List(ctx, uid, page, exportPageSize)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, list...)
+		if int64(len(list)) < exportPageSize {
+			return res, nil
+		}
+	}
+}
+
+//ExportUserData 导出个人数据,以json附件返回
+func ExportUserData(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	user, err := utils.GetContextUser(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	uid := user.GetId()
+	interval := time.Duration(misc.Conf.Account.ExportInterval) * time.Second
+	if err = account.Throttle(ctx, throttleExport, strconv.Itoa(int(uid)), interval, 0); err != nil {
+		if errors.Is(err, account.ErrTooFrequent) {
+			utils.FailWithMsg(c, "导出太频繁,请稍后再试")
+			return
+		}
+		misc.Logger.Error("throttle export err", zap.Error(err))
+		utils.FailWithMsg(c, "导出失败")
+		return
+	}
+
+	archive := map[string]interface{}{
+		"exportTime": time.Now().Unix(),
+		"profile":    user,
+	}
+	if profile, err := account.GetProfile(ctx, uid); err == nil {
+		archive["profile"] = profile
+	}
+	if privacy, err := account.GetPrivacy(ctx, uid); err == nil {
+		archive["privacy"] = privacy
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var partErr error
+	for name, part := range exportParts {
+		wg.Add(1)
+		go func(name string, part exportPart) {
+			defer wg.Done()
+			data, err := part(ctx, uid)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				misc.Logger.Error("export part err", zap.String("part", name), zap.Error(err))
+				partErr = err
+				return
+			}
+			archive[name] = data
+		}(name, part)
+	}
+	wg.Wait()
+	if partErr != nil {
+		utils.FailWithMsg(c, "导出失败")
+		return
+	}
+
+	body, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		misc.Logger.Error("marshal export archive err", zap.Error(err))
+		utils.FailWithMsg(c, "导出失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+		attribute.Int("size", len(body)),
+	)
+
+	filename := fmt.Sprintf("zu-export-%d-%s.json", uid, time.Now().Format("20060102"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+//rpcErr 将rpc的返回码转换为error
+func rpcErr(code int32, err error) error {
+	if err != nil {
+		return err
+	}
+	if code == misc.CodeFail {
+		return errors.New("rpc fail")
+	}
+	return nil
+}
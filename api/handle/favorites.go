@@ -1,10 +1,18 @@
 package handle
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
 	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/favorite"
 	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/notify"
 	"github.com/dopamine-joker/zu_web_server/proto"
 	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/dopamine-joker/zu_web_server/watch"
 
 	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/otel/attribute"
@@ -12,6 +20,7 @@ import (
 	"go.uber.org/zap"
 )
 
+//AddFavorites 收藏物品,重复收藏同一物品时返回已有记录
 func AddFavorites(c *gin.Context) {
 	span := trace.SpanFromContext(c.Request.Context())
 	defer span.End()
@@ -31,30 +40,89 @@ func AddFavorites(c *gin.Context) {
 		return
 	}
 
-	req := &proto.AddFavoritesRequest{
-		Uid: uid,
-		Gid: form.GId,
+	if hiddenGoods(c.Request.Context(), []int32{form.GId})[form.GId] {
+		utils.FailWithMsg(c, "物品已下架")
+		return
 	}
 
-	code, fid, err := rpc.AddFavorites(c.Request.Context(), req)
-	if err != nil || code == misc.CodeFail {
-		misc.Logger.Error("rpc add favorites err", zap.Error(err))
+	folder := favorite.DefaultFolder
+	if form.Folder != nil {
+		folder = *form.Folder
+	}
+	if err = favorite.CheckFolder(c.Request.Context(), uid, folder); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	claimed, err := favorite.Claim(c.Request.Context(), uid, form.GId, folder)
+	if err != nil {
+		misc.Logger.Error("claim favorite err", zap.Error(err))
+		utils.FailWithMsg(c, "添加失败")
+		return
+	}
+	if !claimed && form.Folder != nil {
+		if err = favorite.Move(c.Request.Context(), uid, form.GId, folder); err != nil {
+			misc.Logger.Error("move favorite err", zap.Error(err))
+			utils.FailWithMsg(c, "添加失败")
+			return
+		}
+	}
+
+	// 旧版本可能已经存在收藏记录,不再重复添加
+	fids, err := favoriteIds(c.Request.Context(), uid, form.GId)
+	if err != nil {
+		misc.Logger.Error("rpc get user favorites err", zap.Error(err))
+		if claimed {
+			_, _ = favorite.Unclaim(c.Request.Context(), uid, form.GId)
+		}
 		utils.FailWithMsg(c, "添加失败")
 		return
 	}
 
+	var fid int32
+	if len(fids) > 0 {
+		fid = fids[0]
+	} else {
+		req := &proto.AddFavoritesRequest{
+			Uid: uid,
+			Gid: form.GId,
+		}
+		var code int32
+		code, fid, err = rpc.AddFavorites(c.Request.Context(), req)
+		if err != nil || code == misc.CodeFail {
+			misc.Logger.Error("rpc add favorites err", zap.Error(err))
+			if claimed {
+				_, _ = favorite.Unclaim(c.Request.Context(), uid, form.GId)
+			}
+			utils.FailWithMsg(c, "添加失败")
+			return
+		}
+	}
+
+	if err = watch.Subscribe(c.Request.Context(), uid, form.GId); err != nil {
+		misc.Logger.Error("subscribe goods err", zap.Error(err))
+	}
+	if claimed {
+		notifyFavorited(c.Request.Context(), uid, form.GId)
+	}
+
 	span.SetAttributes(
 		attribute.Int64("goodsId", int64(form.GId)),
-		attribute.Int64("code", int64(code)),
+		attribute.Int64("folder", folder),
+		attribute.Bool("duplicate", !claimed),
 	)
 
 	data := map[string]interface{}{
-		"fid": fid,
+		"fid":       fid,
+		"gid":       form.GId,
+		"folder":    folder,
+		"duplicate": !claimed,
 	}
 
 	utils.SuccessWithMsg(c, "add favorites success", data)
 }
 
+//DeleteFavorites 按物品取消收藏,未收藏时同样返回成功
 func DeleteFavorites(c *gin.Context) {
 	span := trace.SpanFromContext(c.Request.Context())
 	defer span.End()
@@ -74,30 +142,72 @@ func DeleteFavorites(c *gin.Context) {
 		return
 	}
 
-	req := &proto.DeleteFavoritesRequest{
-		Uid: uid,
-		Fid: form.FId,
+	if form.GId == 0 {
+		if form.FId == 0 {
+			utils.FailWithMsg(c, "参数错误")
+			return
+		}
+		form.GId, err = favoriteGid(c.Request.Context(), uid, form.FId)
+		if err != nil {
+			misc.Logger.Error("find favorite goods err", zap.Error(err), zap.Int32("fid", form.FId))
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
 	}
 
-	code, err := rpc.DeleteFavorites(c.Request.Context(), req)
-	if err != nil || code == misc.CodeFail {
-		misc.Logger.Error("rpc delete favorites err", zap.Error(err))
-		utils.FailWithMsg(c, "添加失败")
+	removed, err := favorite.Unclaim(c.Request.Context(), uid, form.GId)
+	if err != nil {
+		misc.Logger.Error("unclaim favorite err", zap.Error(err))
+		utils.FailWithMsg(c, "删除失败")
 		return
 	}
 
+	// 同时清理旧版本重复添加的记录
+	fids, err := favoriteIds(c.Request.Context(), uid, form.GId)
+	if err != nil {
+		misc.Logger.Error("rpc get user favorites err", zap.Error(err))
+		utils.FailWithMsg(c, "删除失败")
+		return
+	}
+	for _, fid := range fids {
+		req := &proto.DeleteFavoritesRequest{
+			Uid: uid,
+			Fid: fid,
+		}
+		code, err := rpc.DeleteFavorites(c.Request.Context(), req)
+		if err != nil || code == misc.CodeFail {
+			misc.Logger.Error("rpc delete favorites err", zap.Error(err), zap.Int32("fid", fid))
+			utils.FailWithMsg(c, "删除失败")
+			return
+		}
+	}
+
+	if err = watch.Unsubscribe(c.Request.Context(), uid, form.GId); err != nil {
+		misc.Logger.Error("unsubscribe goods err", zap.Error(err))
+	}
+
 	span.SetAttributes(
-		attribute.Int64("favoritesId", int64(form.FId)),
-		attribute.Int64("code", int64(code)),
+		attribute.Int64("goodsId", int64(form.GId)),
+		attribute.Bool("removed", removed),
+		attribute.Int("rows", len(fids)),
 	)
 
 	utils.SuccessWithMsg(c, "delete favorites success", nil)
 }
 
+//GetUserFavorites 获取用户收藏,可按收藏夹过滤
 func GetUserFavorites(c *gin.Context) {
 	span := trace.SpanFromContext(c.Request.Context())
 	defer span.End()
 
+	var form GetUserFavoritesForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil && !errors.Is(err, io.EOF) {
+		misc.Logger.Error("handle get user favorites bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
 	uid, err := utils.GetContextUserId(c)
 	if err != nil {
 		misc.Logger.Error("请求Token参数错误")
@@ -112,21 +222,46 @@ func GetUserFavorites(c *gin.Context) {
 	code, protoList, err := rpc.GetUserFavorites(c.Request.Context(), req)
 	if err != nil || code == misc.CodeFail {
 		misc.Logger.Error("rpc get user favorites err", zap.Error(err))
-		utils.FailWithMsg(c, "添加失败")
+		utils.FailWithMsg(c, "获取收藏失败")
 		return
 	}
 
+	favorites, err := favorite.List(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("list favorites err", zap.Error(err))
+		utils.FailWithMsg(c, "获取收藏失败")
+		return
+	}
+	folderOf := make(map[int32]int64, len(favorites))
+	for _, f := range favorites {
+		folderOf[f.Gid] = f.Folder
+	}
+
 	var list []map[string]interface{}
 
+	seen := make(map[int32]bool, len(protoList))
 	for _, favorites := range protoList {
+		if seen[favorites.Gid] {
+			continue
+		}
+		seen[favorites.Gid] = true
+		folder, ok := folderOf[favorites.Gid]
+		if !ok {
+			// 迁移前的收藏由backfillFavorites补充记录,尚未补充的视为在默认收藏夹
+			folder = favorite.DefaultFolder
+		}
+		if form.Folder != nil && *form.Folder != folder {
+			continue
+		}
 		list = append(list, map[string]interface{}{
-			"id":    favorites.Id,
-			"uid":   favorites.Uid,
-			"gid":   favorites.Gid,
-			"gname": favorites.Name,
-			"price": favorites.Price,
-			"type":  favorites.Type,
-			"cover": favorites.Cover,
+			"id":     favorites.Id,
+			"uid":    favorites.Uid,
+			"gid":    favorites.Gid,
+			"gname":  favorites.Name,
+			"price":  favorites.Price,
+			"type":   favorites.Type,
+			"cover":  favorites.Cover,
+			"folder": folder,
 		})
 	}
 
@@ -141,3 +276,293 @@ func GetUserFavorites(c *gin.Context) {
 
 	utils.SuccessWithMsg(c, "get user favorites success", data)
 }
+
+//CheckFavorites 批量查询物品是否已收藏及收藏数
+func CheckFavorites(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form CheckFavoritesForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle check favorites bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	favorited, counts := goodsFavorites(c.Request.Context(), uid, form.GIds)
+
+	var list []map[string]interface{}
+	for _, gid := range form.GIds {
+		list = append(list, map[string]interface{}{
+			"gid":           gid,
+			"favorited":     favorited[gid],
+			"favoriteCount": counts[gid],
+		})
+	}
+
+	data := map[string]interface{}{
+		"len":  len(list),
+		"data": list,
+	}
+
+	utils.SuccessWithMsg(c, "check favorites success", data)
+}
+
+//MoveFavorites 将收藏移动到其他收藏夹
+func MoveFavorites(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form MoveFavoritesForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle move favorites bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	if err = favorite.CheckFolder(c.Request.Context(), uid, *form.Folder); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if err = favorite.Move(c.Request.Context(), uid, form.GId, *form.Folder); err != nil {
+		if errors.Is(err, favorite.ErrNotFavorited) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		misc.Logger.Error("move favorite err", zap.Error(err))
+		utils.FailWithMsg(c, "移动失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("goodsId", int64(form.GId)),
+		attribute.Int64("folder", *form.Folder),
+	)
+
+	utils.SuccessWithMsg(c, "move favorites success", nil)
+}
+
+//GetFavoriteFolders 获取用户收藏夹列表
+func GetFavoriteFolders(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	folders, err := favorite.Folders(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("get favorite folders err", zap.Error(err))
+		utils.FailWithMsg(c, "获取收藏夹失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"len":  len(folders),
+		"data": folders,
+	}
+
+	utils.SuccessWithMsg(c, "get favorite folders success", data)
+}
+
+//AddFavoriteFolder 新建收藏夹
+func AddFavoriteFolder(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form AddFolderForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle add folder bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	folder, err := favorite.CreateFolder(c.Request.Context(), uid, form.Name)
+	if err != nil {
+		if errors.Is(err, favorite.ErrFolderLimit) || errors.Is(err, favorite.ErrFolderName) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		misc.Logger.Error("create folder err", zap.Error(err))
+		utils.FailWithMsg(c, "新建收藏夹失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("folder", folder.Id),
+	)
+
+	utils.SuccessWithMsg(c, "add folder success", folder)
+}
+
+//RenameFavoriteFolder 重命名收藏夹
+func RenameFavoriteFolder(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form RenameFolderForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle rename folder bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	if err = favorite.RenameFolder(c.Request.Context(), uid, form.Id, form.Name); err != nil {
+		if errors.Is(err, favorite.ErrFolderNotFound) || errors.Is(err, favorite.ErrFolderName) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		misc.Logger.Error("rename folder err", zap.Error(err))
+		utils.FailWithMsg(c, "重命名失败")
+		return
+	}
+
+	utils.SuccessWithMsg(c, "rename folder success", nil)
+}
+
+//DeleteFavoriteFolder 删除收藏夹,收藏移回默认收藏夹
+func DeleteFavoriteFolder(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form DeleteFolderForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle delete folder bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	if err = favorite.DeleteFolder(c.Request.Context(), uid, form.Id); err != nil {
+		if errors.Is(err, favorite.ErrFolderNotFound) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		misc.Logger.Error("delete folder err", zap.Error(err))
+		utils.FailWithMsg(c, "删除收藏夹失败")
+		return
+	}
+
+	utils.SuccessWithMsg(c, "delete folder success", nil)
+}
+
+//notifyFavorited 通知物品发布者物品被收藏
+func notifyFavorited(ctx context.Context, uid, gid int32) {
+	code, goodsDetail, _, err := rpc.PicList(ctx, &proto.GetGoodsDetailRequest{Gid: gid})
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("favorited rpc goods detail err", zap.Error(err), zap.Int32("gid", gid))
+		return
+	}
+	if goodsDetail.Uid == uid {
+		return
+	}
+	sendNotification(ctx, &notify.Notification{
+		Uid:     goodsDetail.Uid,
+		Type:    notify.TypeFavorited,
+		Title:   "物品被收藏",
+		Content: fmt.Sprintf("有用户收藏了你的物品 %s", goodsDetail.Name),
+		Data: map[string]interface{}{
+			"gid": gid,
+			"uid": uid,
+		},
+	})
+}
+
+//favoriteIds 获取用户对某个物品的全部收藏记录id
+//favoriteGid 根据旧版本的收藏记录id查找收藏的物品
+func favoriteGid(ctx context.Context, uid, fid int32) (int32, error) {
+	code, list, err := rpc.GetUserFavorites(ctx, &proto.GetUserFavoritesRequest{Uid: uid})
+	if err != nil || code == misc.CodeFail {
+		return 0, errors.New("删除失败")
+	}
+	for _, f := range list {
+		if f.Id == fid {
+			return f.Gid, nil
+		}
+	}
+	return 0, errors.New("收藏不存在")
+}
+
+//claimLegacyFavorites 为旧版本添加的收藏补充记录到默认收藏夹并订阅物品动态
+func claimLegacyFavorites(ctx context.Context, uid int32) error {
+	code, list, err := rpc.GetUserFavorites(ctx, &proto.GetUserFavoritesRequest{Uid: uid})
+	if err != nil || code == misc.CodeFail {
+		return errors.New("获取收藏失败")
+	}
+	for _, f := range list {
+		claimed, err := favorite.Claim(ctx, uid, f.Gid, favorite.DefaultFolder)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		if err = watch.Subscribe(ctx, uid, f.Gid); err != nil {
+			misc.Logger.Error("subscribe goods err", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func favoriteIds(ctx context.Context, uid, gid int32) ([]int32, error) {
+	req := &proto.GetUserFavoritesRequest{
+		Uid: uid,
+	}
+	code, list, err := rpc.GetUserFavorites(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if code == misc.CodeFail {
+		return nil, errors.New("rpc get user favorites fail")
+	}
+	var fids []int32
+	for _, f := range list {
+		if f.Gid == gid {
+			fids = append(fids, f.Id)
+		}
+	}
+	return fids, nil
+}
@@ -3,10 +3,11 @@ package handle
 type LoginForm struct {
 	Email    string `form:"email" json:"email" binding:"required"`
 	Password string `form:"password" json:"password" binding:"required"`
+	SmsCode  string `form:"smsCode" json:"smsCode" binding:"omitempty,numeric"` //开启登录短信验证后必填
 }
 
 type RegisterForm struct {
-	Email    string `form:"email" json:"email" binding:"required"`
+	Email    string `form:"email" json:"email" binding:"required,email"`
 	Password string `form:"password" json:"password" binding:"required"`
 	Name     string `form:"name" json:"name" binding:"required"`
 }
@@ -15,15 +16,6 @@ type TokenLoginForm struct {
 	Token string `form:"token" json:"token" binding:"required"`
 }
 
-type UpdateUserForm struct {
-	Email    string `form:"email" json:"email" binding:"required"`
-	Phone    string `form:"phone" json:"phone" binding:"required"`
-	Password string `form:"password" json:"password" binding:"required"`
-	Name     string `form:"name" json:"name" binding:"required"`
-	School   string `form:"school" json:"school" binding:"required"`
-	Sex      int32  `form:"sex" json:"sex" binding:"required"`
-}
-
 type LogoutForm struct {
 	Token string `form:"token" json:"token" binding:"required"`
 }
@@ -60,28 +52,56 @@ type DeleteGoodsForm struct {
 }
 
 type AddOrderForm struct {
-	SellId int32  `form:"sellid" json:"sellid" binding:"required"`
+	SellId int32  `form:"sellid" json:"sellid"` //以物品的发布者为准,填写时需要一致
 	GId    int32  `form:"gid" json:"gid" binding:"required"`
-	School string `form:"school" json:"school" binding:"required"`
+	School string `form:"school" json:"school"` //以物品所在学校为准,不再使用
 }
 
 type UpdateOrderForm struct {
 	Id     int32 `form:"id" json:"id" binding:"required"`
-	Status int32 `form:"status" json:"status" binding:"required"`
+	Status int32 `form:"status" json:"status" binding:"required,oneof=2 3 4"` //已支付、退款和纠纷状态由支付和纠纷流程推进
 }
 
 type AddFavoritesForm struct {
-	GId int32 `form:"gid" json:"gid" binding:"required"`
+	GId    int32  `form:"gid" json:"gid" binding:"required"`
+	Folder *int64 `form:"folder" json:"folder"`
 }
 
 type DeleteFavoritesForm struct {
-	FId int32 `form:"fid" json:"fid" binding:"required"`
+	GId int32 `form:"gid" json:"gid"`
+	FId int32 `form:"fid" json:"fid"` //旧版本客户端按收藏记录id删除
+}
+
+type GetUserFavoritesForm struct {
+	Folder *int64 `form:"folder" json:"folder"`
+}
+
+type CheckFavoritesForm struct {
+	GIds []int32 `form:"gids" json:"gids" binding:"required,max=100"`
+}
+
+type MoveFavoritesForm struct {
+	GId    int32  `form:"gid" json:"gid" binding:"required"`
+	Folder *int64 `form:"folder" json:"folder" binding:"required"`
+}
+
+type AddFolderForm struct {
+	Name string `form:"name" json:"name" binding:"required"`
+}
+
+type RenameFolderForm struct {
+	Id   int64  `form:"id" json:"id" binding:"required"`
+	Name string `form:"name" json:"name" binding:"required"`
+}
+
+type DeleteFolderForm struct {
+	Id int64 `form:"id" json:"id" binding:"required"`
 }
 
 type AddCommentForm struct {
 	GId     int32  `form:"gid" json:"gid" binding:"required"`
 	OId     int32  `form:"oid" json:"oid" binding:"required"`
-	Level   int32  `form:"level" json:"level" binding:"required"`
+	Level   int32  `form:"level" json:"level" binding:"required,min=1,max=5"`
 	Content string `form:"content" json:"content" binding:"required"`
 }
 
@@ -92,3 +112,294 @@ type GetCommentByGoodsIdForm struct {
 type DeleteCommentForm struct {
 	CId int32 `form:"cid" json:"cid" binding:"required"`
 }
+
+type CreatePaymentForm struct {
+	OId int32 `form:"oid" json:"oid" binding:"required"`
+}
+
+type RefundPaymentForm struct {
+	OId    int32 `form:"oid" json:"oid" binding:"required"`
+	Amount int64 `form:"amount" json:"amount"` //单位分,不填则全额退款
+}
+
+type MockPayForm struct {
+	IntentId string `form:"intentId" json:"intentId" binding:"required"`
+	Status   string `form:"status" json:"status"`
+}
+
+type OpenDisputeForm struct {
+	OId    int32  `form:"oid" json:"oid" binding:"required"`
+	Reason string `form:"reason" json:"reason" binding:"required"`
+}
+
+type DisputeMessageForm struct {
+	DId     int64  `form:"did" json:"did" binding:"required"`
+	Content string `form:"content" json:"content" binding:"required"`
+}
+
+type DisputeDetailForm struct {
+	DId int64 `form:"did" json:"did" binding:"required"`
+}
+
+type DisputeEvidenceForm struct {
+	DId  int64  `form:"did" json:"did" binding:"required"`
+	Name string `form:"name" json:"name" binding:"required"`
+}
+
+type ListDisputeForm struct {
+	Page  *int64 `form:"page" json:"page" binding:"required,min=0"`
+	Count *int64 `form:"count" json:"count" binding:"required,min=1,max=100"`
+}
+
+type ResolveDisputeForm struct {
+	DId    int64  `form:"did" json:"did" binding:"required"`
+	Result string `form:"result" json:"result" binding:"required,oneof=full partial reject"`
+	Amount int64  `form:"amount" json:"amount"` //部分退款金额,单位分
+	Remark string `form:"remark" json:"remark"`
+}
+
+type AddReplyForm struct {
+	GId     int32  `form:"gid" json:"gid" binding:"required"`
+	CId     int32  `form:"cid" json:"cid" binding:"required"`
+	Parent  int64  `form:"parent" json:"parent"` //回复的回复id,直接回复评价时不填
+	Content string `form:"content" json:"content" binding:"required"`
+}
+
+type DeleteReplyForm struct {
+	RId int64 `form:"rid" json:"rid" binding:"required"`
+}
+
+type EditCommentForm struct {
+	CId     int32  `form:"cid" json:"cid" binding:"required"`
+	Level   int32  `form:"level" json:"level" binding:"required,min=1,max=5"`
+	Content string `form:"content" json:"content" binding:"required"`
+}
+
+type SellerProfileForm struct {
+	Uid int32 `form:"uid" json:"uid" binding:"required"`
+}
+
+type ListModerationForm struct {
+	Page  *int64 `form:"page" json:"page" binding:"required,min=0"`
+	Count *int64 `form:"count" json:"count" binding:"required,min=1,max=100"`
+}
+
+type ModerationItemForm struct {
+	Id int64 `form:"id" json:"id" binding:"required"`
+}
+
+type AddReportForm struct {
+	TargetType string `form:"targetType" json:"targetType" binding:"required,oneof=goods comment user"`
+	TargetId   int32  `form:"targetId" json:"targetId" binding:"required"`
+	GId        int32  `form:"gid" json:"gid"` //举报评论时必填
+	Reason     string `form:"reason" json:"reason" binding:"required"`
+}
+
+type ListReportForm struct {
+	Page  *int64 `form:"page" json:"page" binding:"required,min=0"`
+	Count *int64 `form:"count" json:"count" binding:"required,min=1,max=100"`
+}
+
+type ResolveReportForm struct {
+	Id        int64  `form:"id" json:"id" binding:"required"`
+	Action    string `form:"action" json:"action" binding:"required,oneof=dismiss hide_goods delete_comment suspend_user"`
+	Days      int    `form:"days" json:"days" binding:"min=0,max=3650"` //封禁天数
+	Permanent bool   `form:"permanent" json:"permanent"`                //永久封禁,与封禁天数二选一
+	Remark    string `form:"remark" json:"remark"`
+}
+
+type SuspendUserForm struct {
+	Uid int32 `form:"uid" json:"uid" binding:"required"`
+}
+
+type HideGoodsForm struct {
+	Gid int32 `form:"gid" json:"gid" binding:"required"`
+}
+
+type UserRoleForm struct {
+	Uid int32 `form:"uid" json:"uid" binding:"required"`
+}
+
+type SetUserRoleForm struct {
+	Uid  int32  `form:"uid" json:"uid" binding:"required"`
+	Role string `form:"role" json:"role" binding:"required"`
+}
+
+type ListAuditForm struct {
+	Page  *int64 `form:"page" json:"page" binding:"required,min=0"`
+	Count *int64 `form:"count" json:"count" binding:"required,min=1,max=100"`
+}
+
+type ListNotificationForm struct {
+	Page  *int64 `form:"page" json:"page" binding:"required"`
+	Count *int64 `form:"count" json:"count" binding:"required,min=1,max=100"`
+}
+
+type ReadNotificationForm struct {
+	Ids []int64 `form:"ids" json:"ids"`
+}
+
+type CreateConversationForm struct {
+	Scope string `form:"scope" json:"scope" binding:"required,oneof=order goods"`
+	Id    int32  `form:"id" json:"id" binding:"required"`
+}
+
+type SendMessageForm struct {
+	ConvId  string `form:"convId" json:"convId" binding:"required"`
+	Content string `form:"content" json:"content" binding:"required,max=1000"`
+}
+
+type ListMessageForm struct {
+	ConvId string `form:"convId" json:"convId" binding:"required"`
+	Before int64  `form:"before" json:"before"`
+	Count  int64  `form:"count" json:"count" binding:"required,min=1,max=100"`
+}
+
+type ListConversationForm struct {
+	Page  *int64 `form:"page" json:"page" binding:"required"`
+	Count *int64 `form:"count" json:"count" binding:"required,min=1,max=100"`
+}
+
+type ReadConversationForm struct {
+	ConvId string `form:"convId" json:"convId" binding:"required"`
+}
+
+type VerifyEmailForm struct {
+	Token string `form:"token" json:"token" binding:"required"`
+}
+
+type ForgotPasswordForm struct {
+	Email string `form:"email" json:"email" binding:"required,email"`
+}
+
+type ResetPasswordForm struct {
+	Token    string `form:"token" json:"token" binding:"required"`
+	Password string `form:"password" json:"password" binding:"required,min=6,max=32"`
+}
+
+type SendSchoolCodeForm struct {
+	Email string `form:"email" json:"email" binding:"required,email"`
+}
+
+type VerifySchoolForm struct {
+	Code string `form:"code" json:"code" binding:"required,len=6,numeric"`
+}
+
+type SendPhoneCodeForm struct {
+	Phone string `form:"phone" json:"phone" binding:"required"`
+}
+
+type VerifyPhoneForm struct {
+	Code string `form:"code" json:"code" binding:"required,numeric"`
+}
+
+type SmsLoginForm struct {
+	Enable *bool `form:"enable" json:"enable" binding:"required"`
+}
+
+type TotpCodeForm struct {
+	Code string `form:"code" json:"code" binding:"required"` //动态验证码或恢复码
+}
+
+type TotpLoginForm struct {
+	Challenge string `form:"challenge" json:"challenge" binding:"required"`
+	Code      string `form:"code" json:"code" binding:"required"` //动态验证码或恢复码
+}
+
+//UpdateUserForm 旧版整体更新资料,已废弃
+type UpdateUserForm struct {
+	Email     string `form:"email" json:"email" binding:"required"`
+	Phone     string `form:"phone" json:"phone" binding:"required"`
+	Password  string `form:"password" json:"password" binding:"required"`
+	Name      string `form:"name" json:"name" binding:"required"`
+	School    string `form:"school" json:"school" binding:"required"`
+	Sex       int32  `form:"sex" json:"sex" binding:"required"`
+	PhoneCode string `form:"phoneCode" json:"phoneCode" binding:"omitempty,numeric"` //更换手机号时必填
+}
+
+//UpdateProfileForm 只更新mask中列出的字段
+type UpdateProfileForm struct {
+	Mask      []string `form:"mask" json:"mask" binding:"required,min=1,dive,oneof=name phone school sex email"`
+	Name      string   `form:"name" json:"name"`
+	Phone     string   `form:"phone" json:"phone"`
+	PhoneCode string   `form:"phoneCode" json:"phoneCode" binding:"omitempty,numeric"` //更换手机号时必填
+	School    string   `form:"school" json:"school"`
+	Sex       int32    `form:"sex" json:"sex"`
+	Email     string   `form:"email" json:"email" binding:"omitempty,email"` //确认新邮箱后才会生效
+	Password  string   `form:"password" json:"password" binding:"required"`  //当前密码,logic服务整体更新时需要原样写回
+}
+
+//ConfirmEmailChangeForm 确认更换邮箱时同样需要当前密码
+type ConfirmEmailChangeForm struct {
+	Token    string `form:"token" json:"token" binding:"required"`
+	Password string `form:"password" json:"password" binding:"required"`
+}
+
+type ChangePasswordForm struct {
+	OldPassword string `form:"oldPassword" json:"oldPassword" binding:"required"`
+	NewPassword string `form:"newPassword" json:"newPassword" binding:"required,min=6,max=32"`
+}
+
+type PublicProfileForm struct {
+	Uid int32 `form:"uid" json:"uid" binding:"required"`
+}
+
+//PrivacyForm 只修改填写了的字段
+type PrivacyForm struct {
+	Face     *bool `form:"face" json:"face"`
+	School   *bool `form:"school" json:"school"`
+	Badges   *bool `form:"badges" json:"badges"`
+	Listings *bool `form:"listings" json:"listings"`
+	Rating   *bool `form:"rating" json:"rating"`
+}
+
+type DeleteAccountForm struct {
+	Password string `form:"password" json:"password" binding:"required"`
+	Code     string `form:"code" json:"code"` //开启两步验证后必填
+}
+
+type BlockUserForm struct {
+	Uid int32 `form:"uid" json:"uid" binding:"required"`
+}
+
+type CategoryAttributeForm struct {
+	Key      string            `form:"key" json:"key" binding:"required"`
+	Names    map[string]string `form:"names" json:"names" binding:"required"`
+	Type     string            `form:"type" json:"type" binding:"required,oneof=text number enum bool"`
+	Options  []string          `form:"options" json:"options"`
+	Required bool              `form:"required" json:"required"`
+}
+
+type AddCategoryForm struct {
+	Id         int32                    `form:"id" json:"id"` //为空时自动分配,迁移已有的type时可以指定
+	Parent     int32                    `form:"parent" json:"parent"`
+	Names      map[string]string        `form:"names" json:"names" binding:"required"`
+	Icon       string                   `form:"icon" json:"icon"`
+	Attributes []*CategoryAttributeForm `form:"attributes" json:"attributes" binding:"dive"`
+	Sort       int32                    `form:"sort" json:"sort"`
+	Disabled   bool                     `form:"disabled" json:"disabled"`
+}
+
+type UpdateCategoryForm struct {
+	Id         int32                    `form:"id" json:"id" binding:"required"`
+	Parent     int32                    `form:"parent" json:"parent"`
+	Names      map[string]string        `form:"names" json:"names" binding:"required"`
+	Icon       string                   `form:"icon" json:"icon"`
+	Attributes []*CategoryAttributeForm `form:"attributes" json:"attributes" binding:"dive"`
+	Sort       int32                    `form:"sort" json:"sort"`
+	Disabled   bool                     `form:"disabled" json:"disabled"`
+}
+
+type DeleteCategoryForm struct {
+	Id int32 `form:"id" json:"id" binding:"required"`
+}
+
+type SearchSchoolForm struct {
+	Keyword string `form:"keyword" json:"keyword" binding:"required"`
+	Count   int    `form:"count" json:"count"`
+}
+
+type GetSchoolForm struct {
+	Id   int32  `form:"id" json:"id" binding:"required_without=Name"`
+	Name string `form:"name" json:"name" binding:"required_without=Id"` //名称或别名
+}
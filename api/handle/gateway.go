@@ -0,0 +1,101 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dopamine-joker/zu_web_server/gateway"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	orderChannelPrefix = "order:"
+)
+
+var (
+	errChannelDenied = errors.New("无权订阅该频道")
+	errOriginDenied  = errors.New("不允许的来源")
+)
+
+//ServeGateway 建立websocket连接,实时推送用户通知和订单事件
+func ServeGateway(c *gin.Context) {
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	server := websocket.Server{
+		Handshake: checkOrigin,
+		Handler: func(ws *websocket.Conn) {
+			misc.Logger.Info("gateway connection open", zap.Int32("uid", uid))
+			gateway.Default.Serve(ws, uid, authorizeChannel)
+			misc.Logger.Info("gateway connection close", zap.Int32("uid", uid))
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+//checkOrigin 浏览器会带上Origin,只允许配置中的来源或同域页面建立连接,
+//防止其他网站借用户的登录状态建立连接。非浏览器客户端没有Origin,不做限制
+func checkOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return errOriginDenied
+	}
+	config.Origin = u
+	origins := misc.Conf.Gateway.Origins
+	if len(origins) == 0 {
+		if strings.EqualFold(u.Host, req.Host) {
+			return nil
+		}
+		return errOriginDenied
+	}
+	for _, o := range origins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return nil
+		}
+	}
+	return errOriginDenied
+}
+
+//authorizeChannel 用户只能订阅自己的频道和自己参与的订单
+func authorizeChannel(ctx context.Context, uid int32, channel string) error {
+	if channel == gateway.UserChannel(uid) {
+		return nil
+	}
+	if !strings.HasPrefix(channel, orderChannelPrefix) {
+		return errChannelDenied
+	}
+	oid, err := strconv.Atoi(strings.TrimPrefix(channel, orderChannelPrefix))
+	if err != nil {
+		return errChannelDenied
+	}
+	if _, err = findSellOrder(ctx, uid, int32(oid)); err == nil {
+		return nil
+	}
+	if _, err = findBuyOrder(ctx, uid, int32(oid)); err == nil {
+		return nil
+	}
+	return errChannelDenied
+}
+
+//publishEvent 发布实时事件,失败时只记录日志
+func publishEvent(ctx context.Context, channel string, ev *gateway.Event) {
+	if err := gateway.Publish(ctx, channel, ev); err != nil {
+		misc.Logger.Error("publish gateway event err", zap.Error(err), zap.String("channel", channel))
+	}
+}
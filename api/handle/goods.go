@@ -1,9 +1,19 @@
 package handle
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+
 	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/favorite"
 	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/moderation"
 	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/rating"
+	"github.com/dopamine-joker/zu_web_server/rbac"
+	"github.com/dopamine-joker/zu_web_server/sanction"
 	"github.com/dopamine-joker/zu_web_server/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/mitchellh/mapstructure"
@@ -16,8 +26,36 @@ import (
 const (
 	uploadKey      = "files"
 	uploadCoverKey = "cover"
+	maxUploadSize  = 10 * 1024 * 1024
 )
 
+//formFile 表单中的文件,同名文件分别保留
+type formFile struct {
+	Name    string
+	Content []byte
+}
+
+//readFormFiles 按上传顺序读取multipart表单中key对应的全部文件
+func readFormFiles(form *multipart.Form, key string) ([]*formFile, error) {
+	files := make([]*formFile, 0, len(form.File[key]))
+	for _, file := range form.File[key] {
+		src, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(io.LimitReader(src, maxUploadSize+1))
+		_ = src.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(content) > maxUploadSize {
+			return nil, fmt.Errorf("file %s too large", file.Filename)
+		}
+		files = append(files, &formFile{Name: file.Filename, Content: content})
+	}
+	return files, nil
+}
+
 //Upload 该请求数据格式不为json,而为multipart/form-data
 func Upload(c *gin.Context) {
 
@@ -51,42 +89,40 @@ func Upload(c *gin.Context) {
 		return
 	}
 
+	if uploadForm.School, err = normalizeSchool(uploadForm.School); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if err = checkSchool(c.Request.Context(), uid, uploadForm.School); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if err = checkCategory(c.Request.Context(), uploadForm.Type); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
 	// 提取文件,转换为byte数组后保存
-	files := make(map[string][]byte)
-	cover := make(map[string][]byte)
-	for key, headers := range form.File {
-		if key != uploadKey && key != uploadCoverKey {
-			continue
-		}
-		// grpc发送文件
-		for _, file := range headers { //遍历每一个文件
-			// 获取文件的数据流
-			src, err := file.Open()
-			if err != nil {
-				misc.Logger.Error("pic open file err", zap.Error(err))
-				utils.FailWithMsg(c, "图片解码出现问题")
-			}
-			// 读取其中的byte流
-			picBytes := make([]byte, 10*1024*1024)
-			n, err := src.Read(picBytes)
-			if err != nil {
-				misc.Logger.Error("pic file read err", zap.Error(err))
-				utils.FailWithMsg(c, "图片解码出现问题")
-			}
-
-			if key == uploadKey {
-				// 存储到map中,用于grpc,根据读取的字节数裁断
-				files[file.Filename] = picBytes[:n]
-			} else if key == uploadCoverKey {
-				// 存储到封面byte,用于grpc,根据读取的字节数裁断
-				cover[file.Filename] = picBytes[:n]
-			}
-			_ = src.Close()
-		}
+	files, err := readFormFiles(form, uploadKey)
+	if err != nil {
+		misc.Logger.Error("pic file read err", zap.Error(err))
+		utils.FailWithMsg(c, "图片解码出现问题")
+		return
+	}
+	cover, err := readFormFiles(form, uploadCoverKey)
+	if err != nil {
+		misc.Logger.Error("cover file read err", zap.Error(err))
+		utils.FailWithMsg(c, "图片解码出现问题")
+		return
 	}
 
+	// 同名图片只保留最后一张
+	pics := make(map[string][]byte, len(files))
+	for _, file := range files {
+		pics[file.Name] = file.Content
+	}
 	var picList []*proto.FileStream
-	for name, bytes := range files {
+	for name, bytes := range pics {
 		picList = append(picList, &proto.FileStream{
 			Name:    name,
 			Content: bytes,
@@ -94,25 +130,43 @@ func Upload(c *gin.Context) {
 	}
 
 	var coverPic *proto.FileStream
-	for name, bytes := range cover {
+	if len(cover) > 0 {
+		last := cover[len(cover)-1]
 		coverPic = &proto.FileStream{
-			Name:    name,
-			Content: bytes,
+			Name:    last.Name,
+			Content: last.Content,
 		}
 	}
 
+	action, texts, reasons := moderation.Default.CheckAll(moderation.KindGoods, uploadForm.Name, uploadForm.Detail)
+	if action == moderation.ActionReject {
+		misc.Logger.Info("goods rejected by moderation", zap.Int32("uid", uid), zap.Strings("reasons", reasons))
+		utils.FailWithMsg(c, "物品信息包含违规内容")
+		return
+	}
+
 	//构造请求
 	req := &proto.UploadRequest{
 		Uid:     uid,
-		Name:    uploadForm.Name,
+		Name:    texts[0],
 		Price:   uploadForm.Price,
 		Type:    uploadForm.Type,
 		School:  uploadForm.School,
-		Detail:  uploadForm.Detail,
+		Detail:  texts[1],
 		Cover:   coverPic,
 		PicList: picList,
 	}
 
+	if action == moderation.ActionReview {
+		if err = enqueueModeration(c.Request.Context(), moderation.KindGoods, uid, 0, texts, reasons, req); err != nil {
+			misc.Logger.Error("enqueue goods moderation err", zap.Error(err))
+			utils.FailWithMsg(c, "上传失败")
+			return
+		}
+		utils.SuccessWithMsg(c, "goods is waiting for review", map[string]interface{}{"queued": true})
+		return
+	}
+
 	code, err := rpc.UploadGoods(c.Request.Context(), req)
 	if code == misc.CodeFail || err != nil {
 		misc.Logger.Error("rpc upload err", zap.Error(err))
@@ -150,8 +204,20 @@ func GetGoods(c *gin.Context) {
 		return
 	}
 
+	gids := make([]int32, 0, len(list))
+	for _, goods := range list {
+		gids = append(gids, goods.Id)
+	}
+	ratings := goodsRatings(c.Request.Context(), gids)
+	hidden := hiddenGoods(c.Request.Context(), gids)
+	uid, _ := utils.GetContextUserId(c)
+	favorited, favoriteCounts := goodsFavorites(c.Request.Context(), uid, gids)
+
 	var dataMap []map[string]interface{}
 	for _, goods := range list {
+		if hidden[goods.Id] {
+			continue
+		}
 		m := make(map[string]interface{})
 		m["id"] = goods.Id
 		m["name"] = goods.Name
@@ -159,7 +225,11 @@ func GetGoods(c *gin.Context) {
 		m["price"] = goods.Price
 		m["type"] = goods.Type
 		m["cover"] = goods.Cover
-		m["school"] = goods.School
+		m["school"] = canonicalSchool(goods.School)
+		m["rating"] = ratings[goods.Id].Average
+		m["ratingCount"] = ratings[goods.Id].Count
+		m["favorited"] = favorited[goods.Id]
+		m["favoriteCount"] = favoriteCounts[goods.Id]
 		dataMap = append(dataMap, m)
 	}
 
@@ -194,20 +264,32 @@ func GetUserGoodsList(c *gin.Context) {
 		return
 	}
 
+	gids := make([]int32, 0, len(list))
+	for _, g := range list {
+		gids = append(gids, g.Gid)
+	}
+	ratings := goodsRatings(c.Request.Context(), gids)
+	hidden := hiddenGoods(c.Request.Context(), gids)
+	_, favoriteCounts := goodsFavorites(c.Request.Context(), uid, gids)
+
 	var dataList []map[string]interface{}
 
 	for _, g := range list {
 		dataList = append(dataList, map[string]interface{}{
-			"gid":         g.Gid,
-			"uid":         g.Uid,
-			"name":        g.Name,
-			"uname":       g.Uname,
-			"price":       g.Price,
-			"type":        g.Type,
-			"school":      g.School,
-			"detail":      g.Detail,
-			"cover":       g.Cover,
-			"create_time": g.CreateTime,
+			"gid":           g.Gid,
+			"uid":           g.Uid,
+			"name":          g.Name,
+			"uname":         g.Uname,
+			"price":         g.Price,
+			"type":          g.Type,
+			"school":        canonicalSchool(g.School),
+			"detail":        g.Detail,
+			"cover":         g.Cover,
+			"create_time":   g.CreateTime,
+			"rating":        ratings[g.Gid].Average,
+			"ratingCount":   ratings[g.Gid].Count,
+			"favoriteCount": favoriteCounts[g.Gid],
+			"hidden":        hidden[g.Gid],
 		})
 	}
 
@@ -243,6 +325,15 @@ func GetGoodsDetail(c *gin.Context) {
 		return
 	}
 
+	// 被下架的物品只有发布者和管理人员可以查看
+	uid, _ := utils.GetContextUserId(c)
+	if hiddenGoods(c.Request.Context(), []int32{goodsDetail.Gid})[goodsDetail.Gid] {
+		if uid != goodsDetail.Uid && !utils.HasPermission(c, rbac.PermSanction) {
+			utils.FailWithMsg(c, "物品已下架")
+			return
+		}
+	}
+
 	var picList []map[string]interface{}
 	for _, p := range list {
 		data := map[string]interface{}{
@@ -259,12 +350,16 @@ func GetGoodsDetail(c *gin.Context) {
 		"uname":       goodsDetail.Uname,
 		"price":       goodsDetail.Price,
 		"type":        goodsDetail.Type,
-		"school":      goodsDetail.School,
+		"school":      canonicalSchool(goodsDetail.School),
 		"detail":      goodsDetail.Detail,
 		"cover":       goodsDetail.Cover,
 		"create_time": goodsDetail.CreateTime,
 		"picList":     picList,
+		"rating":      goodsRatings(c.Request.Context(), []int32{goodsDetail.Gid})[goodsDetail.Gid],
 	}
+	favorited, favoriteCounts := goodsFavorites(c.Request.Context(), uid, []int32{goodsDetail.Gid})
+	dataMap["favorited"] = favorited[goodsDetail.Gid]
+	dataMap["favoriteCount"] = favoriteCounts[goodsDetail.Gid]
 
 	log.Println(dataMap)
 	misc.Logger.Info("get pic list success", zap.Int32("gid", req.GetGid()))
@@ -309,6 +404,8 @@ func DeleteGoods(c *gin.Context) {
 		attribute.Int64("code", int64(code)),
 	)
 
+	changeAvailability(c.Request.Context(), form.Gid, "", false, uid)
+
 	misc.Logger.Info("delete goods success", zap.Int32("gid", form.Gid))
 
 	utils.SuccessWithMsg(c, "delete goods success", nil)
@@ -340,20 +437,36 @@ func SearchGoods(c *gin.Context) {
 		return
 	}
 
+	gids := make([]int32, 0, len(goodsList))
+	for _, goods := range goodsList {
+		gids = append(gids, goods.Gid)
+	}
+	ratings := goodsRatings(c.Request.Context(), gids)
+	hidden := hiddenGoods(c.Request.Context(), gids)
+	uid, _ := utils.GetContextUserId(c)
+	favorited, favoriteCounts := goodsFavorites(c.Request.Context(), uid, gids)
+
 	var list []map[string]interface{}
 
 	for _, goods := range goodsList {
+		if hidden[goods.Gid] {
+			continue
+		}
 		list = append(list, map[string]interface{}{
-			"gid":         goods.Gid,
-			"uid":         goods.Uid,
-			"name":        goods.Name,
-			"uname":       goods.Uname,
-			"price":       goods.Price,
-			"type":        goods.Type,
-			"school":      goods.School,
-			"detail":      goods.Detail,
-			"cover":       goods.Cover,
-			"create_time": goods.CreateTime,
+			"gid":           goods.Gid,
+			"uid":           goods.Uid,
+			"name":          goods.Name,
+			"uname":         goods.Uname,
+			"price":         goods.Price,
+			"type":          goods.Type,
+			"school":        canonicalSchool(goods.School),
+			"detail":        goods.Detail,
+			"cover":         goods.Cover,
+			"create_time":   goods.CreateTime,
+			"rating":        ratings[goods.Gid].Average,
+			"ratingCount":   ratings[goods.Gid].Count,
+			"favorited":     favorited[goods.Gid],
+			"favoriteCount": favoriteCounts[goods.Gid],
 		})
 	}
 
@@ -366,3 +479,43 @@ func SearchGoods(c *gin.Context) {
 
 	utils.SuccessWithMsg(c, "search success", dataMap)
 }
+
+//goodsRatings 批量获取物品评分,失败时返回空统计,不影响列表展示
+func goodsRatings(ctx context.Context, gids []int32) map[int32]*rating.GoodsStats {
+	ratings, err := rating.Goods(ctx, gids)
+	if err != nil {
+		misc.Logger.Error("get goods rating err", zap.Error(err))
+		ratings = make(map[int32]*rating.GoodsStats, len(gids))
+	}
+	for _, gid := range gids {
+		if _, ok := ratings[gid]; !ok {
+			ratings[gid] = &rating.GoodsStats{Gid: gid}
+		}
+	}
+	return ratings
+}
+
+//goodsFavorites 批量获取当前用户是否收藏及物品收藏数,失败时返回空结果
+func goodsFavorites(ctx context.Context, uid int32, gids []int32) (map[int32]bool, map[int32]int64) {
+	favorited, err := favorite.Favorited(ctx, uid, gids)
+	if err != nil {
+		misc.Logger.Error("get favorited err", zap.Error(err))
+		favorited = map[int32]bool{}
+	}
+	counts, err := favorite.Counts(ctx, gids)
+	if err != nil {
+		misc.Logger.Error("get favorite counts err", zap.Error(err))
+		counts = map[int32]int64{}
+	}
+	return favorited, counts
+}
+
+//hiddenGoods 批量获取被下架的物品,失败时不做过滤
+func hiddenGoods(ctx context.Context, gids []int32) map[int32]bool {
+	hidden, err := sanction.HiddenGoods(ctx, gids)
+	if err != nil {
+		misc.Logger.Error("get hidden goods err", zap.Error(err))
+		return map[int32]bool{}
+	}
+	return hidden
+}
@@ -0,0 +1,288 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/account"
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/campus"
+	"github.com/dopamine-joker/zu_web_server/category"
+	"github.com/dopamine-joker/zu_web_server/comment"
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/rating"
+	"github.com/dopamine-joker/zu_web_server/school"
+	"github.com/dopamine-joker/zu_web_server/watch"
+	"go.uber.org/zap"
+)
+
+const (
+	migrationLockExpire = 30 * time.Minute
+	migrationPageSize   = 100
+)
+
+//migration 一次性数据迁移,名称确定后不能修改
+type migration struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+var migrations = []migration{
+	{name: "rating-backfill", run: backfillRatings},
+	{name: "favorite-backfill", run: backfillFavorites},
+	{name: "watch-reindex", run: watch.Reindex},
+	{name: "campus-email-index", run: indexCampusEmails},
+	{name: "reply-user-index", run: comment.IndexReplies},
+	{name: "category-seed", run: seedCategories},
+	{name: "school-audit", run: auditSchools},
+}
+
+//RunMigrations 启动时依次执行尚未完成的迁移,失败的迁移下次启动重试
+func RunMigrations(ctx context.Context) {
+	for _, m := range migrations {
+		ran, err := db.RunOnce(ctx, m.name, migrationLockExpire, m.run)
+		if err != nil {
+			misc.Logger.Error("run migration err", zap.Error(err), zap.String("name", m.name))
+			continue
+		}
+		if ran {
+			misc.Logger.Info("migration done", zap.String("name", m.name))
+		}
+	}
+}
+
+//eachGoodsSummary 分页遍历logic服务中的全部物品。logic服务的页码从0开始,
+//GetGoods接口把客户端的page原样转发,第一页即为0。返回不足一页时结束
+func eachGoodsSummary(ctx context.Context, fn func(goods *proto.Goods) error) error {
+	for page := int32(0); ; page++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		code, list, err := rpc.GetGoods(ctx, &proto.GetGoodsRequest{Page: page, Count: migrationPageSize})
+		if err != nil || code == misc.CodeFail {
+			return errors.New("获取物品列表失败")
+		}
+		for _, g := range list {
+			if err = fn(g); err != nil {
+				return err
+			}
+		}
+		if len(list) < migrationPageSize {
+			return nil
+		}
+	}
+}
+
+//eachGoods 遍历全部物品的详情,获取详情失败的物品跳过
+func eachGoods(ctx context.Context, fn func(goods *proto.GoodsDetail) error) error {
+	return eachGoodsSummary(ctx, func(g *proto.Goods) error {
+		code, detail, _, err := rpc.PicList(ctx, &proto.GetGoodsDetailRequest{Gid: g.Id})
+		if err != nil || code == misc.CodeFail {
+			misc.Logger.Error("migration get goods detail err", zap.Error(err), zap.Int32("gid", g.Id))
+			return nil
+		}
+		return fn(detail)
+	})
+}
+
+//backfillRatings 评分统计上线前的评价没有计入统计,补录评价记录和评分,
+//同时按卖家的历史订单补录已完成订单数。已被物品删除带走的评价无法找回
+func backfillRatings(ctx context.Context) error {
+	// 迁移期间新发表的评价由submitComment计入,只补录迁移开始前的评价
+	start := time.Now().Unix()
+	sellers := make(map[int32]bool)
+	err := eachGoods(ctx, func(goods *proto.GoodsDetail) error {
+		sellers[goods.Uid] = true
+		code, list, err := rpc.GetCommentByGoodsId(ctx, &proto.GetCommentByGoodsIdRequest{Gid: goods.Gid})
+		if err != nil || code == misc.CodeFail {
+			return errors.New("获取物品评价失败")
+		}
+		for _, c := range list {
+			if c.Time >= start || c.Level < 1 {
+				continue
+			}
+			review := &comment.Review{
+				Cid:        c.Id,
+				Oid:        c.Oid,
+				Gid:        c.Gid,
+				Uid:        c.Uid,
+				SellId:     goods.Uid,
+				Level:      c.Level,
+				Content:    c.Content,
+				CreateTime: c.Time,
+			}
+			imported, err := comment.ImportReview(ctx, review)
+			if err != nil {
+				misc.Logger.Error("import review err", zap.Error(err), zap.Int32("cid", c.Id))
+			}
+			if !imported {
+				continue
+			}
+			if err = rating.Add(ctx, review.Gid, review.SellId, review.Level, review.CreateTime); err != nil {
+				// 撤回补录的记录,重新执行迁移时再补录
+				if _, err := comment.DeleteReview(ctx, review.Cid); err != nil {
+					misc.Logger.Error("rollback imported review err", zap.Error(err), zap.Int32("cid", c.Id))
+				}
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for uid := range sellers {
+		code, list, err := rpc.GetSellOrder(ctx, &proto.GetSellOrderRequest{Sellid: uid})
+		if err != nil || code == misc.CodeFail {
+			return errors.New("获取卖家订单失败")
+		}
+		for _, order := range list {
+			if order.Status != misc.OrderStatusFinished {
+				continue
+			}
+			if err = rating.AddOrder(ctx, uid, order.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//backfillFavorites 收藏计数上线前的收藏没有记录,为能找到的用户补充收藏记录。
+//logic服务不能列出全部用户,只能覆盖有资料快照、发布过物品或下过订单的用户
+func backfillFavorites(ctx context.Context) error {
+	uids, err := account.Uids(ctx)
+	if err != nil {
+		return err
+	}
+	users := make(map[int32]bool, len(uids))
+	for _, uid := range uids {
+		users[uid] = true
+	}
+	sellers := make(map[int32]bool)
+	err = eachGoods(ctx, func(goods *proto.GoodsDetail) error {
+		users[goods.Uid] = true
+		sellers[goods.Uid] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for uid := range sellers {
+		code, list, err := rpc.GetSellOrder(ctx, &proto.GetSellOrderRequest{Sellid: uid})
+		if err != nil || code == misc.CodeFail {
+			return errors.New("获取卖家订单失败")
+		}
+		for _, order := range list {
+			users[order.Buyid] = true
+		}
+	}
+	for uid := range users {
+		if err = claimLegacyFavorites(ctx, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//indexCampusEmails 为已有的学校认证建立邮箱索引,重复认证的账号记录日志由管理员处理
+func indexCampusEmails(ctx context.Context) error {
+	dup, err := campus.IndexEmails(ctx)
+	if err != nil {
+		return err
+	}
+	for _, uid := range dup {
+		misc.Logger.Warn("school email verified by multiple accounts", zap.Int32("uid", uid))
+	}
+	return nil
+}
+
+//seedCategories 分类树上线前物品的type没有定义,为已有物品用到的每个type创建同id的分类,
+//名称由管理员之后修改。分类树为空时发布物品不校验分类
+func seedCategories(ctx context.Context) error {
+	types := make(map[int32]bool)
+	err := eachGoodsSummary(ctx, func(goods *proto.Goods) error {
+		if goods.Type != 0 {
+			types[goods.Type] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for id := range types {
+		cat := &category.Category{
+			Id:    id,
+			Names: map[string]string{category.DefaultLocale: fmt.Sprintf("分类%d", id)},
+			Sort:  id,
+		}
+		if err = category.Create(ctx, cat); err != nil && !errors.Is(err, category.ErrExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+//auditSchools 学校名录上线前用户、物品和订单中的学校是自由填写的。
+//迁移不改写logic服务中的数据:读取时由canonicalSchool显示标准名称,用户资料在下次保存时改为标准名称。
+//名录中找不到的名称记录日志,由管理员在配置中补充学校或别名
+func auditSchools(ctx context.Context) error {
+	unmatched := make(map[string]int)
+	note := func(name string) {
+		if strings.TrimSpace(name) == "" {
+			return
+		}
+		if _, err := school.Default.Lookup(name); err != nil {
+			unmatched[name]++
+		}
+	}
+
+	users := make(map[int32]bool)
+	err := eachGoods(ctx, func(goods *proto.GoodsDetail) error {
+		users[goods.Uid] = true
+		note(goods.School)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	uids, err := account.Uids(ctx)
+	if err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		users[uid] = true
+	}
+
+	for uid := range users {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		code, orders, err := rpc.GetSellOrder(ctx, &proto.GetSellOrderRequest{Sellid: uid})
+		if err = rpcErr(code, err); err != nil {
+			return err
+		}
+		for _, order := range orders {
+			note(order.School)
+		}
+
+		p, err := account.GetProfile(ctx, uid)
+		if errors.Is(err, account.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		note(p.School)
+	}
+
+	for name, n := range unmatched {
+		misc.Logger.Warn("school not in registry", zap.String("school", name), zap.Int("count", n))
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/comment"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/moderation"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// 审核员处理一条内容的最长时间,超时后其他审核员可以重新处理
+const moderationClaimExpire = time.Minute
+
+//ListModerationQueue 管理员查看待审核内容
+func ListModerationQueue(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ListModerationForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle list moderation bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	list, err := moderation.Pending(c.Request.Context(), *form.Page, *form.Count)
+	if err != nil {
+		misc.Logger.Error("list moderation queue err", zap.Error(err))
+		utils.FailWithMsg(c, "获取审核列表失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"len":  len(list),
+		"data": list,
+	}
+
+	utils.SuccessWithMsg(c, "list moderation queue success", data)
+}
+
+//ApproveModeration 审核通过,提交原始请求
+func ApproveModeration(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ModerationItemForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle approve moderation bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	ctx := c.Request.Context()
+	item, err := claimModeration(ctx, form.Id)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	switch item.Kind {
+	case moderation.KindComment:
+		var req proto.AddCommentRequest
+		if err = gproto.Unmarshal(item.Payload, &req); err == nil {
+			if _, err = submitComment(ctx, &req, item.Ref); err != nil {
+				err = requeueComment(ctx, item, req.Oid)
+			}
+		}
+	case moderation.KindGoods:
+		var req proto.UploadRequest
+		if err = gproto.Unmarshal(item.Payload, &req); err == nil {
+			var code int32
+			code, err = rpc.UploadGoods(ctx, &req)
+			if err == nil && code == misc.CodeFail {
+				err = errors.New("upload goods fail")
+			}
+		}
+	default:
+		err = errors.New("unknown moderation kind " + item.Kind)
+	}
+	if err != nil {
+		misc.Logger.Error("approve moderation item err", zap.Error(err), zap.Int64("id", item.Id))
+		// 内容留在队列中,可以重新审核
+		if err = moderation.Unclaim(ctx, item.Id); err != nil {
+			misc.Logger.Error("unclaim moderation item err", zap.Error(err), zap.Int64("id", item.Id))
+		}
+		utils.FailWithMsg(c, "提交失败")
+		return
+	}
+	if err = moderation.Finish(ctx, item.Id); err != nil {
+		misc.Logger.Error("finish moderation item err", zap.Error(err), zap.Int64("id", item.Id))
+	}
+
+	span.SetAttributes(
+		attribute.Int64("itemId", item.Id),
+		attribute.String("kind", item.Kind),
+	)
+
+	utils.SuccessWithMsg(c, "approve success", nil)
+}
+
+//RejectModeration 审核驳回,丢弃原始请求
+func RejectModeration(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ModerationItemForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle reject moderation bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	ctx := c.Request.Context()
+	item, err := claimModeration(ctx, form.Id)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	// 评价被驳回后买家可以重新评价
+	if item.Kind == moderation.KindComment {
+		var req proto.AddCommentRequest
+		if err = gproto.Unmarshal(item.Payload, &req); err == nil {
+			err = comment.ReleaseOrder(ctx, req.Oid)
+		}
+		if err != nil {
+			misc.Logger.Error("reject moderation release order err", zap.Error(err))
+		}
+	}
+	if err = moderation.Finish(ctx, item.Id); err != nil {
+		misc.Logger.Error("finish moderation item err", zap.Error(err), zap.Int64("id", item.Id))
+		if err = moderation.Unclaim(ctx, item.Id); err != nil {
+			misc.Logger.Error("unclaim moderation item err", zap.Error(err), zap.Int64("id", item.Id))
+		}
+		utils.FailWithMsg(c, "驳回失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("itemId", item.Id),
+		attribute.String("kind", item.Kind),
+	)
+
+	utils.SuccessWithMsg(c, "reject success", nil)
+}
+
+//moderateText 审核不需要人工介入的文本,返回打码后的内容
+func moderateText(kind, text string) (string, error) {
+	res := moderation.Default.Check(kind, text)
+	switch res.Action {
+	case moderation.ActionReject:
+		misc.Logger.Info("content rejected by moderation", zap.String("kind", kind), zap.Strings("reasons", res.Reasons))
+		return "", errors.New("内容包含违规信息")
+	case moderation.ActionReview:
+		return "", errors.New("内容可能违规,请修改后重试")
+	}
+	return res.Text, nil
+}
+
+//claimModeration 锁定待审核内容,返回可以直接展示给审核员的错误
+func claimModeration(ctx context.Context, id int64) (*moderation.Item, error) {
+	item, err := moderation.Claim(ctx, id, moderationClaimExpire)
+	if err != nil {
+		misc.Logger.Error("claim moderation item err", zap.Error(err), zap.Int64("id", id))
+		if errors.Is(err, moderation.ErrItemClaimed) {
+			return nil, err
+		}
+		return nil, moderation.ErrItemNotFound
+	}
+	return item, nil
+}
+
+//queuedReviewExpire 排队中的评价占用订单名额的时间,比审核内容的保留时间多留出处理时间,
+//内容过期后名额随之释放
+func queuedReviewExpire(createTime int64) time.Duration {
+	expire := misc.Conf.Moderation.QueueExpire
+	if expire <= 0 {
+		return 0
+	}
+	left := time.Until(time.Unix(createTime+int64(expire), 0))
+	if left < 0 {
+		left = 0
+	}
+	return left + reviewReserveExpire
+}
+
+//requeueComment 评价审核通过但提交失败,submitComment已释放订单名额,重新占用后留在队列中。
+//名额已被占用说明评价已经存在或买家重新评价,审核内容作废
+func requeueComment(ctx context.Context, item *moderation.Item, oid int32) error {
+	err := comment.ReserveOrder(ctx, oid, queuedReviewExpire(item.CreateTime))
+	if errors.Is(err, comment.ErrOrderReviewed) {
+		if err = moderation.Finish(ctx, item.Id); err != nil {
+			misc.Logger.Error("finish moderation item err", zap.Error(err), zap.Int64("id", item.Id))
+		}
+		return comment.ErrOrderReviewed
+	}
+	if err != nil {
+		misc.Logger.Error("requeue comment reserve order err", zap.Error(err), zap.Int32("oid", oid))
+	}
+	return errors.New("submit comment fail")
+}
+
+//enqueueModeration 将原始rpc请求放入人工审核队列
+func enqueueModeration(ctx context.Context, kind string, uid, ref int32, texts, reasons []string, req gproto.Message) error {
+	payload, err := gproto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	item := &moderation.Item{
+		Kind:    kind,
+		Uid:     uid,
+		Ref:     ref,
+		Text:    texts,
+		Reasons: reasons,
+		Payload: payload,
+	}
+	return moderation.Enqueue(ctx, item, time.Duration(misc.Conf.Moderation.QueueExpire)*time.Second)
+}
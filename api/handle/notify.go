@@ -0,0 +1,253 @@
+package handle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/gateway"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/notify"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// 推送到gateway的事件类型
+const (
+	eventNotification = "notification"
+	eventOrderStatus  = "order_status"
+)
+
+const (
+	//streamHeartbeat 推送连接的心跳间隔,避免被代理断开
+	streamHeartbeat = 25 * time.Second
+)
+
+//streamCtx 服务关闭时取消,结束所有推送连接
+var streamCtx, cancelStreams = context.WithCancel(context.Background())
+
+//CloseStreams 关闭所有推送连接,在服务关闭时调用
+func CloseStreams() {
+	cancelStreams()
+}
+
+//ListNotifications 获取用户站内通知
+func ListNotifications(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ListNotificationForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle list notification bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	list, err := notify.List(c.Request.Context(), uid, *form.Page, *form.Count)
+	if err != nil {
+		misc.Logger.Error("list notification err", zap.Error(err))
+		utils.FailWithMsg(c, "获取通知失败")
+		return
+	}
+	unread, err := notify.UnreadCount(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("get unread count err", zap.Error(err))
+		utils.FailWithMsg(c, "获取通知失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"len":    len(list),
+		"data":   list,
+		"unread": unread,
+	}
+
+	utils.SuccessWithMsg(c, "list notification success", data)
+}
+
+//ReadNotifications 标记通知已读,ids为空时全部已读
+func ReadNotifications(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ReadNotificationForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle read notification bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	if err = notify.MarkRead(c.Request.Context(), uid, form.Ids); err != nil {
+		misc.Logger.Error("mark notification read err", zap.Error(err))
+		utils.FailWithMsg(c, "操作失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int("count", len(form.Ids)),
+	)
+
+	utils.SuccessWithMsg(c, "read notification success", nil)
+}
+
+//GetUnreadCount 获取未读通知数
+func GetUnreadCount(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	unread, err := notify.UnreadCount(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("get unread count err", zap.Error(err))
+		utils.FailWithMsg(c, "获取通知失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"unread": unread,
+	}
+
+	utils.SuccessWithMsg(c, "get unread count success", data)
+}
+
+//StreamNotifications 通过Server-Sent Events实时推送新通知
+func StreamNotifications(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	sub := notify.Subscribe(ctx, uid)
+	defer sub.Close()
+	// 等待订阅生效,避免丢失订阅前后的通知
+	if _, err = sub.Receive(ctx); err != nil {
+		misc.Logger.Error("subscribe notification err", zap.Error(err))
+		utils.FailWithMsg(c, "订阅通知失败")
+		return
+	}
+	unread, err := notify.UnreadCount(ctx, uid)
+	if err != nil {
+		misc.Logger.Error("get unread count err", zap.Error(err))
+	}
+
+	ch := sub.Channel()
+	ticker := time.NewTicker(streamHeartbeat)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("unread", unread)
+	c.Writer.Flush()
+
+	misc.Logger.Info("notification stream open", zap.Int32("uid", uid))
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-streamCtx.Done():
+			c.SSEvent("close", "server shutdown")
+			return false
+		case msg, ok := <-ch:
+			if !ok {
+				return false
+			}
+			c.SSEvent("notification", msg.Payload)
+			return true
+		case <-ticker.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		}
+	})
+	misc.Logger.Info("notification stream close", zap.Int32("uid", uid))
+}
+
+var orderStatusText = map[int32]string{
+	misc.OrderStatusCreated:  "待卖家确认",
+	misc.OrderStatusAccepted: "卖家已确认",
+	misc.OrderStatusFinished: "已完成",
+	misc.OrderStatusCanceled: "已取消",
+	misc.OrderStatusPaid:     "买家已支付",
+	misc.OrderStatusRefunded: "已退款",
+	misc.OrderStatusDisputed: "纠纷处理中",
+}
+
+//notifyOrderStatus 订单状态变化时通知订单的另一方,operator为操作人
+func notifyOrderStatus(ctx context.Context, order *proto.Order, status, operator int32) {
+	to := order.Sellid
+	if operator == order.Sellid {
+		to = order.Buyid
+	}
+	text, ok := orderStatusText[status]
+	if !ok {
+		return
+	}
+	typ := notify.TypeOrderStatus
+	if status == misc.OrderStatusPaid {
+		typ = notify.TypePaid
+	}
+	publishEvent(ctx, gateway.OrderChannel(order.Id), &gateway.Event{
+		Type: eventOrderStatus,
+		Data: map[string]interface{}{
+			"oid":      order.Id,
+			"status":   status,
+			"operator": operator,
+		},
+	})
+	sendNotification(ctx, &notify.Notification{
+		Uid:     to,
+		Type:    typ,
+		Title:   "订单状态更新",
+		Content: fmt.Sprintf("%s 的订单%s", order.Gname, text),
+		Data: map[string]interface{}{
+			"oid":    order.Id,
+			"gid":    order.GId,
+			"status": status,
+		},
+	})
+}
+
+//sendNotification 投递通知,失败时只记录日志,不影响主流程
+func sendNotification(ctx context.Context, n *notify.Notification) {
+	if n.Uid == 0 {
+		return
+	}
+	if err := notify.Send(ctx, n); err != nil {
+		misc.Logger.Error("send notification err", zap.Error(err), zap.Int32("uid", n.Uid), zap.String("type", n.Type))
+		return
+	}
+	publishEvent(ctx, gateway.UserChannel(n.Uid), &gateway.Event{Type: eventNotification, Data: n})
+}
@@ -1,9 +1,17 @@
 package handle
 
 import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+
 	"github.com/dopamine-joker/zu_web_server/api/rpc"
 	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/notify"
+	"github.com/dopamine-joker/zu_web_server/payment"
 	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/rating"
 	"github.com/dopamine-joker/zu_web_server/utils"
 	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/otel/attribute"
@@ -11,6 +19,38 @@ import (
 	"go.uber.org/zap"
 )
 
+var (
+	errOrderRpc      = errors.New("订单获取失败")
+	errOrderNotFound = errors.New("订单不存在")
+)
+
+//orderTransition 订单状态变更,key为当前状态,value为可以变更到的状态
+type orderTransition map[int32][]int32
+
+var (
+	// 卖家确认或拒绝订单,买家归还后确认完成;支付后不能再取消,需要走退款
+	// 线下付款的订单可以从已确认直接完成,发起过在线支付的订单见checkOfflineFinish
+	sellerTransitions = orderTransition{
+		misc.OrderStatusCreated:  {misc.OrderStatusAccepted, misc.OrderStatusCanceled},
+		misc.OrderStatusAccepted: {misc.OrderStatusCanceled, misc.OrderStatusFinished},
+		misc.OrderStatusPaid:     {misc.OrderStatusFinished},
+	}
+	// 买家只能在支付前取消订单
+	buyerTransitions = orderTransition{
+		misc.OrderStatusCreated:  {misc.OrderStatusCanceled},
+		misc.OrderStatusAccepted: {misc.OrderStatusCanceled},
+	}
+)
+
+func (t orderTransition) allow(from, to int32) bool {
+	for _, s := range t[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
 func AddOrder(c *gin.Context) {
 
 	span := trace.SpanFromContext(c.Request.Context())
@@ -31,25 +71,67 @@ func AddOrder(c *gin.Context) {
 		return
 	}
 
+	if hiddenGoods(c.Request.Context(), []int32{form.GId})[form.GId] {
+		utils.FailWithMsg(c, "物品已下架")
+		return
+	}
+
+	// 卖家和学校以物品记录为准,不信任客户端传入的值
+	code, goods, _, err := rpc.PicList(c.Request.Context(), &proto.GetGoodsDetailRequest{Gid: form.GId})
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("add order rpc get goods err", zap.Error(err), zap.Int32("gid", form.GId))
+		utils.FailWithMsg(c, "物品不存在")
+		return
+	}
+	if form.SellId != 0 && form.SellId != goods.Uid {
+		utils.FailWithMsg(c, "订单与物品不匹配")
+		return
+	}
+	if goods.Uid == uid {
+		utils.FailWithMsg(c, "不能租借自己发布的物品")
+		return
+	}
+	goodsSchool := canonicalSchool(goods.School)
+	if err = checkSchool(c.Request.Context(), uid, goodsSchool); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	if err = checkBlocked(c.Request.Context(), uid, goods.Uid); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
 	req := &proto.AddOrderRequest{
 		Buyid:  uid,
-		Sellid: form.SellId,
+		Sellid: goods.Uid,
 		Gid:    form.GId,
-		School: form.School,
+		School: goodsSchool,
 	}
 
-	code, err := rpc.AddOrder(c.Request.Context(), req)
+	code, err = rpc.AddOrder(c.Request.Context(), req)
 	if err != nil || code == misc.CodeFail {
 		misc.Logger.Error("rpc add order err", zap.Error(err))
 		utils.FailWithMsg(c, "添加失败")
 		return
 	}
 
+	sendNotification(c.Request.Context(), &notify.Notification{
+		Uid:     goods.Uid,
+		Type:    notify.TypeNewOrder,
+		Title:   "收到新的租借订单",
+		Content: "有买家下单租借你的物品,请及时确认",
+		Data: map[string]interface{}{
+			"gid":   form.GId,
+			"buyId": uid,
+		},
+	})
+
 	span.SetAttributes(
 		attribute.Int64("buyId", int64(uid)),
-		attribute.Int64("sellId", int64(form.SellId)),
+		attribute.Int64("sellId", int64(goods.Uid)),
 		attribute.Int64("goodId", int64(form.GId)),
-		attribute.String("school", form.School),
+		attribute.String("school", goodsSchool),
 		attribute.Int64("code", int64(code)),
 	)
 
@@ -95,7 +177,7 @@ func GetBuyOrder(c *gin.Context) {
 			"sellName": order.SellName,
 			"gid":      order.GId,
 			"gName":    order.Gname,
-			"school":   order.School,
+			"school":   canonicalSchool(order.School),
 			"price":    order.Price,
 			"type":     order.Type,
 			"cover":    order.Cover,
@@ -153,7 +235,7 @@ func GetSellOrder(c *gin.Context) {
 			"sellName": order.SellName,
 			"gid":      order.GId,
 			"gName":    order.Gname,
-			"school":   order.School,
+			"school":   canonicalSchool(order.School),
 			"price":    order.Price,
 			"type":     order.Type,
 			"cover":    order.Cover,
@@ -192,6 +274,28 @@ func UpdateOrder(c *gin.Context) {
 		return
 	}
 
+	transitions := sellerTransitions
+	order, err := findSellOrder(c.Request.Context(), uid, form.Id)
+	if errors.Is(err, errOrderNotFound) {
+		transitions = buyerTransitions
+		order, err = findBuyOrder(c.Request.Context(), uid, form.Id)
+	}
+	if err != nil {
+		misc.Logger.Error("update order find order err", zap.Error(err), zap.Int32("oid", form.Id))
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if !transitions.allow(order.Status, form.Status) {
+		utils.FailWithMsg(c, "订单当前状态不能进行此操作")
+		return
+	}
+	if order.Status == misc.OrderStatusAccepted && form.Status == misc.OrderStatusFinished {
+		if err = checkOfflineFinish(c.Request.Context(), order.Id); err != nil {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+	}
+
 	req := &proto.UpdateOrderRequest{
 		Id:     form.Id,
 		Uid:    uid,
@@ -205,6 +309,14 @@ func UpdateOrder(c *gin.Context) {
 		return
 	}
 
+	if req.Status == misc.OrderStatusFinished {
+		recordFinishedOrder(c.Request.Context(), order)
+	}
+	notifyOrderStatus(c.Request.Context(), order, req.Status, uid)
+	if available, ok := orderAvailability(req.Status); ok {
+		changeAvailability(c.Request.Context(), order.GId, order.Gname, available, order.Buyid)
+	}
+
 	span.SetAttributes(
 		attribute.Int64("orderId", int64(req.Id)),
 		attribute.Int64("status", int64(req.Status)),
@@ -212,3 +324,60 @@ func UpdateOrder(c *gin.Context) {
 
 	utils.SuccessWithMsg(c, "update order success", nil)
 }
+
+//checkOfflineFinish 已确认的订单只有没有发起过在线支付时才能直接完成,否则需等支付完成
+func checkOfflineFinish(ctx context.Context, oid int32) error {
+	_, err := payment.GetOrderIntent(ctx, oid)
+	if errors.Is(err, payment.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		misc.Logger.Error("get order intent err", zap.Error(err), zap.Int32("oid", oid))
+		return errors.New("支付状态获取失败")
+	}
+	return errors.New("订单已发起在线支付,需支付完成后才能完成订单")
+}
+
+//recordFinishedOrder 完成的订单计入卖家信誉
+func recordFinishedOrder(ctx context.Context, order *proto.Order) {
+	if err := rating.AddOrder(ctx, order.Sellid, order.Id); err != nil {
+		misc.Logger.Error("add rating order err", zap.Error(err), zap.Int32("oid", order.Id))
+	}
+}
+
+//findBuyOrder 从用户的购买订单中查找订单
+func findBuyOrder(ctx context.Context, uid, oid int32) (*proto.Order, error) {
+	code, list, err := rpc.GetBuyOrder(ctx, &proto.GetBuyOrderRequest{Buyid: uid})
+	if err != nil || code == misc.CodeFail {
+		return nil, errOrderRpc
+	}
+	for _, order := range list {
+		if order.Id == oid {
+			return order, nil
+		}
+	}
+	return nil, errOrderNotFound
+}
+
+//findSellOrder 从用户的出售订单中查找订单
+func findSellOrder(ctx context.Context, uid, oid int32) (*proto.Order, error) {
+	code, list, err := rpc.GetSellOrder(ctx, &proto.GetSellOrderRequest{Sellid: uid})
+	if err != nil || code == misc.CodeFail {
+		return nil, errOrderRpc
+	}
+	for _, order := range list {
+		if order.Id == oid {
+			return order, nil
+		}
+	}
+	return nil, errOrderNotFound
+}
+
+//priceToCent 价格字符串转换为分
+func priceToCent(price string) (int64, error) {
+	f, err := strconv.ParseFloat(price, 64)
+	if err != nil || f < 0 {
+		return 0, errors.New("价格格式错误")
+	}
+	return int64(math.Round(f * 100)), nil
+}
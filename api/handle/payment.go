@@ -0,0 +1,342 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/notify"
+	"github.com/dopamine-joker/zu_web_server/payment"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+//CreatePayment 买家为订单创建支付单
+func CreatePayment(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form CreatePaymentForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle create payment bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	order, err := findBuyOrder(c.Request.Context(), uid, form.OId)
+	if err != nil {
+		misc.Logger.Error("create payment find order err", zap.Error(err))
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if order.Status != misc.OrderStatusCreated && order.Status != misc.OrderStatusAccepted {
+		utils.FailWithMsg(c, "订单当前状态无法支付")
+		return
+	}
+
+	// 已有未过期的支付单直接返回
+	old, err := payment.GetOrderIntent(c.Request.Context(), order.Id)
+	if err == nil && old.Status == payment.IntentCreated && !old.Expired() {
+		utils.SuccessWithMsg(c, "create payment success", intentData(old))
+		return
+	}
+	// 已支付但订单状态没有更新成功,补推订单状态
+	if err == nil && old.Status == payment.IntentSucceeded {
+		if err = markOrderPaid(c.Request.Context(), old); err != nil {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		utils.FailWithMsg(c, "订单已支付")
+		return
+	}
+	if err != nil && !errors.Is(err, payment.ErrNotFound) {
+		misc.Logger.Error("get order intent err", zap.Error(err))
+		utils.FailWithMsg(c, "创建支付失败")
+		return
+	}
+
+	amount, err := priceToCent(order.Price)
+	if err != nil {
+		misc.Logger.Error("create payment parse price err", zap.String("price", order.Price))
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	now := time.Now().Unix()
+	intent := &payment.Intent{
+		Oid:       order.Id,
+		BuyId:     order.Buyid,
+		SellId:    order.Sellid,
+		Amount:    amount,
+		Status:    payment.IntentCreated,
+		CreatedAt: now,
+	}
+	if expire := misc.Conf.PayCfg.Expire; expire > 0 {
+		intent.ExpiresAt = now + int64(expire)
+	}
+	if err = payment.Default.CreateIntent(c.Request.Context(), intent); err != nil {
+		misc.Logger.Error("provider create intent err", zap.Error(err))
+		utils.FailWithMsg(c, "创建支付失败")
+		return
+	}
+	if err = payment.SaveIntent(c.Request.Context(), intent); err != nil {
+		misc.Logger.Error("save intent err", zap.Error(err))
+		utils.FailWithMsg(c, "创建支付失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("orderId", int64(order.Id)),
+		attribute.String("intentId", intent.Id),
+		attribute.Int64("amount", intent.Amount),
+	)
+
+	utils.SuccessWithMsg(c, "create payment success", intentData(intent))
+}
+
+//PaymentCallback 支付渠道回调,不需要token,依靠签名校验
+func PaymentCallback(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	ev, err := payment.Default.ParseCallback(c.Request)
+	if err != nil {
+		misc.Logger.Error("parse payment callback err", zap.Error(err))
+		utils.FailWithMsg(c, "回调校验失败")
+		return
+	}
+
+	if err = applyPaymentEvent(c.Request.Context(), ev); err != nil {
+		utils.FailWithMsg(c, "回调处理失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("intentId", ev.IntentId),
+		attribute.String("status", ev.Status),
+	)
+
+	utils.SuccessWithMsg(c, "payment callback success", nil)
+}
+
+//MockPay 本地开发时模拟买家完成支付,走与真实回调相同的验签流程
+func MockPay(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form MockPayForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle mock pay bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	mock, ok := payment.Default.(*payment.MockProvider)
+	if !ok {
+		utils.FailWithMsg(c, "当前支付渠道不支持模拟支付")
+		return
+	}
+
+	intent, err := payment.GetIntent(c.Request.Context(), form.IntentId)
+	if err != nil || intent.BuyId != uid {
+		utils.FailWithMsg(c, "支付单不存在")
+		return
+	}
+
+	status := form.Status
+	if status == "" {
+		status = payment.IntentSucceeded
+	}
+	req, err := mock.Complete(intent, status)
+	if errors.Is(err, payment.ErrExpired) {
+		utils.FailWithMsg(c, "支付单已过期,请重新发起支付")
+		return
+	}
+	if err != nil {
+		misc.Logger.Error("mock complete err", zap.Error(err))
+		utils.FailWithMsg(c, "模拟支付失败")
+		return
+	}
+	ev, err := mock.ParseCallback(req)
+	if err != nil {
+		misc.Logger.Error("mock parse callback err", zap.Error(err))
+		utils.FailWithMsg(c, "模拟支付失败")
+		return
+	}
+	if err = applyPaymentEvent(c.Request.Context(), ev); err != nil {
+		utils.FailWithMsg(c, "模拟支付失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("intentId", ev.IntentId),
+		attribute.String("status", ev.Status),
+	)
+
+	utils.SuccessWithMsg(c, "mock pay success", nil)
+}
+
+//RefundPayment 卖家对已支付订单退款
+func RefundPayment(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form RefundPaymentForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle refund payment bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	order, err := findSellOrder(c.Request.Context(), uid, form.OId)
+	if err != nil {
+		misc.Logger.Error("refund payment find order err", zap.Error(err))
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	// 纠纷中的订单由管理员处理退款
+	if order.Status == misc.OrderStatusDisputed {
+		utils.FailWithMsg(c, "订单纠纷处理中,无法退款")
+		return
+	}
+
+	intent, refund, err := refundOrder(c.Request.Context(), order, form.Amount)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("orderId", int64(order.Id)),
+		attribute.String("refundId", refund.Id),
+		attribute.Int64("amount", refund.Amount),
+	)
+
+	data := intentData(intent)
+	data["refundId"] = refund.Id
+	utils.SuccessWithMsg(c, "refund success", data)
+}
+
+//applyPaymentEvent 更新支付单,支付成功后推进订单状态。
+//重复回调同样会检查订单,上次订单更新失败时由渠道重试回调补推
+func applyPaymentEvent(ctx context.Context, ev *payment.Event) error {
+	intent, _, err := payment.Apply(ctx, ev)
+	if err != nil {
+		misc.Logger.Error("apply payment event err", zap.Error(err), zap.String("intentId", ev.IntentId))
+		return err
+	}
+	if intent.Status != payment.IntentSucceeded {
+		return nil
+	}
+	return markOrderPaid(ctx, intent)
+}
+
+//markOrderPaid 支付单已成功而订单仍未支付时把订单推进到已支付
+func markOrderPaid(ctx context.Context, intent *payment.Intent) error {
+	order, err := findBuyOrder(ctx, intent.BuyId, intent.Oid)
+	if err != nil {
+		misc.Logger.Error("payment find order err", zap.Error(err), zap.Int32("oid", intent.Oid))
+		return errors.New("订单状态更新失败")
+	}
+	if order.Status != misc.OrderStatusCreated && order.Status != misc.OrderStatusAccepted {
+		return nil
+	}
+	req := &proto.UpdateOrderRequest{
+		Id:     intent.Oid,
+		Uid:    intent.BuyId,
+		Status: misc.OrderStatusPaid,
+	}
+	code, err := rpc.UpdateOrder(ctx, req)
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("payment rpc update order err", zap.Error(err), zap.Int32("oid", intent.Oid))
+		return errors.New("订单状态更新失败")
+	}
+	notifyOrderStatus(ctx, order, misc.OrderStatusPaid, order.Buyid)
+	changeAvailability(ctx, order.GId, order.Gname, false, order.Buyid)
+	return nil
+}
+
+//refundOrder 退款amount分,全额退款后订单进入已退款状态
+func refundOrder(ctx context.Context, order *proto.Order, amount int64) (*payment.Intent, *payment.Refund, error) {
+	old, err := payment.GetOrderIntent(ctx, order.Id)
+	if err != nil {
+		misc.Logger.Error("refund get order intent err", zap.Error(err))
+		return nil, nil, errors.New("订单没有支付记录")
+	}
+	intent, refund, err := payment.RefundIntent(ctx, old.Id, amount)
+	if errors.Is(err, payment.ErrRefunding) || errors.Is(err, payment.ErrAmount) || errors.Is(err, payment.ErrStatus) {
+		return nil, nil, err
+	}
+	if err != nil {
+		misc.Logger.Error("refund intent err", zap.Error(err), zap.Int32("oid", order.Id))
+		return nil, nil, errors.New("退款失败")
+	}
+	if intent.Status == payment.IntentRefunded {
+		req := &proto.UpdateOrderRequest{
+			Id:     order.Id,
+			Uid:    order.Sellid,
+			Status: misc.OrderStatusRefunded,
+		}
+		code, err := rpc.UpdateOrder(ctx, req)
+		if err != nil || code == misc.CodeFail {
+			misc.Logger.Error("refund rpc update order err", zap.Error(err), zap.Int32("oid", order.Id))
+		} else {
+			changeAvailability(ctx, order.GId, order.Gname, true, order.Buyid)
+		}
+	}
+	sendNotification(ctx, &notify.Notification{
+		Uid:     order.Buyid,
+		Type:    notify.TypeRefund,
+		Title:   "订单已退款",
+		Content: fmt.Sprintf("%s 的订单退款 %.2f 元", order.Gname, float64(refund.Amount)/100),
+		Data: map[string]interface{}{
+			"oid":    order.Id,
+			"amount": refund.Amount,
+			"status": intent.Status,
+		},
+	})
+	return intent, refund, nil
+}
+
+func intentData(intent *payment.Intent) map[string]interface{} {
+	return map[string]interface{}{
+		"intentId":  intent.Id,
+		"oid":       intent.Oid,
+		"amount":    intent.Amount,
+		"refunded":  intent.Refunded,
+		"status":    intent.Status,
+		"payUrl":    intent.PayUrl,
+		"expiresAt": intent.ExpiresAt,
+	}
+}
@@ -0,0 +1,255 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dopamine-joker/zu_web_server/account"
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/otp"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/sms"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// 短信验证码的使用场景
+const (
+	otpPhone = "phone"
+	otpLogin = "login"
+)
+
+//SendPhoneCode 向手机号发送验证码,用于验证当前手机号或更换手机号
+func SendPhoneCode(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form SendPhoneCodeForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle send phone code bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	phone, err := sms.NormalizePhone(form.Phone)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if err = sendSmsCode(c.Request.Context(), otpPhone, phoneTarget(uid, phone), phone); err != nil {
+		utils.FailWithMsg(c, otpErrMsg(err, "发送失败"))
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+	)
+
+	data := map[string]interface{}{
+		"phone": sms.Mask(phone),
+	}
+
+	utils.SuccessWithMsg(c, "send phone code success", data)
+}
+
+//VerifyPhone 验证当前绑定的手机号
+func VerifyPhone(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form VerifyPhoneForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle verify phone bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	user, err := utils.GetContextUser(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	phone, err := sms.NormalizePhone(user.GetPhone())
+	if err != nil {
+		utils.FailWithMsg(c, "请先填写正确的手机号")
+		return
+	}
+	ctx := c.Request.Context()
+	if err = otp.Verify(ctx, otpPhone, phoneTarget(user.GetId(), phone), form.Code); err != nil {
+		utils.FailWithMsg(c, otpErrMsg(err, "验证失败"))
+		return
+	}
+	if err = account.SetPhoneVerified(ctx, user.GetId(), phone); err != nil {
+		misc.Logger.Error("set phone verified err", zap.Error(err))
+		utils.FailWithMsg(c, "验证失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(user.GetId())),
+	)
+
+	utils.SuccessWithMsg(c, "verify phone success", nil)
+}
+
+//SetSmsLogin 开启或关闭登录短信验证,开启前需要先验证手机号
+func SetSmsLogin(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form SmsLoginForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle set sms login bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	user, err := utils.GetContextUser(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	if *form.Enable && !phoneVerified(ctx, user) {
+		utils.FailWithMsg(c, "请先验证手机号")
+		return
+	}
+	if err = account.SetSmsLogin(ctx, user.GetId(), *form.Enable); err != nil {
+		misc.Logger.Error("set sms login err", zap.Error(err))
+		utils.FailWithMsg(c, "设置失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(user.GetId())),
+		attribute.Bool("enable", *form.Enable),
+	)
+
+	utils.SuccessWithMsg(c, "set sms login success", nil)
+}
+
+func phoneTarget(uid int32, phone string) string {
+	return fmt.Sprintf("%d:%s", uid, phone)
+}
+
+func sendSmsCode(ctx context.Context, scene, target, phone string) error {
+	code, err := otp.Issue(ctx, scene, target)
+	if err != nil {
+		return err
+	}
+	return sms.Default.Send(ctx, phone, fmt.Sprintf("验证码%s,%d分钟内有效,请勿泄露给他人。", code, misc.Conf.Otp.Expire/60))
+}
+
+func otpErrMsg(err error, fallback string) string {
+	if otp.IsUserErr(err) {
+		return err.Error()
+	}
+	misc.Logger.Error("otp err", zap.Error(err))
+	return fallback
+}
+
+//phoneVerified 用户当前手机号是否已验证
+func phoneVerified(ctx context.Context, user *proto.User) bool {
+	phone, err := sms.NormalizePhone(user.GetPhone())
+	if err != nil {
+		return false
+	}
+	verified, err := account.IsPhoneVerified(ctx, user.GetId(), phone)
+	if err != nil {
+		misc.Logger.Error("get phone verified err", zap.Error(err))
+	}
+	return verified
+}
+
+//checkPhoneChange 手机号变化时校验新手机号的验证码,返回需要保存的手机号以及是否已验证
+func checkPhoneChange(ctx context.Context, user *proto.User, newPhone, code string) (string, bool, error) {
+	if strings.TrimSpace(newPhone) == strings.TrimSpace(user.GetPhone()) {
+		return newPhone, false, nil
+	}
+	phone, err := sms.NormalizePhone(newPhone)
+	if err != nil {
+		return "", false, err
+	}
+	if phone == strings.TrimSpace(user.GetPhone()) {
+		return phone, false, nil
+	}
+	if code == "" {
+		return "", false, errors.New("更换手机号需要填写验证码")
+	}
+	if err = otp.Verify(ctx, otpPhone, phoneTarget(user.GetId(), phone), code); err != nil {
+		return "", false, errors.New(otpErrMsg(err, "验证失败"))
+	}
+	return phone, true, nil
+}
+
+//checkLoginSms 开启登录短信验证的用户在密码正确后还需要校验验证码,未通过时注销本次登录的token
+func checkLoginSms(c *gin.Context, token string, user *proto.User, code string) bool {
+	ctx := c.Request.Context()
+	enabled, err := account.SmsLoginEnabled(ctx, user.GetId())
+	if err == nil && !enabled {
+		return true
+	}
+	passed := false
+	defer func() {
+		if !passed {
+			revokeToken(ctx, token)
+		}
+	}()
+	if err != nil {
+		misc.Logger.Error("get sms login err", zap.Error(err))
+		utils.FailWithMsg(c, "登录失败")
+		return false
+	}
+	phone, err := sms.NormalizePhone(user.GetPhone())
+	if err != nil {
+		utils.FailWithMsg(c, "手机号无效,无法发送验证码")
+		return false
+	}
+	target := strconv.Itoa(int(user.GetId()))
+	if code == "" {
+		// 冷却中说明验证码已经发出,直接提示输入
+		if err = sendSmsCode(ctx, otpLogin, target, phone); err != nil && !errors.Is(err, otp.ErrCooldown) {
+			utils.FailWithMsg(c, otpErrMsg(err, "发送失败"))
+			return false
+		}
+		data := map[string]interface{}{
+			"phone": sms.Mask(phone),
+		}
+		utils.ResponseWithCode(c, misc.CodeSmsRequired, "请输入短信验证码", data)
+		return false
+	}
+	if err = otp.Verify(ctx, otpLogin, target, code); err != nil {
+		utils.FailWithMsg(c, otpErrMsg(err, "登录失败"))
+		return false
+	}
+	passed = true
+	return true
+}
+
+func revokeToken(ctx context.Context, token string) {
+	code, err := rpc.Logout(ctx, &proto.LogoutRequest{Token: token})
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("rpc revoke token err", zap.Error(err))
+	}
+}
@@ -0,0 +1,351 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/account"
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/mail"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// 资料更新的字段
+const (
+	profileName   = "name"
+	profilePhone  = "phone"
+	profileSchool = "school"
+	profileSex    = "sex"
+	profileEmail  = "email"
+)
+
+const (
+	throttleChangeEmail = "changeEmail"
+)
+
+//UpdateProfile 按mask更新部分资料,更换邮箱需要确认新邮箱后才生效
+func UpdateProfile(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form UpdateProfileForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle update profile bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	user, err := utils.GetContextUser(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	pending, err := updateProfile(c.Request.Context(), user, &form)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(user.GetId())),
+		attribute.StringSlice("mask", form.Mask),
+	)
+
+	data := map[string]interface{}{
+		"emailPending": pending,
+	}
+
+	utils.SuccessWithMsg(c, "update profile success", data)
+}
+
+//UpdateUser 旧版整体更新资料接口,已废弃,请使用PATCH /user/profile
+//所有字段按mask全量走UpdateProfile的校验,password作为当前密码校验,修改密码请使用/user/password
+func UpdateUser(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form UpdateUserForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle update user bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	user, err := utils.GetContextUser(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	pending, err := updateProfile(c.Request.Context(), user, &UpdateProfileForm{
+		Mask:      []string{profileName, profilePhone, profileSchool, profileSex, profileEmail},
+		Name:      form.Name,
+		Phone:     form.Phone,
+		PhoneCode: form.PhoneCode,
+		School:    form.School,
+		Sex:       form.Sex,
+		Email:     form.Email,
+		Password:  form.Password,
+	})
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(user.GetId())),
+	)
+
+	data := map[string]interface{}{
+		"emailPending": pending,
+	}
+
+	utils.SuccessWithMsg(c, "update user success", data)
+}
+
+//updateProfile 校验当前密码后按mask更新资料,返回是否有待确认的新邮箱,错误信息可直接返回给前端
+func updateProfile(ctx context.Context, user *proto.User, form *UpdateProfileForm) (bool, error) {
+	var err error
+	if err = checkPassword(ctx, user.GetEmail(), form.Password); err != nil {
+		return false, err
+	}
+	p := profileOf(user)
+	changed, phoneChecked := false, false
+	var newEmail string
+	for _, field := range form.Mask {
+		switch field {
+		case profileName:
+			if strings.TrimSpace(form.Name) == "" {
+				return false, errors.New("昵称不能为空")
+			}
+			p.Name, changed = form.Name, true
+		case profilePhone:
+			p.Phone, phoneChecked, err = checkPhoneChange(ctx, user, form.Phone, form.PhoneCode)
+			if err != nil {
+				return false, err
+			}
+			changed = true
+		case profileSchool:
+			if p.School, err = normalizeUserSchool(form.School, user.GetSchool()); err != nil {
+				return false, err
+			}
+			changed = true
+		case profileSex:
+			p.Sex, changed = form.Sex, true
+		case profileEmail:
+			if form.Email == "" {
+				return false, errors.New("邮箱不能为空")
+			}
+			if account.NormalizeEmail(form.Email) != account.NormalizeEmail(user.GetEmail()) {
+				newEmail = form.Email
+			}
+		}
+	}
+
+	if newEmail != "" {
+		if err = checkEmailFree(ctx, user.GetId(), newEmail); err != nil {
+			return false, err
+		}
+		if err = throttleMail(ctx, throttleChangeEmail, newEmail); err != nil {
+			return false, err
+		}
+	}
+	if changed {
+		if err = saveUser(ctx, p, form.Password); err != nil {
+			misc.Logger.Error("update profile err", zap.Error(err))
+			return false, errors.New("更新失败")
+		}
+	}
+	if phoneChecked {
+		if err = account.SetPhoneVerified(ctx, p.Id, p.Phone); err != nil {
+			misc.Logger.Error("set phone verified err", zap.Error(err))
+		}
+	}
+	if newEmail != "" {
+		if err = sendChangeEmailMail(ctx, p.Id, newEmail); err != nil {
+			misc.Logger.Error("send change email mail err", zap.Error(err), zap.Int32("uid", p.Id))
+			return false, errors.New("确认邮件发送失败")
+		}
+	}
+	return newEmail != "", nil
+}
+
+//ChangePassword 校验原密码后修改密码
+func ChangePassword(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ChangePasswordForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle change password bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	user, err := utils.GetContextUser(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err = checkPassword(ctx, user.GetEmail(), form.OldPassword); err != nil {
+		utils.FailWithMsg(c, "原密码错误")
+		return
+	}
+
+	if err = saveUser(ctx, profileOf(user), form.NewPassword); err != nil {
+		misc.Logger.Error("change password err", zap.Error(err))
+		utils.FailWithMsg(c, "修改失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(user.GetId())),
+	)
+
+	utils.SuccessWithMsg(c, "change password success", nil)
+}
+
+//ConfirmEmailChange 使用新邮箱收到的token完成邮箱更换
+func ConfirmEmailChange(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ConfirmEmailChangeForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle confirm email change bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	ctx := c.Request.Context()
+	claims, err := account.ConsumeToken(ctx, account.PurposeChangeEmail, form.Token)
+	if err != nil {
+		utils.FailWithMsg(c, tokenErrMsg(err))
+		return
+	}
+	if err = checkEmailFree(ctx, claims.Uid, claims.Email); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	p, err := account.GetProfile(ctx, claims.Uid)
+	if err != nil {
+		misc.Logger.Error("confirm email change get profile err", zap.Error(err))
+		utils.FailWithMsg(c, "更换失败")
+		return
+	}
+	if err = checkPassword(ctx, p.Email, form.Password); err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	p.Email = claims.Email
+	if err = saveUser(ctx, p, form.Password); err != nil {
+		misc.Logger.Error("confirm email change err", zap.Error(err))
+		utils.FailWithMsg(c, "更换失败")
+		return
+	}
+	if err = account.SetVerified(ctx, claims.Uid, claims.Email); err != nil {
+		misc.Logger.Error("set email verified err", zap.Error(err))
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(claims.Uid)),
+	)
+
+	utils.SuccessWithMsg(c, "confirm email change success", nil)
+}
+
+func profileOf(user *proto.User) *account.Profile {
+	return &account.Profile{
+		Id:     user.GetId(),
+		Email:  user.GetEmail(),
+		Phone:  user.GetPhone(),
+		Name:   user.GetName(),
+		School: user.GetSchool(),
+		Sex:    user.GetSex(),
+		Face:   user.GetFace(),
+	}
+}
+
+//checkPassword logic服务没有单独的密码校验接口,用密码登录一次再注销
+func checkPassword(ctx context.Context, email, password string) error {
+	code, token, _, err := rpc.Login(ctx, &proto.LoginRequest{Email: email, Password: password})
+	if err != nil || code == misc.CodeFail {
+		return errors.New("密码错误")
+	}
+	revokeToken(ctx, token)
+	return nil
+}
+
+//saveUser 通过logic服务整体更新用户资料并刷新快照
+//UpdateUser接口会覆盖所有字段,包括密码,调用方必须传入已校验的当前密码或新密码
+func saveUser(ctx context.Context, p *account.Profile, password string) error {
+	if password == "" {
+		return errors.New("save user without password")
+	}
+	req := &proto.UpdateUserRequest{
+		Uid:      p.Id,
+		Email:    p.Email,
+		Name:     p.Name,
+		Phone:    p.Phone,
+		Password: password,
+		School:   p.School,
+		Sex:      p.Sex,
+	}
+	code, err := rpc.UpdateUser(ctx, req)
+	if err != nil {
+		return err
+	}
+	if code == misc.CodeFail {
+		return errors.New("rpc update user fail")
+	}
+	return account.SaveProfile(ctx, p)
+}
+
+//checkEmailFree 新邮箱不能已被其他用户使用
+func checkEmailFree(ctx context.Context, uid int32, email string) error {
+	owner, err := account.UidByEmail(ctx, email)
+	if errors.Is(err, account.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		misc.Logger.Error("get uid by email err", zap.Error(err))
+		return errors.New("校验邮箱失败")
+	}
+	if owner != uid {
+		return errors.New("该邮箱已被使用")
+	}
+	return nil
+}
+
+func sendChangeEmailMail(ctx context.Context, uid int32, email string) error {
+	expire := time.Duration(misc.Conf.Account.VerifyExpire) * time.Second
+	token, err := account.IssueToken(ctx, account.PurposeChangeEmail, uid, email, expire)
+	if err != nil {
+		return err
+	}
+	return mail.Default.Send(ctx, &mail.Mail{
+		To:      email,
+		Subject: "确认更换邮箱",
+		Body: fmt.Sprintf("请在%d小时内打开以下链接,确认将账号邮箱更换为本邮箱:\n\n%s?token=%s\n\n如果不是你本人操作,请忽略本邮件。",
+			int(expire.Hours()), misc.Conf.Account.ChangeEmailUrl, token),
+	})
+}
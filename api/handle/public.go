@@ -0,0 +1,265 @@
+package handle
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dopamine-joker/zu_web_server/account"
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/block"
+	"github.com/dopamine-joker/zu_web_server/campus"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/rating"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/dopamine-joker/zu_web_server/watch"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+//GetPublicProfile 查看用户公开主页,按对方的隐私设置隐藏字段,查看自己时不做隐藏
+func GetPublicProfile(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form PublicProfileForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle public profile bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	privacy, err := profilePrivacy(ctx, uid, form.Uid)
+	if err != nil {
+		if errors.Is(err, errProfileBlocked) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		misc.Logger.Error("public profile get privacy err", zap.Error(err))
+		utils.FailWithMsg(c, "获取主页失败")
+		return
+	}
+	profile, err := account.GetProfile(ctx, form.Uid)
+	if err != nil && !errors.Is(err, account.ErrNotFound) {
+		misc.Logger.Error("public profile get profile err", zap.Error(err))
+		utils.FailWithMsg(c, "获取主页失败")
+		return
+	}
+
+	code, list, err := rpc.GetUserGoods(ctx, &proto.GetUserGoodsListRequest{Uid: form.Uid})
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("public profile rpc user goods err", zap.Error(err))
+		utils.FailWithMsg(c, "获取主页失败")
+		return
+	}
+	// 没有资料快照的老用户只能从物品列表中取昵称
+	if profile == nil {
+		if len(list) == 0 {
+			utils.FailWithMsg(c, account.ErrNotFound.Error())
+			return
+		}
+		profile = &account.Profile{Id: form.Uid, Name: list[0].Uname}
+	}
+
+	data := map[string]interface{}{
+		"uid":  profile.Id,
+		"name": profile.Name,
+	}
+	if privacy.Face {
+		data["face"] = profile.Face
+	}
+	if privacy.School {
+		data["school"] = canonicalSchool(profile.School)
+	}
+	if privacy.Badges {
+		data["badges"] = profileBadges(ctx, profile)
+	}
+	if privacy.Rating {
+		stats, err := rating.Seller(ctx, form.Uid)
+		if err != nil {
+			misc.Logger.Error("public profile seller rating err", zap.Error(err))
+			utils.FailWithMsg(c, "获取主页失败")
+			return
+		}
+		data["rating"] = map[string]interface{}{
+			"reputation": stats.Reputation,
+			"average":    stats.Average,
+			"count":      stats.Count,
+		}
+	}
+	if privacy.Listings {
+		listings := activeListings(ctx, uid, list)
+		data["listingCount"] = len(listings)
+		data["listings"] = listings
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(form.Uid)),
+	)
+
+	utils.SuccessWithMsg(c, "get public profile success", data)
+}
+
+var errProfileBlocked = errors.New("无法查看该用户的主页")
+
+//profilePrivacy 被对方拉黑时返回errProfileBlocked,否则返回对方设置的可见字段,查看自己时全部可见
+func profilePrivacy(ctx context.Context, viewer, uid int32) (*account.Privacy, error) {
+	if viewer == uid {
+		return account.DefaultPrivacy(), nil
+	}
+	blocked, err := block.IsBlocked(ctx, uid, viewer)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, errProfileBlocked
+	}
+	return account.GetPrivacy(ctx, uid)
+}
+
+//GetPrivacy 获取自己的隐私设置
+func GetPrivacy(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	privacy, err := account.GetPrivacy(c.Request.Context(), uid)
+	if err != nil {
+		misc.Logger.Error("get privacy err", zap.Error(err))
+		utils.FailWithMsg(c, "获取隐私设置失败")
+		return
+	}
+
+	utils.SuccessWithMsg(c, "get privacy success", privacy)
+}
+
+//SetPrivacy 修改隐私设置
+func SetPrivacy(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form PrivacyForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle set privacy bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	privacy, err := account.GetPrivacy(ctx, uid)
+	if err != nil {
+		misc.Logger.Error("get privacy err", zap.Error(err))
+		utils.FailWithMsg(c, "修改隐私设置失败")
+		return
+	}
+	if form.Face != nil {
+		privacy.Face = *form.Face
+	}
+	if form.School != nil {
+		privacy.School = *form.School
+	}
+	if form.Badges != nil {
+		privacy.Badges = *form.Badges
+	}
+	if form.Listings != nil {
+		privacy.Listings = *form.Listings
+	}
+	if form.Rating != nil {
+		privacy.Rating = *form.Rating
+	}
+	if err = account.SetPrivacy(ctx, uid, privacy); err != nil {
+		misc.Logger.Error("set privacy err", zap.Error(err))
+		utils.FailWithMsg(c, "修改隐私设置失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+	)
+
+	utils.SuccessWithMsg(c, "set privacy success", privacy)
+}
+
+//profileBadges 用户的认证标识,查询失败的项按未认证处理
+func profileBadges(ctx context.Context, p *account.Profile) map[string]interface{} {
+	emailOk, err := account.IsVerified(ctx, p.Id, p.Email)
+	if err != nil {
+		misc.Logger.Error("get email verified err", zap.Error(err))
+	}
+	phoneOk := phoneVerified(ctx, &proto.User{Id: p.Id, Phone: p.Phone})
+	var school string
+	badge, err := campus.GetBadge(ctx, p.Id)
+	if err != nil {
+		misc.Logger.Error("get school badge err", zap.Error(err))
+	}
+	if badge != nil {
+		school = badge.School
+	}
+	return map[string]interface{}{
+		"email":  p.Email != "" && emailOk,
+		"phone":  phoneOk,
+		"school": school,
+	}
+}
+
+//activeListings 在售物品,不包含被下架和正在出租的物品
+func activeListings(ctx context.Context, viewer int32, list []*proto.GoodsDetail) []map[string]interface{} {
+	gids := make([]int32, 0, len(list))
+	for _, g := range list {
+		gids = append(gids, g.Gid)
+	}
+	hidden := hiddenGoods(ctx, gids)
+	unavailable, err := watch.Unavailable(ctx, gids)
+	if err != nil {
+		misc.Logger.Error("get unavailable goods err", zap.Error(err))
+		unavailable = map[int32]bool{}
+	}
+	ratings := goodsRatings(ctx, gids)
+	favorited, favoriteCounts := goodsFavorites(ctx, viewer, gids)
+
+	listings := make([]map[string]interface{}, 0, len(list))
+	for _, g := range list {
+		if hidden[g.Gid] || unavailable[g.Gid] {
+			continue
+		}
+		listings = append(listings, map[string]interface{}{
+			"id":            g.Gid,
+			"name":          g.Name,
+			"price":         g.Price,
+			"type":          g.Type,
+			"cover":         g.Cover,
+			"school":        canonicalSchool(g.School),
+			"create_time":   g.CreateTime,
+			"rating":        ratings[g.Gid].Average,
+			"ratingCount":   ratings[g.Gid].Count,
+			"favorited":     favorited[g.Gid],
+			"favoriteCount": favoriteCounts[g.Gid],
+		})
+	}
+	return listings
+}
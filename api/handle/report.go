@@ -0,0 +1,257 @@
+package handle
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/report"
+	"github.com/dopamine-joker/zu_web_server/sanction"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// 举报处理动作
+const (
+	reportDismiss       = "dismiss"
+	reportHideGoods     = "hide_goods"
+	reportDeleteComment = "delete_comment"
+	reportSuspendUser   = "suspend_user"
+)
+
+//AddReport 举报物品、评论或用户
+func AddReport(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form AddReportForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle add report bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	r := &report.Report{
+		Reporter:   uid,
+		TargetType: form.TargetType,
+		TargetId:   form.TargetId,
+		Reason:     form.Reason,
+	}
+	switch form.TargetType {
+	case report.TargetGoods:
+		code, goodsDetail, _, err := rpc.PicList(ctx, &proto.GetGoodsDetailRequest{Gid: form.TargetId})
+		if err != nil || code == misc.CodeFail {
+			misc.Logger.Error("report rpc goods detail err", zap.Error(err))
+			utils.FailWithMsg(c, "物品不存在")
+			return
+		}
+		r.TargetUid, r.Gid = goodsDetail.GetUid(), goodsDetail.GetGid()
+	case report.TargetComment:
+		goodsComment, err := findGoodsComment(ctx, form.GId, form.TargetId)
+		if err != nil {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		r.TargetUid, r.Gid = goodsComment.Uid, goodsComment.Gid
+	case report.TargetUser:
+		r.TargetUid = form.TargetId
+	}
+	if r.TargetUid == uid {
+		utils.FailWithMsg(c, "不能举报自己")
+		return
+	}
+
+	if err = report.Create(ctx, r); err != nil {
+		misc.Logger.Error("create report err", zap.Error(err))
+		if errors.Is(err, report.ErrDuplicate) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		utils.FailWithMsg(c, "举报失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("reportId", r.Id),
+		attribute.String("targetType", r.TargetType),
+		attribute.Int64("targetId", int64(r.TargetId)),
+	)
+
+	data := map[string]interface{}{
+		"id": r.Id,
+	}
+
+	utils.SuccessWithMsg(c, "add report success", data)
+}
+
+//ListReports 管理员查看待处理举报
+func ListReports(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ListReportForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle list report bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	list, err := report.Pending(c.Request.Context(), *form.Page, *form.Count)
+	if err != nil {
+		misc.Logger.Error("list pending report err", zap.Error(err))
+		utils.FailWithMsg(c, "获取举报失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"len":  len(list),
+		"data": list,
+	}
+
+	utils.SuccessWithMsg(c, "list reports success", data)
+}
+
+//ResolveReport 管理员处理举报,处理结果在之后的请求中生效
+func ResolveReport(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form ResolveReportForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle resolve report bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	// 封禁必须明确给出天数或选择永久封禁,避免漏填天数变成永久封禁
+	if form.Action == reportSuspendUser && (form.Days > 0) == form.Permanent {
+		utils.FailWithMsg(c, "请填写封禁天数或选择永久封禁")
+		return
+	}
+
+	ctx := c.Request.Context()
+	r, err := report.Get(ctx, form.Id)
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+	if r.Status != report.StatusPending {
+		utils.FailWithMsg(c, report.ErrResolved.Error())
+		return
+	}
+
+	switch form.Action {
+	case reportHideGoods:
+		if r.TargetType != report.TargetGoods {
+			utils.FailWithMsg(c, "只能下架被举报的物品")
+			return
+		}
+		err = sanction.HideGoods(ctx, r.TargetId)
+	case reportDeleteComment:
+		if r.TargetType != report.TargetComment {
+			utils.FailWithMsg(c, "只能删除被举报的评论")
+			return
+		}
+		err = removeComment(ctx, r.TargetUid, r.TargetId)
+	case reportSuspendUser:
+		// 过期时间为0表示永久封禁
+		err = sanction.SuspendUser(ctx, r.TargetUid, r.Reason, time.Duration(form.Days)*24*time.Hour)
+	}
+	if err != nil {
+		misc.Logger.Error("resolve report action err", zap.Error(err), zap.String("action", form.Action))
+		utils.FailWithMsg(c, "处理失败")
+		return
+	}
+
+	r.Action = form.Action
+	r.Handler = uid
+	r.Remark = form.Remark
+	if err = report.Resolve(ctx, r); err != nil {
+		misc.Logger.Error("resolve report err", zap.Error(err))
+		utils.FailWithMsg(c, "处理失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("adminId", int64(uid)),
+		attribute.Int64("reportId", r.Id),
+		attribute.String("action", r.Action),
+	)
+
+	utils.SuccessWithMsg(c, "resolve report success", r)
+}
+
+//UnsuspendUser 管理员解除用户封禁
+func UnsuspendUser(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form SuspendUserForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle unsuspend user bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	if err = sanction.UnsuspendUser(c.Request.Context(), form.Uid); err != nil {
+		misc.Logger.Error("unsuspend user err", zap.Error(err))
+		utils.FailWithMsg(c, "处理失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(form.Uid)),
+	)
+
+	utils.SuccessWithMsg(c, "unsuspend user success", nil)
+}
+
+//UnhideGoods 管理员恢复被下架的物品
+func UnhideGoods(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form HideGoodsForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle unhide goods bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	if err = sanction.UnhideGoods(c.Request.Context(), form.Gid); err != nil {
+		misc.Logger.Error("unhide goods err", zap.Error(err))
+		utils.FailWithMsg(c, "处理失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("goodsId", int64(form.Gid)),
+	)
+
+	utils.SuccessWithMsg(c, "unhide goods success", nil)
+}
@@ -0,0 +1,100 @@
+package handle
+
+import (
+	"strings"
+
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/school"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+//SearchSchools 学校名称联想,匹配名称和别名,不需要登录
+func SearchSchools(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form SearchSchoolForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle search school bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	list := school.Default.Search(form.Keyword, form.Count)
+
+	span.SetAttributes(
+		attribute.String("keyword", form.Keyword),
+		attribute.Int("len", len(list)),
+	)
+
+	data := map[string]interface{}{
+		"len":  len(list),
+		"data": list,
+	}
+
+	utils.SuccessWithMsg(c, "search school success", data)
+}
+
+//GetSchool 根据id或名称、别名查询学校
+func GetSchool(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form GetSchoolForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle get school bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	var s *school.School
+	if form.Id != 0 {
+		s, err = school.Default.Get(form.Id)
+	} else {
+		s, err = school.Default.Lookup(form.Name)
+	}
+	if err != nil {
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("schoolId", int64(s.Id)),
+	)
+
+	utils.SuccessWithMsg(c, "get school success", s)
+}
+
+//normalizeSchool 把学校名称或别名规范为名录中的名称
+func normalizeSchool(name string) (string, error) {
+	s, err := school.Default.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return s.Name, nil
+}
+
+//canonicalSchool 已收录的学校返回标准名称,迁移前的旧名称不在名录中时保留原值
+func canonicalSchool(name string) string {
+	if s, err := school.Default.Lookup(name); err == nil {
+		return s.Name
+	}
+	return name
+}
+
+//normalizeUserSchool 修改资料时规范学校名称,未修改的旧数据即使不在名录中也保留,避免无法修改其他资料
+func normalizeUserSchool(name, current string) (string, error) {
+	if strings.TrimSpace(name) == strings.TrimSpace(current) {
+		if s, err := school.Default.Lookup(name); err == nil {
+			return s.Name, nil
+		}
+		return current, nil
+	}
+	return normalizeSchool(name)
+}
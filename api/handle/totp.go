@@ -0,0 +1,307 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/totp"
+	"github.com/dopamine-joker/zu_web_server/utils"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	totpSweepInterval = time.Minute
+	totpSweepBatch    = 100
+)
+
+//EnrollTotp 生成两步验证密钥,返回验证器App扫码使用的地址
+func EnrollTotp(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	user, err := utils.GetContextUser(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	secret, err := totp.Enroll(c.Request.Context(), user.GetId())
+	if err != nil {
+		utils.FailWithMsg(c, totpErrMsg(err, "获取密钥失败"))
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(user.GetId())),
+	)
+
+	data := map[string]interface{}{
+		"secret": secret,
+		"uri":    totp.URI(misc.Conf.Totp.Issuer, user.GetEmail(), secret),
+	}
+
+	utils.SuccessWithMsg(c, "enroll totp success", data)
+}
+
+//ConfirmTotp 输入验证器App上的验证码开启两步验证,恢复码只在这里返回一次
+func ConfirmTotp(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form TotpCodeForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle confirm totp bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	codes, err := totp.Confirm(c.Request.Context(), uid, form.Code)
+	if err != nil {
+		utils.FailWithMsg(c, totpErrMsg(err, "开启失败"))
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+	)
+
+	data := map[string]interface{}{
+		"recoveryCodes": codes,
+	}
+
+	utils.SuccessWithMsg(c, "confirm totp success", data)
+}
+
+//DisableTotp 校验验证码后关闭两步验证
+func DisableTotp(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form TotpCodeForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle disable totp bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err = totp.Check(ctx, uid, form.Code); err != nil {
+		utils.FailWithMsg(c, totpErrMsg(err, "关闭失败"))
+		return
+	}
+	if err = totp.Disable(ctx, uid); err != nil {
+		misc.Logger.Error("disable totp err", zap.Error(err))
+		utils.FailWithMsg(c, "关闭失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+	)
+
+	utils.SuccessWithMsg(c, "disable totp success", nil)
+}
+
+//RegenerateRecoveryCodes 校验验证码后重新生成恢复码
+func RegenerateRecoveryCodes(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form TotpCodeForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle regenerate recovery codes bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err = totp.Check(ctx, uid, form.Code); err != nil {
+		utils.FailWithMsg(c, totpErrMsg(err, "生成失败"))
+		return
+	}
+	codes, err := totp.RegenerateRecovery(ctx, uid)
+	if err != nil {
+		misc.Logger.Error("regenerate recovery codes err", zap.Error(err))
+		utils.FailWithMsg(c, "生成失败")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(uid)),
+	)
+
+	data := map[string]interface{}{
+		"recoveryCodes": codes,
+	}
+
+	utils.SuccessWithMsg(c, "regenerate recovery codes success", data)
+}
+
+//GetTotpStatus 两步验证是否开启以及剩余恢复码数量
+func GetTotpStatus(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	enabled, err := totp.Enabled(ctx, uid)
+	if err != nil {
+		misc.Logger.Error("get totp enabled err", zap.Error(err))
+		utils.FailWithMsg(c, "获取失败")
+		return
+	}
+	left, err := totp.RecoveryLeft(ctx, uid)
+	if err != nil {
+		misc.Logger.Error("get recovery codes left err", zap.Error(err))
+		utils.FailWithMsg(c, "获取失败")
+		return
+	}
+
+	data := map[string]interface{}{
+		"enabled":      enabled,
+		"recoveryLeft": left,
+	}
+
+	utils.SuccessWithMsg(c, "get totp status success", data)
+}
+
+//TotpLogin 使用登录返回的challenge和验证码换取token
+func TotpLogin(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form TotpLoginForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle totp login bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	ctx := c.Request.Context()
+	ch, err := totp.Exchange(ctx, form.Challenge, form.Code)
+	if err != nil {
+		if ch != nil && ch.Token != "" &&
+			(errors.Is(err, totp.ErrTooMany) || errors.Is(err, totp.ErrLocked) || errors.Is(err, totp.ErrBadChallenge)) {
+			revokeToken(ctx, ch.Token)
+		}
+		utils.FailWithMsg(c, totpErrMsg(err, "登录失败"))
+		return
+	}
+
+	code, _, user, err := rpc.CheckAuth(ctx, &proto.CheckAuthRequest{AuthToken: ch.Token})
+	if code == misc.CodeFail || err != nil {
+		misc.Logger.Error("totp login rpc check auth err", zap.Error(err))
+		utils.FailWithMsg(c, "登录已过期,请重新登录")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("userId", int64(ch.Uid)),
+	)
+
+	dataMap := map[string]interface{}{
+		"token":         ch.Token,
+		"user":          user,
+		"emailVerified": emailVerified(ctx, user),
+		"phoneVerified": phoneVerified(ctx, user),
+	}
+
+	utils.SuccessWithMsg(c, "totp login success", dataMap)
+}
+
+//challengeTotp 开启两步验证的用户不直接下发token,改为返回challenge,已响应时返回true
+func challengeTotp(c *gin.Context, token string, user *proto.User) bool {
+	ctx := c.Request.Context()
+	enabled, err := totp.Enabled(ctx, user.GetId())
+	if err == nil && !enabled {
+		return false
+	}
+	if err != nil {
+		misc.Logger.Error("get totp enabled err", zap.Error(err))
+		revokeToken(ctx, token)
+		utils.FailWithMsg(c, "登录失败")
+		return true
+	}
+	challenge, err := totp.NewChallenge(ctx, user.GetId(), token)
+	if err != nil {
+		misc.Logger.Error("new totp challenge err", zap.Error(err))
+		revokeToken(ctx, token)
+		utils.FailWithMsg(c, "登录失败")
+		return true
+	}
+	data := map[string]interface{}{
+		"challenge": challenge,
+		"expire":    misc.Conf.Totp.ChallengeExpire,
+	}
+	utils.ResponseWithCode(c, misc.CodeTotpRequired, "请输入两步验证码", data)
+	return true
+}
+
+//RunTotpSweep 定期吊销过期未兑换的challenge中的token,ctx结束后退出
+func RunTotpSweep(ctx context.Context) {
+	ticker := time.NewTicker(totpSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			list, err := totp.TakeExpired(ctx, time.Now(), totpSweepBatch)
+			if err != nil {
+				misc.Logger.Error("take expired totp challenges err", zap.Error(err))
+			}
+			for _, ch := range list {
+				revokeToken(ctx, ch.Token)
+			}
+		}
+	}
+}
+
+func totpErrMsg(err error, fallback string) string {
+	if errors.Is(err, totp.ErrEnabled) || errors.Is(err, totp.ErrNotEnabled) || errors.Is(err, totp.ErrNoEnroll) ||
+		errors.Is(err, totp.ErrWrongCode) || errors.Is(err, totp.ErrBadChallenge) || errors.Is(err, totp.ErrTooMany) ||
+		errors.Is(err, totp.ErrLocked) {
+		return err.Error()
+	}
+	misc.Logger.Error("totp err", zap.Error(err))
+	return fallback
+}
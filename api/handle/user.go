@@ -1,15 +1,18 @@
 package handle
 
 import (
+	"errors"
+
+	"github.com/dopamine-joker/zu_web_server/account"
 	"github.com/dopamine-joker/zu_web_server/api/rpc"
 	"github.com/dopamine-joker/zu_web_server/misc"
 	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/rating"
 	"github.com/dopamine-joker/zu_web_server/utils"
 	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
-	"log"
 )
 
 func Login(c *gin.Context) {
@@ -25,7 +28,6 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	log.Println("login: email:", loginForm.Email, "pwd:", loginForm.Password)
 	misc.Logger.Info("web_server login", zap.String("email", loginForm.Email))
 	req := &proto.LoginRequest{
 		Email:    loginForm.Email,
@@ -37,6 +39,13 @@ func Login(c *gin.Context) {
 		utils.FailWithMsg(c, utils.GetRpcMsg(err.Error()))
 		return
 	}
+	// 开启两步验证后以动态验证码代替短信验证
+	if challengeTotp(c, token, user) {
+		return
+	}
+	if !checkLoginSms(c, token, user, loginForm.SmsCode) {
+		return
+	}
 	misc.Logger.Info("login success", zap.String("email", loginForm.Email), zap.String("token", token))
 	span.SetAttributes(
 		attribute.String("email", req.Email),
@@ -44,9 +53,12 @@ func Login(c *gin.Context) {
 		attribute.Int64("code", int64(code)),
 	)
 
+	user.School = canonicalSchool(user.GetSchool())
 	dataMap := map[string]interface{}{
-		"token": token,
-		"user":  user,
+		"token":         token,
+		"user":          user,
+		"emailVerified": emailVerified(c.Request.Context(), user),
+		"phoneVerified": phoneVerified(c.Request.Context(), user),
 	}
 	utils.SuccessWithMsg(c, "login success", dataMap)
 }
@@ -64,7 +76,6 @@ func TokenLogin(c *gin.Context) {
 		return
 	}
 
-	log.Println("token login: token:", tokenLoginForm.Token)
 	misc.Logger.Info("web_server tokenLogin", zap.String("token", tokenLoginForm.Token))
 
 	req := &proto.TokenLoginRequest{
@@ -85,64 +96,17 @@ func TokenLogin(c *gin.Context) {
 
 	misc.Logger.Info("tokenLogin success", zap.String("token", token))
 
+	user.School = canonicalSchool(user.GetSchool())
 	dataMap := map[string]interface{}{
-		"token": token,
-		"user":  user,
+		"token":         token,
+		"user":          user,
+		"emailVerified": emailVerified(c.Request.Context(), user),
+		"phoneVerified": phoneVerified(c.Request.Context(), user),
 	}
 
 	utils.SuccessWithMsg(c, "token login success", dataMap)
 }
 
-func UpdateUser(c *gin.Context) {
-	span := trace.SpanFromContext(c.Request.Context())
-
-	defer span.End()
-	var form UpdateUserForm
-	var err error
-	if err = c.ShouldBindJSON(&form); err != nil {
-		misc.Logger.Error("update user bind json err", zap.String("err", err.Error()))
-		utils.FailWithMsg(c, err.Error())
-		return
-	}
-
-	uid, err := utils.GetContextUserId(c)
-	if err != nil {
-		misc.Logger.Error("请求Token参数错误")
-		utils.FailWithMsg(c, err.Error())
-		return
-	}
-
-	req := &proto.UpdateUserRequest{
-		Uid:      uid,
-		Email:    form.Email,
-		Name:     form.Name,
-		Phone:    form.Phone,
-		Password: form.Password,
-		School:   form.School,
-		Sex:      form.Sex,
-	}
-
-	code, err := rpc.UpdateUser(c.Request.Context(), req)
-	if err != nil || code == misc.CodeFail {
-		misc.Logger.Error("rpc update user err", zap.Error(err))
-		utils.FailWithMsg(c, utils.GetRpcMsg(err.Error()))
-		return
-	}
-
-	span.SetAttributes(
-		attribute.Int64("id", int64(req.GetUid())),
-		attribute.String("email", req.GetEmail()),
-		attribute.String("phone", req.GetPhone()),
-		attribute.String("name", req.GetName()),
-		attribute.String("password", req.GetPassword()),
-		attribute.String("school", req.GetSchool()),
-		attribute.Int64("sex", int64(req.GetSex())),
-		attribute.Int64("code", int64(code)),
-	)
-
-	utils.SuccessWithMsg(c, "update user success", nil)
-}
-
 func Register(c *gin.Context) {
 	span := trace.SpanFromContext(c.Request.Context())
 
@@ -154,8 +118,7 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	misc.Logger.Info("web_server register", zap.String("email", registerForm.Email),
-		zap.String("pwd", registerForm.Password))
+	misc.Logger.Info("web_server register", zap.String("email", registerForm.Email))
 
 	req := &proto.RegisterRequest{
 		Email:    registerForm.Email,
@@ -165,7 +128,6 @@ func Register(c *gin.Context) {
 
 	span.SetAttributes(attribute.String("email", req.Email),
 		attribute.String("name", req.Name),
-		attribute.String("password", req.Password),
 	)
 
 	code, err := rpc.Register(c.Request.Context(), req)
@@ -175,8 +137,9 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	misc.Logger.Info("register success", zap.String("email", registerForm.Email),
-		zap.String("password", registerForm.Password))
+	misc.Logger.Info("register success", zap.String("email", registerForm.Email))
+
+	onRegistered(c.Request.Context(), registerForm.Email, registerForm.Password)
 
 	utils.SuccessWithMsg(c, "register success", nil)
 }
@@ -192,7 +155,6 @@ func Logout(c *gin.Context) {
 		return
 	}
 
-	log.Println("logout, token:", logoutForm.Token)
 	misc.Logger.Info("web_server logout", zap.String("token", logoutForm.Token))
 
 	req := &proto.LogoutRequest{
@@ -331,6 +293,9 @@ func UpdateFace(c *gin.Context) {
 	)
 
 	misc.Logger.Info("upload face success")
+	if err = account.SetFace(c.Request.Context(), uid, path); err != nil {
+		misc.Logger.Error("save account face err", zap.Error(err))
+	}
 
 	res := map[string]interface{}{
 		"path": path,
@@ -338,3 +303,77 @@ func UpdateFace(c *gin.Context) {
 
 	utils.SuccessWithMsg(c, "upload pic success", res)
 }
+
+//GetSellerProfile 卖家信誉及在售物品数,与公开主页一样受拉黑和隐私设置限制
+func GetSellerProfile(c *gin.Context) {
+	span := trace.SpanFromContext(c.Request.Context())
+	defer span.End()
+
+	var form SellerProfileForm
+	var err error
+	if err = c.ShouldBindJSON(&form); err != nil {
+		misc.Logger.Error("handle seller profile bind json err", zap.String("err", err.Error()))
+		utils.FailWithMsg(c, "参数错误")
+		return
+	}
+
+	uid, err := utils.GetContextUserId(c)
+	if err != nil {
+		misc.Logger.Error("请求Token参数错误")
+		utils.FailWithMsg(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	privacy, err := profilePrivacy(ctx, uid, form.Uid)
+	if err != nil {
+		if errors.Is(err, errProfileBlocked) {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		misc.Logger.Error("seller profile get privacy err", zap.Error(err))
+		utils.FailWithMsg(c, "获取卖家信息失败")
+		return
+	}
+
+	code, list, err := rpc.GetUserGoods(ctx, &proto.GetUserGoodsListRequest{Uid: form.Uid})
+	if err != nil || code == misc.CodeFail {
+		misc.Logger.Error("rpc seller goods err", zap.Error(err))
+		utils.FailWithMsg(c, "获取卖家信息失败")
+		return
+	}
+
+	var name string
+	if len(list) > 0 {
+		name = list[0].Uname
+	}
+	if profile, err := account.GetProfile(ctx, form.Uid); err == nil {
+		name = profile.Name
+	}
+
+	span.SetAttributes(
+		attribute.Int64("sellerId", int64(form.Uid)),
+		attribute.Int64("code", int64(code)),
+	)
+
+	dataMap := map[string]interface{}{
+		"uid":  form.Uid,
+		"name": name,
+	}
+	if privacy.Rating {
+		stats, err := rating.Seller(ctx, form.Uid)
+		if err != nil {
+			misc.Logger.Error("get seller rating err", zap.Error(err))
+			utils.FailWithMsg(c, "获取卖家信息失败")
+			return
+		}
+		dataMap["reputation"] = stats.Reputation
+		dataMap["average"] = stats.Average
+		dataMap["ratingCount"] = stats.Count
+	}
+	if privacy.Listings {
+		dataMap["goodsCount"] = len(activeListings(ctx, uid, list))
+	}
+
+	utils.SuccessWithMsg(c, "get seller profile success", dataMap)
+}
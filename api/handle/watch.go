@@ -0,0 +1,143 @@
+package handle
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/notify"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/watch"
+	"go.uber.org/zap"
+)
+
+// 检查收藏物品价格的间隔
+const priceWatchInterval = 5 * time.Minute
+
+//RunPriceWatch 定期检查有订阅用户的物品价格,ctx结束后退出。
+//logic服务没有修改物品的接口,价格只会在logic服务中被修改,只能定期对比
+func RunPriceWatch(ctx context.Context) {
+	ticker := time.NewTicker(priceWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkWatchedPrices(ctx)
+		}
+	}
+}
+
+func checkWatchedPrices(ctx context.Context) {
+	gids, err := watch.Watched(ctx)
+	if err != nil {
+		misc.Logger.Error("get watched goods err", zap.Error(err))
+		return
+	}
+	prices := make(map[int32]string, len(gids))
+	names := make(map[int32]string, len(gids))
+	for _, gid := range gids {
+		forgotten, err := watch.Forget(ctx, gid)
+		if err != nil {
+			misc.Logger.Error("forget watched goods err", zap.Error(err), zap.Int32("gid", gid))
+		}
+		if forgotten {
+			continue
+		}
+		code, detail, _, err := rpc.PicList(ctx, &proto.GetGoodsDetailRequest{Gid: gid})
+		if err != nil || code == misc.CodeFail {
+			continue
+		}
+		prices[gid] = detail.Price
+		names[gid] = detail.Name
+	}
+	observeGoodsPrices(ctx, prices, names)
+}
+
+//observeGoodsPrices 对比物品价格与上次记录,变化时提醒收藏了该物品的用户
+func observeGoodsPrices(ctx context.Context, prices, names map[int32]string) {
+	changes, err := watch.ObservePrices(ctx, prices)
+	if err != nil {
+		misc.Logger.Error("observe goods prices err", zap.Error(err))
+		return
+	}
+	for _, change := range changes {
+		n := &notify.Notification{
+			Type:    notify.TypePriceChange,
+			Title:   "收藏的物品价格变动",
+			Content: fmt.Sprintf("%s 的价格由 %s 调整为 %s", names[change.Gid], change.Old, change.New),
+			Data: map[string]interface{}{
+				"gid":      change.Gid,
+				"oldPrice": change.Old,
+				"newPrice": change.New,
+			},
+		}
+		oldPrice, err1 := strconv.ParseFloat(change.Old, 64)
+		newPrice, err2 := strconv.ParseFloat(change.New, 64)
+		if err1 == nil && err2 == nil && newPrice < oldPrice {
+			n.Type = notify.TypePriceDrop
+			n.Title = "收藏的物品降价了"
+		}
+		notifyWatchers(ctx, change.Gid, 0, n)
+	}
+}
+
+//changeAvailability 物品可租状态变化时提醒收藏了该物品的用户,exclude为不需要提醒的用户
+func changeAvailability(ctx context.Context, gid int32, name string, ok bool, exclude int32) {
+	changed, err := watch.SetAvailable(ctx, gid, ok)
+	if err != nil {
+		misc.Logger.Error("set goods available err", zap.Error(err), zap.Int32("gid", gid))
+		return
+	}
+	if !changed {
+		return
+	}
+	if name == "" {
+		name = "收藏的物品"
+	}
+	n := &notify.Notification{
+		Type:    notify.TypeAvailable,
+		Title:   "收藏的物品可以租借了",
+		Content: fmt.Sprintf("%s 现在可以租借", name),
+		Data: map[string]interface{}{
+			"gid": gid,
+		},
+	}
+	if !ok {
+		n.Type = notify.TypeUnavailable
+		n.Title = "收藏的物品暂时无法租借"
+		n.Content = fmt.Sprintf("%s 已被租借或下架", name)
+	}
+	notifyWatchers(ctx, gid, exclude, n)
+}
+
+//orderAvailability 订单状态对应的物品可租状态,返回false表示该状态不影响物品
+func orderAvailability(status int32) (available bool, ok bool) {
+	switch status {
+	case misc.OrderStatusAccepted, misc.OrderStatusPaid:
+		return false, true
+	case misc.OrderStatusFinished, misc.OrderStatusCanceled, misc.OrderStatusRefunded:
+		return true, true
+	}
+	return false, false
+}
+
+func notifyWatchers(ctx context.Context, gid, exclude int32, tmpl *notify.Notification) {
+	uids, err := watch.Subscribers(ctx, gid)
+	if err != nil {
+		misc.Logger.Error("get goods subscribers err", zap.Error(err), zap.Int32("gid", gid))
+		return
+	}
+	for _, uid := range uids {
+		if uid == exclude {
+			continue
+		}
+		n := *tmpl
+		n.Uid = uid
+		sendNotification(ctx, &n)
+	}
+}
@@ -1,34 +1,76 @@
 package router
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
+	"github.com/dopamine-joker/zu_web_server/account"
 	"github.com/dopamine-joker/zu_web_server/api/rpc"
 	"github.com/dopamine-joker/zu_web_server/db"
 	"github.com/dopamine-joker/zu_web_server/misc"
 	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/rbac"
+	"github.com/dopamine-joker/zu_web_server/sanction"
 	"github.com/dopamine-joker/zu_web_server/utils"
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 )
 
 const (
 	TokenKey   = "X-TOKEN"
 	UserInfo   = "X-USER"
 	UserId     = "X-UID"
+	UserRole   = "X-ROLE"
 	CountLimit = 20
+
+	IdempotencyKey      = "Idempotency-Key"
+	IdempotencyReplayed = "Idempotency-Replayed"
+	idemKeyMaxLen       = 128
+	auditBodyMaxLen     = 4096
 )
 
 var (
-	noVerifyRoute = []string{"/user/login", "/user/register", "/user/tokenLogin", "/user/getSig", "/goods/search", "/metrics"}
+	// EventSource和WebSocket无法设置请求头,这些路由允许通过query参数token传递
+	queryTokenRoute = []string{"/notify/stream", "/ws"}
+	noVerifyRoute   = []string{"/user/login", "/user/register", "/user/tokenLogin", "/user/getSig", "/goods/search", "/metrics", "/payment/callback",
+		"/user/verifyEmail", "/user/forgotPassword", "/user/resetPassword", "/user/login/2fa", "/user/confirmEmail", "/categories",
+		"/school/search", "/school/get"}
 )
 
+//AccessLogMiddleware 访问日志只记录路径,不记录query参数,避免SSE和WebSocket的token写入日志
+func AccessLogMiddleware() gin.HandlerFunc {
+	return accessLogger(gin.DefaultWriter)
+}
+
+func accessLogger(out io.Writer) gin.HandlerFunc {
+	return gin.LoggerWithConfig(gin.LoggerConfig{
+		Output: out,
+		Formatter: func(param gin.LogFormatterParams) string {
+			return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+				param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+				param.StatusCode,
+				param.Latency,
+				param.ClientIP,
+				param.Method,
+				param.Request.URL.Path,
+				param.ErrorMessage,
+			)
+		},
+	})
+}
+
 func CorsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
-		c.Header("Access-Control-Allow-Methods", "GET, OPTIONS, POST, PUT, DELETE")
+		c.Header("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Idempotency-Key")
+		c.Header("Access-Control-Allow-Methods", "GET, OPTIONS, POST, PUT, PATCH, DELETE")
 		c.Set("content-type", "application/json")
 		method := c.Request.Method
 		// options 用于获取url所支持的方法，"GET,POST..."
@@ -49,6 +91,9 @@ func UserAuthMiddleware() gin.HandlerFunc {
 		}
 		// 获取header的token
 		token := c.GetHeader(TokenKey)
+		if token == "" && utils.IsContain(queryTokenRoute, c.Request.URL.Path) {
+			token = c.Query("token")
+		}
 		if token == "" {
 			c.Abort()
 			utils.ResponseWithCode(c, misc.CodeTokenError, nil, nil)
@@ -62,8 +107,42 @@ func UserAuthMiddleware() gin.HandlerFunc {
 			utils.ResponseWithCode(c, misc.CodeTokenError, nil, nil)
 			return
 		}
+		// 被封禁的用户不能继续访问
+		suspended, err := sanction.IsSuspended(c.Request.Context(), user.GetId())
+		if err != nil {
+			c.Abort()
+			utils.ResponseWithCode(c, misc.CodeFail, "内部数据库错误", nil)
+			return
+		}
+		if suspended {
+			c.Abort()
+			utils.ResponseWithCode(c, misc.CodeSuspended, "账号已被封禁", nil)
+			return
+		}
+		deleted, err := account.IsDeleted(c.Request.Context(), user.GetId())
+		if err != nil {
+			c.Abort()
+			utils.ResponseWithCode(c, misc.CodeFail, "内部数据库错误", nil)
+			return
+		}
+		if deleted {
+			c.Abort()
+			utils.ResponseWithCode(c, misc.CodeTokenError, "账号已注销", nil)
+			return
+		}
+		// 快照上线前登录的用户在这里补充资料快照,资料有变化时同步更新
+		if err = account.RefreshUser(c.Request.Context(), user); err != nil {
+			misc.Logger.Error("refresh account snapshot err", zap.Error(err), zap.Int32("uid", user.GetId()))
+		}
+		role, err := rbac.GetRole(c.Request.Context(), user.GetId())
+		if err != nil {
+			c.Abort()
+			utils.ResponseWithCode(c, misc.CodeFail, "内部数据库错误", nil)
+			return
+		}
 		c.Set(UserInfo, user)
 		c.Set(UserId, user.GetId())
+		c.Set(UserRole, role)
 		// redis增加计数
 		redisKey := fmt.Sprintf("%s-%s", token, uri)
 
@@ -91,3 +170,186 @@ func UserAuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+//RequirePermission 要求当前用户的角色拥有perm权限
+func RequirePermission(perm rbac.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !utils.HasPermission(c, perm) {
+			utils.ResponseWithCode(c, misc.CodeNoPermission, "无权限", nil)
+			return
+		}
+		c.Next()
+	}
+}
+
+//AuditMiddleware 记录管理接口的每一次调用
+func AuditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if len(body) > auditBodyMaxLen {
+			body = body[:auditBodyMaxLen]
+		}
+
+		w := &bodyWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = w
+		c.Next()
+
+		code, ok := responseCode(w.body.Bytes())
+		if !ok {
+			code = misc.CodeUnknownError
+		}
+		uid, _ := utils.GetContextUserId(c)
+		log := &rbac.AuditLog{
+			Uid:    uid,
+			Role:   utils.GetContextRole(c),
+			Method: c.Request.Method,
+			Route:  c.FullPath(),
+			Body:   string(body),
+			Status: w.Status(),
+			Code:   code,
+			Ip:     c.ClientIP(),
+			Time:   time.Now().Unix(),
+		}
+		misc.Logger.Info("admin audit", zap.Int32("uid", log.Uid), zap.String("role", string(log.Role)),
+			zap.String("route", log.Route), zap.String("body", log.Body), zap.Int("status", log.Status), zap.Int("code", log.Code))
+		if err := rbac.Audit(context.Background(), log); err != nil {
+			misc.Logger.Error("save audit log err", zap.Error(err))
+		}
+	}
+}
+
+//bodyWriter 记录handler写出的响应,用于幂等重放和操作日志
+type bodyWriter struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *bodyWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+//IdempotencyMiddleware 对携带Idempotency-Key的写请求保存首次成功的响应,重复请求直接重放;
+//失败的响应不保存,客户端可以用同一个键重试
+func IdempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKey)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > idemKeyMaxLen {
+			utils.FailWithMsg(c, "Idempotency-Key过长")
+			return
+		}
+		uid, err := utils.GetContextUserId(c)
+		if err != nil {
+			utils.FailWithMsg(c, err.Error())
+			return
+		}
+		route := c.FullPath()
+		ctx := c.Request.Context()
+		expire := time.Duration(misc.Conf.IdemCfg.Expire) * time.Second
+		lockExpire := time.Duration(misc.Conf.IdemCfg.LockExpire) * time.Second
+
+		bodyHash, err := hashBody(c)
+		if err != nil {
+			misc.Logger.Error("read idempotency request body err", zap.Error(err))
+			utils.FailWithMsg(c, "请求出错")
+			return
+		}
+
+		ok, saved, err := db.AcquireIdem(ctx, uid, route, key, bodyHash, lockExpire)
+		if err != nil {
+			misc.Logger.Error("acquire idempotency key err", zap.Error(err))
+			utils.ResponseWithCode(c, misc.CodeFail, "内部数据库错误", nil)
+			return
+		}
+		if !ok {
+			if saved.BodyHash != bodyHash {
+				utils.ResponseWithStatus(c, http.StatusUnprocessableEntity, misc.CodeConflict, "Idempotency-Key已用于其他请求", nil)
+				return
+			}
+			if saved.IsPending() {
+				utils.ResponseWithStatus(c, http.StatusConflict, misc.CodeConflict, "相同请求正在处理中", nil)
+				return
+			}
+			c.Header(IdempotencyReplayed, "true")
+			c.Data(saved.Status, saved.ContentType, saved.Body)
+			c.Abort()
+			return
+		}
+
+		w := &bodyWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = w
+		stored := false
+		defer func() {
+			// 请求失败、handler panic或保存失败时释放,避免客户端一直收到409或重放错误
+			if !stored {
+				if err := db.ReleaseIdem(context.Background(), uid, route, key); err != nil {
+					misc.Logger.Error("release idempotency key err", zap.Error(err))
+				}
+			}
+		}()
+
+		c.Next()
+
+		if !succeeded(w.Status(), w.body.Bytes()) {
+			return
+		}
+		res := &db.IdemResponse{
+			BodyHash:    bodyHash,
+			Status:      w.Status(),
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.Bytes(),
+		}
+		if err = db.SaveIdem(context.Background(), uid, route, key, res, expire); err != nil {
+			misc.Logger.Error("save idempotency response err", zap.Error(err))
+			return
+		}
+		stored = true
+	}
+}
+
+//hashBody 计算请求体摘要,读取后重新放回请求
+func hashBody(c *gin.Context) (string, error) {
+	if c.Request.Body == nil {
+		return "", nil
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return "", err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//succeeded 业务错误也以200返回,需要根据响应中的code判断
+func succeeded(status int, body []byte) bool {
+	if status != http.StatusOK {
+		return false
+	}
+	code, ok := responseCode(body)
+	return ok && code == misc.CodeSuccess
+}
+
+//responseCode 解析响应中的业务码
+func responseCode(body []byte) (int, bool) {
+	var res struct {
+		Code *int `json:"code"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || res.Code == nil {
+		return 0, false
+	}
+	return *res.Code, true
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dopamine-joker/zu_web_server/api/handle"
+	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	canaryPassword = "redact-canary-password"
+	canaryToken    = "redact-canary-token"
+	canaryEmail    = "redact-canary@example.com"
+)
+
+//fakeLogic 只实现登录相关调用,其余调用会panic
+type fakeLogic struct {
+	proto.RpcLogicServiceClient
+}
+
+func (f *fakeLogic) Login(ctx context.Context, in *proto.LoginRequest, opts ...grpc.CallOption) (*proto.LoginResponse, error) {
+	return nil, status.Error(codes.Unauthenticated, "密码错误")
+}
+
+func (f *fakeLogic) TokenLogin(ctx context.Context, in *proto.TokenLoginRequest, opts ...grpc.CallOption) (*proto.TokenLoginResponse, error) {
+	return nil, status.Error(codes.Unauthenticated, "token已过期")
+}
+
+func (f *fakeLogic) Logout(ctx context.Context, in *proto.LogoutRequest, opts ...grpc.CallOption) (*proto.LogoutResponse, error) {
+	return &proto.LogoutResponse{Code: misc.CodeSuccess}, nil
+}
+
+//TestHandlersRedactSecrets 调用真实的handler,检查应用日志和访问日志中不出现密码、token和完整邮箱
+func TestHandlersRedactSecrets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	logs := &bytes.Buffer{}
+	misc.Redact = misc.NewRedactor(nil)
+	misc.Logger = misc.NewLogger(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(logs), zap.DebugLevel))
+	oldClient := rpc.LogicRpcClient
+	rpc.LogicRpcClient = &fakeLogic{}
+	defer func() { rpc.LogicRpcClient = oldClient }()
+
+	access := &bytes.Buffer{}
+	r := gin.New()
+	r.Use(accessLogger(access), gin.Recovery())
+	r.POST("/user/login", handle.Login)
+	r.POST("/user/tokenLogin", handle.TokenLogin)
+	r.POST("/user/logout", handle.Logout)
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/user/login", strings.NewReader(`{"email":"`+canaryEmail+`","password":"`+canaryPassword+`"}`)),
+		httptest.NewRequest(http.MethodPost, "/user/tokenLogin", strings.NewReader(`{"token":"`+canaryToken+`"}`)),
+		httptest.NewRequest(http.MethodPost, "/user/logout", strings.NewReader(`{"token":"`+canaryToken+`"}`)),
+		httptest.NewRequest(http.MethodGet, "/ws?token="+canaryToken, nil),
+		httptest.NewRequest(http.MethodGet, "/notify/stream?token="+canaryToken, nil),
+	}
+	for _, req := range requests {
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	_ = misc.Logger.Sync()
+
+	if logs.Len() == 0 || access.Len() == 0 {
+		t.Fatal("handlers wrote no logs")
+	}
+	for name, out := range map[string]string{"app": logs.String(), "access": access.String()} {
+		for _, secret := range []string{canaryPassword, canaryToken, canaryEmail} {
+			if strings.Contains(out, secret) {
+				t.Errorf("%s log contains %s:\n%s", name, secret, out)
+			}
+		}
+	}
+	if !strings.Contains(access.String(), `"/ws"`) {
+		t.Errorf("access log missing path:\n%s", access.String())
+	}
+}
@@ -3,6 +3,8 @@ package router
 import (
 	"github.com/dopamine-joker/zu_web_server/api/handle"
 	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/payment"
+	"github.com/dopamine-joker/zu_web_server/rbac"
 	"github.com/dopamine-joker/zu_web_server/utils"
 	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/otel"
@@ -11,35 +13,131 @@ import (
 )
 
 func Register() *gin.Engine {
-	r := gin.Default()
+	r := gin.New()
+	r.Use(AccessLogMiddleware(), gin.Recovery())
 	r.NoRoute(NoRouteFunc)
 	// prometheus
 	misc.StartMonitor(r)
 	monitor := misc.NewPrometheusMonitor(misc.NAMESPACE, misc.SERVICE)
 	r.Use(otelgin.Middleware(misc.SERVICE, otelgin.WithPropagators(otel.GetTextMapPropagator()), otelgin.WithTracerProvider(otel.GetTracerProvider())),
-		monitor.PromMiddleware(), CorsMiddleware(), UserAuthMiddleware(), gin.Recovery())
+		monitor.PromMiddleware(), CorsMiddleware(), UserAuthMiddleware())
 	initUserRouter(r)
 	initGoodsRouter(r)
+	initCategoryRouter(r)
+	initSchoolRouter(r)
 	initOrderRouter(r)
 	initVoiceRouter(r)
 	initCommentRouter(r)
 	initFavoritesRouter(r)
+	initPaymentRouter(r)
+	initDisputeRouter(r)
+	initReportRouter(r)
+	initNotifyRouter(r)
+	initGatewayRouter(r)
+	initChatRouter(r)
+	initAdminRouter(r)
 	return r
 }
 
+//initAdminRouter 管理接口,每个路由声明所需权限,所有调用记录操作日志
+func initAdminRouter(r *gin.Engine) {
+	adminGroup := r.Group("/admin", AuditMiddleware())
+	adminGroup.POST("/dispute/list", RequirePermission(rbac.PermDispute), handle.ListOpenDisputes)
+	adminGroup.POST("/dispute/resolve", RequirePermission(rbac.PermDispute), IdempotencyMiddleware(), handle.ResolveDispute)
+	adminGroup.POST("/moderation/queue", RequirePermission(rbac.PermModerate), handle.ListModerationQueue)
+	adminGroup.POST("/moderation/approve", RequirePermission(rbac.PermModerate), handle.ApproveModeration)
+	adminGroup.POST("/moderation/reject", RequirePermission(rbac.PermModerate), handle.RejectModeration)
+	adminGroup.POST("/report/list", RequirePermission(rbac.PermModerate), handle.ListReports)
+	adminGroup.POST("/report/resolve", RequirePermission(rbac.PermModerate), IdempotencyMiddleware(), handle.ResolveReport)
+	adminGroup.POST("/user/unsuspend", RequirePermission(rbac.PermSanction), handle.UnsuspendUser)
+	adminGroup.POST("/goods/unhide", RequirePermission(rbac.PermSanction), handle.UnhideGoods)
+	adminGroup.POST("/role/get", RequirePermission(rbac.PermManageRole), handle.GetUserRole)
+	adminGroup.POST("/role/set", RequirePermission(rbac.PermManageRole), handle.SetUserRole)
+	adminGroup.POST("/audit/list", RequirePermission(rbac.PermAudit), handle.ListAuditLogs)
+	adminGroup.POST("/category/list", RequirePermission(rbac.PermCategory), handle.ListCategories)
+	adminGroup.POST("/category/add", RequirePermission(rbac.PermCategory), handle.AddCategory)
+	adminGroup.POST("/category/update", RequirePermission(rbac.PermCategory), handle.UpdateCategory)
+	adminGroup.POST("/category/delete", RequirePermission(rbac.PermCategory), handle.DeleteCategory)
+}
+
+func initCategoryRouter(r *gin.Engine) {
+	r.GET("/categories", handle.GetCategories)
+}
+
+func initSchoolRouter(r *gin.Engine) {
+	schoolGroup := r.Group("/school")
+	schoolGroup.POST("/search", handle.SearchSchools)
+	schoolGroup.POST("/get", handle.GetSchool)
+}
+
+func initChatRouter(r *gin.Engine) {
+	chatGroup := r.Group("/chat")
+	chatGroup.POST("/create", handle.CreateConversation)
+	chatGroup.POST("/send", IdempotencyMiddleware(), handle.SendMessage)
+	chatGroup.POST("/messages", handle.GetMessages)
+	chatGroup.POST("/list", handle.GetConversations)
+	chatGroup.POST("/read", handle.ReadConversation)
+	chatGroup.POST("/unread", handle.GetChatUnread)
+}
+
+func initGatewayRouter(r *gin.Engine) {
+	r.GET("/ws", handle.ServeGateway)
+}
+
+func initNotifyRouter(r *gin.Engine) {
+	notifyGroup := r.Group("/notify")
+	notifyGroup.POST("/list", handle.ListNotifications)
+	notifyGroup.POST("/read", handle.ReadNotifications)
+	notifyGroup.POST("/unread", handle.GetUnreadCount)
+	notifyGroup.GET("/stream", handle.StreamNotifications)
+}
+
+func initReportRouter(r *gin.Engine) {
+	reportGroup := r.Group("/report")
+	reportGroup.POST("/add", IdempotencyMiddleware(), handle.AddReport)
+}
+
+func initDisputeRouter(r *gin.Engine) {
+	disputeGroup := r.Group("/dispute")
+	disputeGroup.POST("/open", IdempotencyMiddleware(), handle.OpenDispute)
+	disputeGroup.POST("/message", IdempotencyMiddleware(), handle.AddDisputeMessage)
+	disputeGroup.POST("/detail", handle.GetDisputeDetail)
+	disputeGroup.GET("/evidence", handle.GetDisputeEvidence)
+	disputeGroup.POST("/user", handle.GetUserDisputes)
+}
+
+func initPaymentRouter(r *gin.Engine) {
+	paymentGroup := r.Group("/payment")
+	paymentGroup.POST("/create", IdempotencyMiddleware(), handle.CreatePayment)
+	paymentGroup.POST("/callback", handle.PaymentCallback)
+	paymentGroup.POST("/refund", IdempotencyMiddleware(), handle.RefundPayment)
+	if misc.Conf.PayCfg.Provider == payment.ProviderMock {
+		paymentGroup.POST("/mock/pay", handle.MockPay)
+	}
+}
+
 func initFavoritesRouter(r *gin.Engine) {
 	favoritesGroup := r.Group("/favorites")
-	favoritesGroup.POST("/add", handle.AddFavorites)
-	favoritesGroup.POST("/delete", handle.DeleteFavorites)
+	favoritesGroup.POST("/add", IdempotencyMiddleware(), handle.AddFavorites)
+	favoritesGroup.POST("/delete", IdempotencyMiddleware(), handle.DeleteFavorites)
 	favoritesGroup.POST("/user", handle.GetUserFavorites)
+	favoritesGroup.POST("/check", handle.CheckFavorites)
+	favoritesGroup.POST("/move", handle.MoveFavorites)
+	favoritesGroup.POST("/folder/list", handle.GetFavoriteFolders)
+	favoritesGroup.POST("/folder/add", IdempotencyMiddleware(), handle.AddFavoriteFolder)
+	favoritesGroup.POST("/folder/rename", handle.RenameFavoriteFolder)
+	favoritesGroup.POST("/folder/delete", handle.DeleteFavoriteFolder)
 }
 
 func initCommentRouter(r *gin.Engine) {
 	commentGroup := r.Group("/comment")
-	commentGroup.POST("/add", handle.AddComment)
-	commentGroup.POST("/delete", handle.DeleteComment)
+	commentGroup.POST("/add", IdempotencyMiddleware(), handle.AddComment)
+	commentGroup.POST("/delete", IdempotencyMiddleware(), handle.DeleteComment)
+	commentGroup.POST("/edit", IdempotencyMiddleware(), handle.EditComment)
 	commentGroup.POST("/user", handle.GetCommentByUserId)
 	commentGroup.POST("/goods", handle.GetCommentByGoodsId)
+	commentGroup.POST("/reply", IdempotencyMiddleware(), handle.AddCommentReply)
+	commentGroup.POST("/replyDelete", IdempotencyMiddleware(), handle.DeleteCommentReply)
 }
 
 func initVoiceRouter(r *gin.Engine) {
@@ -54,26 +152,56 @@ func initUserRouter(r *gin.Engine) {
 	userGroup.POST("/tokenLogin", handle.TokenLogin)
 	userGroup.POST("/logout", handle.Logout)
 	userGroup.POST("/getSig", handle.GetSig)
-	userGroup.POST("/update", handle.UpdateUser)
-	userGroup.POST("/uploadFace", handle.UpdateFace)
+	userGroup.POST("/update", IdempotencyMiddleware(), handle.UpdateUser) //已废弃,请使用PATCH /user/profile
+	userGroup.POST("/uploadFace", IdempotencyMiddleware(), handle.UpdateFace)
+	userGroup.POST("/seller", handle.GetSellerProfile)
+	userGroup.POST("/public", handle.GetPublicProfile)
+	userGroup.POST("/privacy/get", handle.GetPrivacy)
+	userGroup.POST("/privacy/set", handle.SetPrivacy)
+	userGroup.POST("/block/add", handle.BlockUser)
+	userGroup.POST("/block/delete", handle.UnblockUser)
+	userGroup.POST("/block/list", handle.GetBlockList)
+	userGroup.POST("/export", handle.ExportUserData)
+	userGroup.POST("/delete", handle.DeleteAccount)
+	userGroup.POST("/delete/cancel", handle.CancelDeleteAccount)
+	userGroup.POST("/delete/status", handle.GetDeleteStatus)
+	userGroup.POST("/resendVerify", handle.ResendVerifyEmail)
+	userGroup.POST("/verifyEmail", handle.VerifyEmail)
+	userGroup.POST("/forgotPassword", handle.ForgotPassword)
+	userGroup.POST("/resetPassword", handle.ResetPassword)
+	userGroup.POST("/school/send", handle.SendSchoolCode)
+	userGroup.POST("/school/verify", handle.VerifySchool)
+	userGroup.POST("/school/badge", handle.GetSchoolBadge)
+	userGroup.POST("/phone/send", handle.SendPhoneCode)
+	userGroup.POST("/phone/verify", handle.VerifyPhone)
+	userGroup.POST("/phone/smsLogin", handle.SetSmsLogin)
+	userGroup.POST("/login/2fa", handle.TotpLogin)
+	userGroup.POST("/2fa/enroll", handle.EnrollTotp)
+	userGroup.POST("/2fa/confirm", handle.ConfirmTotp)
+	userGroup.POST("/2fa/disable", handle.DisableTotp)
+	userGroup.POST("/2fa/recovery", handle.RegenerateRecoveryCodes)
+	userGroup.POST("/2fa/status", handle.GetTotpStatus)
+	userGroup.PATCH("/profile", handle.UpdateProfile)
+	userGroup.POST("/password", handle.ChangePassword)
+	userGroup.POST("/confirmEmail", handle.ConfirmEmailChange)
 }
 
 func initGoodsRouter(r *gin.Engine) {
 	goodsGroup := r.Group("/goods")
-	goodsGroup.POST("/upload", handle.Upload)
+	goodsGroup.POST("/upload", IdempotencyMiddleware(), handle.Upload)
 	goodsGroup.POST("/getGoods", handle.GetGoods)
 	goodsGroup.POST("/userGoods", handle.GetUserGoodsList)
 	goodsGroup.POST("/goodsDetail", handle.GetGoodsDetail)
 	goodsGroup.POST("/search", handle.SearchGoods)
-	goodsGroup.POST("/delete", handle.DeleteGoods)
+	goodsGroup.POST("/delete", IdempotencyMiddleware(), handle.DeleteGoods)
 }
 
 func initOrderRouter(r *gin.Engine) {
 	orderGroup := r.Group("/order")
-	orderGroup.POST("/add", handle.AddOrder)
+	orderGroup.POST("/add", IdempotencyMiddleware(), handle.AddOrder)
 	orderGroup.POST("/getBuy", handle.GetBuyOrder)
 	orderGroup.POST("/getSell", handle.GetSellOrder)
-	orderGroup.POST("/update", handle.UpdateOrder)
+	orderGroup.POST("/update", IdempotencyMiddleware(), handle.UpdateOrder)
 }
 
 func NoRouteFunc(r *gin.Context) {
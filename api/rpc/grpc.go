@@ -34,7 +34,7 @@ func InitLogicRpcClient() {
 
 //Login api grpc调用login
 func Login(ctx context.Context, req *proto.LoginRequest) (code int32, authToken string, user *proto.User, err error) {
-	misc.Logger.Info("login call rpc", zap.Any("request", req))
+	misc.Logger.Info("login call rpc", zap.String("email", req.GetEmail()))
 	response, err := LogicRpcClient.Login(ctx, req)
 	if err != nil {
 		return misc.CodeFail, "", nil, err
@@ -0,0 +1,116 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	listPrefix = "block:list"
+
+	//maxBlocks 每个用户最多拉黑的人数
+	maxBlocks = 1000
+)
+
+var (
+	ErrSelf    = errors.New("不能拉黑自己")
+	ErrTooMany = errors.New("拉黑人数已达上限")
+)
+
+//Entry 黑名单中的一项
+type Entry struct {
+	Uid  int32 `json:"uid"`
+	Time int64 `json:"time"`
+}
+
+//listKey 用户的黑名单,score为拉黑时间
+func listKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", listPrefix, uid)
+}
+
+//Block uid拉黑target,重复拉黑时不更新时间
+func Block(ctx context.Context, uid, target int32) error {
+	if uid == target {
+		return ErrSelf
+	}
+	n, err := db.RedisClient.ZCard(ctx, listKey(uid)).Result()
+	if err != nil {
+		return err
+	}
+	if n >= maxBlocks {
+		return ErrTooMany
+	}
+	return db.RedisClient.ZAddNX(ctx, listKey(uid), &redis.Z{Score: float64(time.Now().Unix()), Member: target}).Err()
+}
+
+//Unblock 取消拉黑,不在黑名单中时返回false
+func Unblock(ctx context.Context, uid, target int32) (bool, error) {
+	n, err := db.RedisClient.ZRem(ctx, listKey(uid), target).Result()
+	return n > 0, err
+}
+
+//List 按拉黑时间倒序列出黑名单
+func List(ctx context.Context, uid int32) ([]*Entry, error) {
+	vals, err := db.RedisClient.ZRevRangeWithScores(ctx, listKey(uid), 0, maxBlocks-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Entry, 0, len(vals))
+	for _, z := range vals {
+		target, err := strconv.Atoi(z.Member.(string))
+		if err != nil {
+			continue
+		}
+		list = append(list, &Entry{Uid: int32(target), Time: int64(z.Score)})
+	}
+	return list, nil
+}
+
+//IsBlocked uid是否拉黑了target
+func IsBlocked(ctx context.Context, uid, target int32) (bool, error) {
+	err := db.RedisClient.ZScore(ctx, listKey(uid), strconv.Itoa(int(target))).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//Between uid与others中任意一人之间是否存在拉黑关系,不区分方向
+func Between(ctx context.Context, uid int32, others ...int32) (bool, error) {
+	pipe := db.RedisClient.Pipeline()
+	cmds := make([]*redis.FloatCmd, 0, 2*len(others))
+	for _, other := range others {
+		if other == uid || other == 0 {
+			continue
+		}
+		cmds = append(cmds,
+			pipe.ZScore(ctx, listKey(uid), strconv.Itoa(int(other))),
+			pipe.ZScore(ctx, listKey(other), strconv.Itoa(int(uid))))
+	}
+	if len(cmds) == 0 {
+		return false, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return false, err
+	}
+	for _, cmd := range cmds {
+		if cmd.Err() == nil {
+			return true, nil
+		}
+		if cmd.Err() != redis.Nil {
+			return false, cmd.Err()
+		}
+	}
+	return false, nil
+}
+
+//Clear 删除用户的黑名单,用于注销账号
+func Clear(ctx context.Context, uid int32) error {
+	return db.RedisClient.Del(ctx, listKey(uid)).Err()
+}
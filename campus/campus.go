@@ -0,0 +1,298 @@
+package campus
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/school"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	codePrefix  = "campus:code"
+	badgePrefix = "campus:badge"
+	emailPrefix = "campus:email" //学校邮箱对应的认证用户
+
+	codeLength = 6
+)
+
+var (
+	ErrUnknownDomain = errors.New("该邮箱不属于已收录的学校")
+	ErrNoCode        = errors.New("验证码不存在或已过期")
+	ErrWrongCode     = errors.New("验证码错误")
+	ErrTooMany       = errors.New("验证码错误次数过多,请重新获取")
+	ErrNotVerified   = errors.New("请先完成学校认证")
+	ErrOtherSchool   = errors.New("只能在已认证的学校发布物品或下单")
+	ErrEmailUsed     = errors.New("该邮箱已被其他账号认证")
+)
+
+//Badge 学校认证标识
+type Badge struct {
+	School     string `json:"school"`
+	Email      string `json:"email"`
+	VerifyTime int64  `json:"verifyTime"`
+}
+
+//pending 等待验证的验证码
+type pending struct {
+	School   string `json:"school"`
+	Email    string `json:"email"`
+	CodeHash string `json:"codeHash"`
+	Attempts int    `json:"attempts"`
+}
+
+func codeKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", codePrefix, uid)
+}
+
+func badgeKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", badgePrefix, uid)
+}
+
+func emailKey(email string) string {
+	return fmt.Sprintf("%s:%s", emailPrefix, strings.ToLower(strings.TrimSpace(email)))
+}
+
+//CheckEmail 学校邮箱是否已被其他账号认证
+func CheckEmail(ctx context.Context, uid int32, email string) error {
+	owner, err := db.RedisClient.Get(ctx, emailKey(email)).Int64()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if int32(owner) != uid {
+		return ErrEmailUsed
+	}
+	return nil
+}
+
+//SchoolByEmail 根据邮箱域名查找学校
+func SchoolByEmail(email string) (string, error) {
+	s, err := school.Default.ByEmail(email)
+	if err != nil {
+		return "", ErrUnknownDomain
+	}
+	return s.Name, nil
+}
+
+//IssueCode 为用户生成学校邮箱验证码,覆盖之前未使用的验证码
+func IssueCode(ctx context.Context, uid int32, school, email string) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1e6))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%0*d", codeLength, n.Int64())
+	val, err := json.Marshal(&pending{
+		School:   school,
+		Email:    email,
+		CodeHash: hashCode(uid, code),
+	})
+	if err != nil {
+		return "", err
+	}
+	expire := time.Duration(misc.Conf.Campus.CodeExpire) * time.Second
+	if err = db.RedisClient.Set(ctx, codeKey(uid), val, expire).Err(); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+//Verify 校验验证码,成功后保存认证标识并占用学校邮箱,一个邮箱只能认证一个账号
+func Verify(ctx context.Context, uid int32, code string) (*Badge, error) {
+	val, err := db.RedisClient.Get(ctx, codeKey(uid)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNoCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 先读出待验证的邮箱,事务中同时监视邮箱的占用
+	var first pending
+	if err = json.Unmarshal(val, &first); err != nil {
+		return nil, err
+	}
+	var badge *Badge
+	err = db.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+		val, err := tx.Get(ctx, codeKey(uid)).Bytes()
+		if err == redis.Nil {
+			return ErrNoCode
+		}
+		if err != nil {
+			return err
+		}
+		var p pending
+		if err = json.Unmarshal(val, &p); err != nil {
+			return err
+		}
+		if p.Email != first.Email {
+			// 验证码在读取后被重新发送到其他邮箱
+			return redis.TxFailedErr
+		}
+		if subtle.ConstantTimeCompare([]byte(p.CodeHash), []byte(hashCode(uid, code))) != 1 {
+			p.Attempts++
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if p.Attempts >= misc.Conf.Campus.MaxAttempts {
+					pipe.Del(ctx, codeKey(uid))
+					return nil
+				}
+				val, _ := json.Marshal(&p)
+				pipe.Set(ctx, codeKey(uid), val, redis.KeepTTL)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if p.Attempts >= misc.Conf.Campus.MaxAttempts {
+				return ErrTooMany
+			}
+			return ErrWrongCode
+		}
+		owner, err := tx.Get(ctx, emailKey(p.Email)).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil && int32(owner) != uid {
+			return ErrEmailUsed
+		}
+		old, err := tx.Get(ctx, badgeKey(uid)).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		var oldBadge Badge
+		if len(old) > 0 {
+			if err = json.Unmarshal(old, &oldBadge); err != nil {
+				return err
+			}
+		}
+		badge = &Badge{School: p.School, Email: p.Email, VerifyTime: time.Now().Unix()}
+		badgeVal, err := json.Marshal(badge)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, codeKey(uid))
+			pipe.Set(ctx, badgeKey(uid), badgeVal, 0)
+			// 改用其他邮箱认证时释放原来的邮箱
+			if oldBadge.Email != "" && emailKey(oldBadge.Email) != emailKey(p.Email) {
+				pipe.Del(ctx, emailKey(oldBadge.Email))
+			}
+			pipe.Set(ctx, emailKey(p.Email), uid, 0)
+			return nil
+		})
+		return err
+	}, codeKey(uid), emailKey(first.Email), badgeKey(uid))
+	if err != nil {
+		return nil, err
+	}
+	return badge, nil
+}
+
+//GetBadge 获取用户的学校认证,未认证时返回nil
+func GetBadge(ctx context.Context, uid int32) (*Badge, error) {
+	val, err := db.RedisClient.Get(ctx, badgeKey(uid)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var badge Badge
+	if err = json.Unmarshal(val, &badge); err != nil {
+		return nil, err
+	}
+	return &badge, nil
+}
+
+//RemoveBadge 取消学校认证,同时释放学校邮箱
+func RemoveBadge(ctx context.Context, uid int32) error {
+	badge, err := GetBadge(ctx, uid)
+	if err != nil || badge == nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.Del(ctx, badgeKey(uid))
+	if err = CheckEmail(ctx, uid, badge.Email); err == nil {
+		pipe.Del(ctx, emailKey(badge.Email))
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//IndexEmails 为邮箱占用上线前的认证建立邮箱索引,同一邮箱认证了多个账号时保留最早认证的账号,
+//返回重复认证的用户由管理员处理
+func IndexEmails(ctx context.Context) ([]int32, error) {
+	owners := make(map[string]int32)
+	times := make(map[string]int64)
+	var dup []int32
+	iter := db.RedisClient.Scan(ctx, 0, badgePrefix+":*", 500).Iterator()
+	for iter.Next(ctx) {
+		var uid int32
+		if _, err := fmt.Sscanf(strings.TrimPrefix(iter.Val(), badgePrefix+":"), "%d", &uid); err != nil {
+			continue
+		}
+		badge, err := GetBadge(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		if badge == nil {
+			continue
+		}
+		key := emailKey(badge.Email)
+		prev, ok := owners[key]
+		if !ok {
+			owners[key], times[key] = uid, badge.VerifyTime
+			continue
+		}
+		if badge.VerifyTime < times[key] {
+			dup = append(dup, prev)
+			owners[key], times[key] = uid, badge.VerifyTime
+		} else {
+			dup = append(dup, uid)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	for key, uid := range owners {
+		if err := db.RedisClient.SetNX(ctx, key, uid, 0).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return dup, nil
+}
+
+//CheckSchool 校验用户能否在school发布物品或下单,未开启强制认证时直接通过
+func CheckSchool(ctx context.Context, uid int32, school string) error {
+	if !misc.Conf.Campus.Required {
+		return nil
+	}
+	badge, err := GetBadge(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if badge == nil {
+		return ErrNotVerified
+	}
+	if badge.School != strings.TrimSpace(school) {
+		return ErrOtherSchool
+	}
+	return nil
+}
+
+func hashCode(uid int32, code string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s", uid, code)))
+	return hex.EncodeToString(sum[:])
+}
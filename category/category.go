@@ -0,0 +1,359 @@
+package category
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	treeKey = "category:tree"
+	seqKey  = "category:seq"
+
+	//DefaultLocale 每个分类必须提供的名称语言,其他语言缺失时回退到它
+	DefaultLocale = "zh-CN"
+
+	//maxDepth 分类树的最大层数
+	maxDepth = 3
+)
+
+// 属性类型
+const (
+	AttrText   = "text"
+	AttrNumber = "number"
+	AttrEnum   = "enum"
+	AttrBool   = "bool"
+)
+
+var (
+	ErrNotFound    = errors.New("分类不存在")
+	ErrExists      = errors.New("分类id已存在")
+	ErrParent      = errors.New("父分类不存在")
+	ErrCycle       = errors.New("不能把分类移动到自己的子分类下")
+	ErrDepth       = errors.New("分类层级过深")
+	ErrHasChildren = errors.New("分类下还有子分类")
+	ErrName        = errors.New("缺少默认语言的分类名称")
+	ErrAttribute   = errors.New("分类属性定义错误")
+	ErrNotLeaf     = errors.New("请选择最下级的分类")
+	ErrDisabled    = errors.New("分类已停用")
+	ErrInUse       = errors.New("分类下还有物品,请改为停用")
+)
+
+//Attribute 分类下物品可填写的属性
+type Attribute struct {
+	Key      string            `json:"key"`
+	Names    map[string]string `json:"names"`
+	Type     string            `json:"type"`
+	Options  []string          `json:"options,omitempty"`
+	Required bool              `json:"required"`
+}
+
+//Category 物品分类,id即物品的type
+type Category struct {
+	Id         int32             `json:"id"`
+	Parent     int32             `json:"parent"`
+	Names      map[string]string `json:"names"`
+	Icon       string            `json:"icon"`
+	Attributes []*Attribute      `json:"attributes"`
+	Sort       int32             `json:"sort"`
+	Disabled   bool              `json:"disabled"`
+}
+
+//Node 分类树的节点
+type Node struct {
+	*Category
+	Name     string  `json:"name"`
+	Children []*Node `json:"children"`
+}
+
+//Name 按语言取分类名称,缺失时回退到默认语言
+func (c *Category) Name(locale string) string {
+	return localize(c.Names, locale)
+}
+
+func localize(names map[string]string, locale string) string {
+	if locale == "" {
+		return names[DefaultLocale]
+	}
+	if name, ok := names[locale]; ok {
+		return name
+	}
+	// zh-TW缺失时依次尝试zh和其他zh开头的名称
+	if i := strings.IndexByte(locale, '-'); i > 0 {
+		locale = locale[:i]
+	}
+	if name, ok := names[locale]; ok {
+		return name
+	}
+	if strings.HasPrefix(DefaultLocale, locale+"-") {
+		return names[DefaultLocale]
+	}
+	for l, name := range names {
+		if strings.HasPrefix(l, locale+"-") {
+			return name
+		}
+	}
+	return names[DefaultLocale]
+}
+
+func (c *Category) validate() error {
+	if strings.TrimSpace(c.Names[DefaultLocale]) == "" {
+		return ErrName
+	}
+	keys := make(map[string]bool, len(c.Attributes))
+	for _, a := range c.Attributes {
+		if a == nil || a.Key == "" || keys[a.Key] || strings.TrimSpace(a.Names[DefaultLocale]) == "" {
+			return ErrAttribute
+		}
+		keys[a.Key] = true
+		switch a.Type {
+		case AttrText, AttrNumber, AttrBool:
+			a.Options = nil
+		case AttrEnum:
+			if len(a.Options) == 0 {
+				return ErrAttribute
+			}
+		default:
+			return ErrAttribute
+		}
+	}
+	return nil
+}
+
+//All 获取所有分类,包括已停用的
+func All(ctx context.Context) (map[int32]*Category, error) {
+	return load(ctx, db.RedisClient)
+}
+
+func load(ctx context.Context, c redis.Cmdable) (map[int32]*Category, error) {
+	vals, err := c.HGetAll(ctx, treeKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[int32]*Category, len(vals))
+	for _, v := range vals {
+		var cat Category
+		if err = json.Unmarshal([]byte(v), &cat); err != nil {
+			return nil, err
+		}
+		all[cat.Id] = &cat
+	}
+	return all, nil
+}
+
+//Get 获取单个分类
+func Get(ctx context.Context, id int32) (*Category, error) {
+	val, err := db.RedisClient.HGet(ctx, treeKey, strconv.Itoa(int(id))).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cat Category
+	if err = json.Unmarshal(val, &cat); err != nil {
+		return nil, err
+	}
+	return &cat, nil
+}
+
+//Tree 按sort和id排序构建分类树,withDisabled为false时停用的分类及其子分类都不返回
+func Tree(all map[int32]*Category, locale string, withDisabled bool) []*Node {
+	children := make(map[int32][]*Node)
+	for _, cat := range all {
+		if cat.Disabled && !withDisabled {
+			continue
+		}
+		children[cat.Parent] = append(children[cat.Parent], &Node{Category: cat, Name: cat.Name(locale)})
+	}
+	var build func(parent int32) []*Node
+	build = func(parent int32) []*Node {
+		nodes := children[parent]
+		sort.Slice(nodes, func(i, j int) bool {
+			if nodes[i].Sort != nodes[j].Sort {
+				return nodes[i].Sort < nodes[j].Sort
+			}
+			return nodes[i].Id < nodes[j].Id
+		})
+		for _, n := range nodes {
+			n.Children = build(n.Id)
+		}
+		return nodes
+	}
+	return build(0)
+}
+
+//Create 创建分类,id为0时自动分配
+func Create(ctx context.Context, cat *Category) error {
+	if err := cat.validate(); err != nil {
+		return err
+	}
+	if cat.Id == 0 {
+		id, err := nextId(ctx)
+		if err != nil {
+			return err
+		}
+		cat.Id = id
+	}
+	return db.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+		all, err := load(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if _, ok := all[cat.Id]; ok {
+			return ErrExists
+		}
+		if err = checkParent(all, cat); err != nil {
+			return err
+		}
+		return save(ctx, tx, cat)
+	}, treeKey)
+}
+
+//Update 修改分类,可以移动到其他父分类下
+func Update(ctx context.Context, cat *Category) error {
+	if err := cat.validate(); err != nil {
+		return err
+	}
+	return db.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+		all, err := load(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if _, ok := all[cat.Id]; !ok {
+			return ErrNotFound
+		}
+		if err = checkParent(all, cat); err != nil {
+			return err
+		}
+		return save(ctx, tx, cat)
+	}, treeKey)
+}
+
+//Delete 删除没有子分类的分类,inUse检查是否还有物品使用该分类,有时返回ErrInUse
+func Delete(ctx context.Context, id int32, inUse func(ctx context.Context, id int32) (bool, error)) error {
+	used, err := inUse(ctx, id)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrInUse
+	}
+	return db.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+		all, err := load(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if _, ok := all[id]; !ok {
+			return ErrNotFound
+		}
+		for _, cat := range all {
+			if cat.Parent == id {
+				return ErrHasChildren
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, treeKey, strconv.Itoa(int(id)))
+			return nil
+		})
+		return err
+	}, treeKey)
+}
+
+//Check 校验物品分类,只能选择启用的最下级分类。
+//分类树为空时还没有可供选择的分类,不做校验
+func Check(ctx context.Context, id int32) error {
+	all, err := All(ctx)
+	if err != nil {
+		return err
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	cat, ok := all[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, c := range all {
+		if c.Parent == id && !c.Disabled {
+			return ErrNotLeaf
+		}
+	}
+	// 祖先分类停用时子分类同样不可用
+	for p := cat; p != nil; p = all[p.Parent] {
+		if p.Disabled {
+			return ErrDisabled
+		}
+	}
+	return nil
+}
+
+//checkParent 父分类必须存在,不能形成环,且整棵子树不能超过最大层数
+func checkParent(all map[int32]*Category, cat *Category) error {
+	if cat.Parent == cat.Id {
+		return ErrCycle
+	}
+	depth := 1
+	for p := cat.Parent; p != 0; depth++ {
+		parent, ok := all[p]
+		if !ok {
+			return ErrParent
+		}
+		if parent.Id == cat.Id {
+			return ErrCycle
+		}
+		p = parent.Parent
+	}
+	if depth+height(all, cat.Id)-1 > maxDepth {
+		return ErrDepth
+	}
+	return nil
+}
+
+//height 以id为根的子树层数
+func height(all map[int32]*Category, id int32) int {
+	h := 0
+	for _, c := range all {
+		if c.Parent == id && c.Id != id {
+			if sub := height(all, c.Id); sub > h {
+				h = sub
+			}
+		}
+	}
+	return h + 1
+}
+
+//nextId 分配自增id,跳过管理员手动指定过的id
+func nextId(ctx context.Context) (int32, error) {
+	for {
+		id, err := db.RedisClient.Incr(ctx, seqKey).Result()
+		if err != nil {
+			return 0, err
+		}
+		exists, err := db.RedisClient.HExists(ctx, treeKey, strconv.FormatInt(id, 10)).Result()
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			return int32(id), nil
+		}
+	}
+}
+
+func save(ctx context.Context, tx *redis.Tx, cat *Category) error {
+	val, err := json.Marshal(cat)
+	if err != nil {
+		return err
+	}
+	_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, treeKey, strconv.Itoa(int(cat.Id)), val)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+)
+
+// 会话范围
+const (
+	ScopeOrder = "order"
+	ScopeGoods = "goods"
+)
+
+var (
+	ErrNotFound  = errors.New("会话不存在")
+	ErrNotMember = errors.New("不是会话成员")
+)
+
+//Conversation 买卖双方围绕订单或物品的会话
+type Conversation struct {
+	Id          string   `json:"id"`
+	Scope       string   `json:"scope"`
+	ScopeId     int32    `json:"scopeId"`
+	Members     []int32  `json:"members"`
+	CreateTime  int64    `json:"createTime"`
+	UpdateTime  int64    `json:"updateTime"`
+	LastMessage *Message `json:"lastMessage,omitempty"`
+}
+
+//Message 会话消息,Id在会话内递增
+type Message struct {
+	Id      int64  `json:"id"`
+	ConvId  string `json:"convId"`
+	Sender  int32  `json:"sender"`
+	Content string `json:"content"`
+	Time    int64  `json:"time"`
+}
+
+//Store 会话存储
+type Store interface {
+	//CreateConversation 创建会话,会话已存在时返回已有会话
+	CreateConversation(ctx context.Context, conv *Conversation) (*Conversation, error)
+	GetConversation(ctx context.Context, id string) (*Conversation, error)
+	//ListConversations 按最近消息时间倒序获取用户的会话
+	ListConversations(ctx context.Context, uid int32, page, count int64) ([]*Conversation, error)
+	//AddMessage 保存消息并填充Id,其他成员的未读数加一
+	AddMessage(ctx context.Context, conv *Conversation, msg *Message) error
+	//Messages 获取id小于before的最近count条消息,按id倒序;before为0时从最新一条开始
+	Messages(ctx context.Context, convId string, before, count int64) ([]*Message, error)
+	MarkRead(ctx context.Context, convId string, uid int32) error
+	//Unread 获取用户各个会话的未读数
+	Unread(ctx context.Context, uid int32) (map[string]int64, error)
+	//Purge 删除用户发送的消息和用户的会话列表,会话本身保留给其他成员
+	Purge(ctx context.Context, uid int32) error
+}
+
+var Default Store
+
+func Init() {
+	Default = NewRedisStore(db.RedisClient)
+}
+
+//ConversationId 同一订单,或同一买家对同一物品只有一个会话
+func ConversationId(scope string, scopeId, buyer int32) string {
+	if scope == ScopeOrder {
+		return fmt.Sprintf("%s-%d", scope, scopeId)
+	}
+	return fmt.Sprintf("%s-%d-%d", scope, scopeId, buyer)
+}
+
+//IsMember 用户是否为会话成员
+func (c *Conversation) IsMember(uid int32) bool {
+	for _, m := range c.Members {
+		if m == uid {
+			return true
+		}
+	}
+	return false
+}
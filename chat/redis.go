@@ -0,0 +1,274 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	convPrefix   = "chat:conv"
+	userPrefix   = "chat:user"
+	msgPrefix    = "chat:msg"
+	seqPrefix    = "chat:seq"
+	unreadPrefix = "chat:unread"
+)
+
+//RedisStore 基于redis的会话存储
+type RedisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func convKey(id string) string {
+	return fmt.Sprintf("%s:%s", convPrefix, id)
+}
+
+//userKey 用户的会话,score为最近消息时间
+func userKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", userPrefix, uid)
+}
+
+//msgKey 会话消息,score为消息id
+func msgKey(convId string) string {
+	return fmt.Sprintf("%s:%s", msgPrefix, convId)
+}
+
+func seqKey(convId string) string {
+	return fmt.Sprintf("%s:%s", seqPrefix, convId)
+}
+
+//unreadKey 用户各个会话的未读数
+func unreadKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", unreadPrefix, uid)
+}
+
+func (s *RedisStore) CreateConversation(ctx context.Context, conv *Conversation) (*Conversation, error) {
+	now := time.Now().Unix()
+	conv.CreateTime = now
+	conv.UpdateTime = now
+	val, err := json.Marshal(conv)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := s.client.SetNX(ctx, convKey(conv.Id), val, 0).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return s.GetConversation(ctx, conv.Id)
+	}
+	pipe := s.client.TxPipeline()
+	for _, uid := range conv.Members {
+		pipe.ZAdd(ctx, userKey(uid), &redis.Z{Score: float64(now), Member: conv.Id})
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+func (s *RedisStore) GetConversation(ctx context.Context, id string) (*Conversation, error) {
+	val, err := s.client.Get(ctx, convKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var conv Conversation
+	if err = json.Unmarshal(val, &conv); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+func (s *RedisStore) ListConversations(ctx context.Context, uid int32, page, count int64) ([]*Conversation, error) {
+	ids, err := s.client.ZRevRange(ctx, userKey(uid), page*count, (page+1)*count-1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, convKey(id))
+	}
+	vals, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Conversation, 0, len(vals))
+	for _, val := range vals {
+		str, ok := val.(string)
+		if !ok {
+			continue
+		}
+		var conv Conversation
+		if err = json.Unmarshal([]byte(str), &conv); err != nil {
+			return nil, err
+		}
+		list = append(list, &conv)
+	}
+	return list, nil
+}
+
+func (s *RedisStore) AddMessage(ctx context.Context, conv *Conversation, msg *Message) error {
+	id, err := s.client.Incr(ctx, seqKey(conv.Id)).Result()
+	if err != nil {
+		return err
+	}
+	msg.Id = id
+	msg.ConvId = conv.Id
+	if msg.Time == 0 {
+		msg.Time = time.Now().Unix()
+	}
+	val, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	conv.LastMessage = msg
+	conv.UpdateTime = msg.Time
+	convVal, err := json.Marshal(conv)
+	if err != nil {
+		return err
+	}
+	pipe := s.client.TxPipeline()
+	pipe.ZAdd(ctx, msgKey(conv.Id), &redis.Z{Score: float64(id), Member: val})
+	pipe.Set(ctx, convKey(conv.Id), convVal, 0)
+	for _, uid := range conv.Members {
+		pipe.ZAdd(ctx, userKey(uid), &redis.Z{Score: float64(msg.Time), Member: conv.Id})
+		if uid != msg.Sender {
+			pipe.HIncrBy(ctx, unreadKey(uid), conv.Id, 1)
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) Messages(ctx context.Context, convId string, before, count int64) ([]*Message, error) {
+	max := "+inf"
+	if before > 0 {
+		max = "(" + strconv.FormatInt(before, 10)
+	}
+	vals, err := s.client.ZRevRangeByScore(ctx, msgKey(convId), &redis.ZRangeBy{
+		Max:   max,
+		Min:   "-inf",
+		Count: count,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Message, 0, len(vals))
+	for _, val := range vals {
+		var msg Message
+		if err = json.Unmarshal([]byte(val), &msg); err != nil {
+			return nil, err
+		}
+		list = append(list, &msg)
+	}
+	return list, nil
+}
+
+func (s *RedisStore) MarkRead(ctx context.Context, convId string, uid int32) error {
+	return s.client.HDel(ctx, unreadKey(uid), convId).Err()
+}
+
+func (s *RedisStore) Unread(ctx context.Context, uid int32) (map[string]int64, error) {
+	vals, err := s.client.HGetAll(ctx, unreadKey(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]int64, len(vals))
+	for id, val := range vals {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n <= 0 {
+			continue
+		}
+		res[id] = n
+	}
+	return res, nil
+}
+
+func (s *RedisStore) Purge(ctx context.Context, uid int32) error {
+	ids, err := s.client.ZRange(ctx, userKey(uid), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err = s.purgeConversation(ctx, id, uid); err != nil {
+			return err
+		}
+	}
+	return s.client.Del(ctx, userKey(uid), unreadKey(uid)).Err()
+}
+
+//purgeConversation 删除用户在会话中发送的消息,最近一条消息是用户发送的时改为剩余的最近一条
+func (s *RedisStore) purgeConversation(ctx context.Context, convId string, uid int32) error {
+	vals, err := s.client.ZRange(ctx, msgKey(convId), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	var own []interface{}
+	for _, val := range vals {
+		var msg Message
+		if err = json.Unmarshal([]byte(val), &msg); err != nil {
+			continue
+		}
+		if msg.Sender == uid {
+			own = append(own, val)
+		}
+	}
+	if len(own) > 0 {
+		if err = s.client.ZRem(ctx, msgKey(convId), own...).Err(); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < 3; i++ {
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+			val, err := tx.Get(ctx, convKey(convId)).Bytes()
+			if err == redis.Nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			var conv Conversation
+			if err = json.Unmarshal(val, &conv); err != nil {
+				return err
+			}
+			if conv.LastMessage == nil || conv.LastMessage.Sender != uid {
+				return nil
+			}
+			conv.LastMessage = nil
+			last, err := s.Messages(ctx, convId, 0, 1)
+			if err != nil {
+				return err
+			}
+			if len(last) > 0 {
+				conv.LastMessage = last[0]
+			}
+			convVal, err := json.Marshal(&conv)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, convKey(convId), convVal, 0)
+				return nil
+			})
+			return err
+		}, convKey(convId))
+		if err != redis.TxFailedErr {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+var _ Store = (*RedisStore)(nil)
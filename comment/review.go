@@ -0,0 +1,197 @@
+package comment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	reviewPrefix      = "comment:review"
+	orderReviewPrefix = "comment:order"
+)
+
+var (
+	ErrOrderReviewed = errors.New("该订单已评价")
+	ErrEditExpired   = errors.New("已超过可修改时间")
+	ErrNotReview     = errors.New("评价不存在")
+)
+
+//Review 带评分的评价,记录对应订单和修改内容
+type Review struct {
+	Cid        int32  `json:"cid"`
+	Oid        int32  `json:"oid"`
+	Gid        int32  `json:"gid"`
+	Uid        int32  `json:"uid"`
+	SellId     int32  `json:"sellId"`
+	Level      int32  `json:"level"`
+	Content    string `json:"content"`
+	CreateTime int64  `json:"createTime"`
+	EditTime   int64  `json:"editTime"`
+}
+
+func reviewKey(cid int32) string {
+	return fmt.Sprintf("%s:%d", reviewPrefix, cid)
+}
+
+func orderReviewKey(oid int32) string {
+	return fmt.Sprintf("%s:%d", orderReviewPrefix, oid)
+}
+
+//ReserveOrder 占用订单的评价名额,一个订单只能有一条评价
+func ReserveOrder(ctx context.Context, oid int32, expire time.Duration) error {
+	ok, err := db.RedisClient.SetNX(ctx, orderReviewKey(oid), 0, expire).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrOrderReviewed
+	}
+	return nil
+}
+
+//ReleaseOrder 评价提交失败后释放订单的评价名额
+func ReleaseOrder(ctx context.Context, oid int32) error {
+	return db.RedisClient.Del(ctx, orderReviewKey(oid)).Err()
+}
+
+//SaveReview 评价创建成功后记录
+func SaveReview(ctx context.Context, r *Review) error {
+	r.CreateTime = time.Now().Unix()
+	val, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.Set(ctx, reviewKey(r.Cid), val, 0)
+	pipe.Set(ctx, orderReviewKey(r.Oid), r.Cid, 0)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//ImportReview 为迁移前发表的评价补录记录,保留原评价时间,已有记录时返回false
+func ImportReview(ctx context.Context, r *Review) (bool, error) {
+	val, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	ok, err := db.RedisClient.SetNX(ctx, reviewKey(r.Cid), val, 0).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+	if err = db.RedisClient.SetNX(ctx, orderReviewKey(r.Oid), r.Cid, 0).Err(); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+func GetReview(ctx context.Context, cid int32) (*Review, error) {
+	val, err := db.RedisClient.Get(ctx, reviewKey(cid)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotReview
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r Review
+	if err = json.Unmarshal(val, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+//EditReview 在window时间内修改评分和内容,返回修改后的评价和原评分。
+//并发修改时后一次基于前一次的结果,保证评分汇总只按实际变化调整
+func EditReview(ctx context.Context, uid, cid, level int32, content string, window time.Duration) (*Review, int32, error) {
+	var r *Review
+	var oldLevel int32
+	txf := func(tx *redis.Tx) error {
+		val, err := tx.Get(ctx, reviewKey(cid)).Bytes()
+		if err == redis.Nil {
+			return ErrNotReview
+		}
+		if err != nil {
+			return err
+		}
+		r = &Review{}
+		if err = json.Unmarshal(val, r); err != nil {
+			return err
+		}
+		if r.Uid != uid {
+			return ErrNotReview
+		}
+		if time.Since(time.Unix(r.CreateTime, 0)) > window {
+			return ErrEditExpired
+		}
+		oldLevel = r.Level
+		r.Level = level
+		r.Content = content
+		r.EditTime = time.Now().Unix()
+		if val, err = json.Marshal(r); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, reviewKey(cid), val, 0)
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		err := db.RedisClient.Watch(ctx, txf, reviewKey(cid))
+		if err == redis.TxFailedErr {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return r, oldLevel, nil
+	}
+	return nil, 0, redis.TxFailedErr
+}
+
+//DeleteReview 评价删除后清理记录,返回被删除的评价,没有记录时返回nil。
+//订单名额不释放,避免删除后重新评价绕过一单一评和修改时间限制
+func DeleteReview(ctx context.Context, cid int32) (*Review, error) {
+	r, err := GetReview(ctx, cid)
+	if errors.Is(err, ErrNotReview) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, db.RedisClient.Del(ctx, reviewKey(cid)).Err()
+}
+
+//Reviews 批量获取评价记录,没有记录的评价不在结果中
+func Reviews(ctx context.Context, cids []int32) (map[int32]*Review, error) {
+	res := make(map[int32]*Review, len(cids))
+	if len(cids) == 0 {
+		return res, nil
+	}
+	keys := make([]string, 0, len(cids))
+	for _, cid := range cids {
+		keys = append(keys, reviewKey(cid))
+	}
+	vals, err := db.RedisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var r Review
+		if err = json.Unmarshal([]byte(s), &r); err != nil {
+			return nil, err
+		}
+		res[r.Cid] = &r
+	}
+	return res, nil
+}
@@ -0,0 +1,309 @@
+package comment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	replySeqKey     = "comment:reply:seq"
+	replyPrefix     = "comment:reply"
+	threadPrefix    = "comment:thread"
+	childPrefix     = "comment:child"
+	sellerPrefix    = "comment:seller"
+	tombstonePrefix = "comment:tombstone"
+	userPrefix      = "comment:user"
+)
+
+func replyKey(id int64) string {
+	return fmt.Sprintf("%s:%d", replyPrefix, id)
+}
+
+func threadKey(cid int32) string {
+	return fmt.Sprintf("%s:%d", threadPrefix, cid)
+}
+
+func childKey(id int64) string {
+	return fmt.Sprintf("%s:%d", childPrefix, id)
+}
+
+func sellerKey(cid int32) string {
+	return fmt.Sprintf("%s:%d", sellerPrefix, cid)
+}
+
+func tombstoneKey(gid int32) string {
+	return fmt.Sprintf("%s:%d", tombstonePrefix, gid)
+}
+
+//userKey 用户发表的回复,score为回复时间
+func userKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", userPrefix, uid)
+}
+
+//AddReply 添加回复,卖家对同一评价只能回复一次
+func AddReply(ctx context.Context, r *Reply) error {
+	if r.Parent != 0 {
+		parent, err := GetReply(ctx, r.Parent)
+		if err != nil || parent.Cid != r.Cid || parent.Deleted {
+			return ErrParentReply
+		}
+	}
+	id, err := db.RedisClient.Incr(ctx, replySeqKey).Result()
+	if err != nil {
+		return err
+	}
+	r.Id = id
+	r.Time = time.Now().Unix()
+	val, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// 卖家回复的占用与回复内容在同一个事务中写入,失败时不会留下占用
+	err = db.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+		if r.Seller {
+			n, err := tx.Exists(ctx, sellerKey(r.Cid)).Result()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return ErrSellerReply
+			}
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if r.Seller {
+				pipe.Set(ctx, sellerKey(r.Cid), id, 0)
+			}
+			pipe.Set(ctx, replyKey(id), val, 0)
+			pipe.ZAdd(ctx, threadKey(r.Cid), &redis.Z{Score: float64(r.Time), Member: id})
+			pipe.ZAdd(ctx, userKey(r.Uid), &redis.Z{Score: float64(r.Time), Member: id})
+			if r.Parent != 0 {
+				pipe.SAdd(ctx, childKey(r.Parent), id)
+			}
+			return nil
+		})
+		return err
+	}, sellerKey(r.Cid))
+	if err == redis.TxFailedErr {
+		return ErrSellerReply
+	}
+	return err
+}
+
+func GetReply(ctx context.Context, id int64) (*Reply, error) {
+	val, err := db.RedisClient.Get(ctx, replyKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r Reply
+	if err = json.Unmarshal(val, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+//DeleteReply 删除回复;仍有下级回复时只清空内容,保留楼层结构
+func DeleteReply(ctx context.Context, uid int32, id int64) error {
+	r, err := GetReply(ctx, id)
+	if err != nil {
+		return err
+	}
+	if r.Uid != uid {
+		return ErrNotReplyUser
+	}
+	children, err := db.RedisClient.SCard(ctx, childKey(id)).Result()
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	if children > 0 {
+		r.Deleted = true
+		r.Content = ""
+		val, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, replyKey(id), val, 0)
+	} else {
+		pipe.Del(ctx, replyKey(id))
+		pipe.ZRem(ctx, threadKey(r.Cid), id)
+		pipe.ZRem(ctx, userKey(r.Uid), id)
+		if r.Parent != 0 {
+			pipe.SRem(ctx, childKey(r.Parent), id)
+		}
+	}
+	// 卖家删除回复后可以重新回复
+	if r.Seller {
+		pipe.Del(ctx, sellerKey(r.Cid))
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//Replies 批量获取多条评价下的全部回复,一次pipeline读取回复id,一次MGET读取内容
+func Replies(ctx context.Context, cids []int32) (map[int32][]*Reply, error) {
+	result := make(map[int32][]*Reply, len(cids))
+	if len(cids) == 0 {
+		return result, nil
+	}
+	pipe := db.RedisClient.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, 0, len(cids))
+	for _, cid := range cids {
+		cmds = append(cmds, pipe.ZRange(ctx, threadKey(cid), 0, -1))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, cmd := range cmds {
+		for _, id := range cmd.Val() {
+			keys = append(keys, fmt.Sprintf("%s:%s", replyPrefix, id))
+		}
+	}
+	if len(keys) == 0 {
+		return result, nil
+	}
+	vals, err := db.RedisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var r Reply
+		if err = json.Unmarshal([]byte(s), &r); err != nil {
+			return nil, err
+		}
+		result[r.Cid] = append(result[r.Cid], &r)
+	}
+	return result, nil
+}
+
+//HasReplies 评价下是否有回复
+func HasReplies(ctx context.Context, cid int32) (bool, error) {
+	n, err := db.RedisClient.ZCard(ctx, threadKey(cid)).Result()
+	return n > 0, err
+}
+
+//AddTombstone 评价被删除但仍有回复时保留占位
+func AddTombstone(ctx context.Context, t *Tombstone) error {
+	val, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return db.RedisClient.HSet(ctx, tombstoneKey(t.Gid), strconv.Itoa(int(t.Cid)), val).Err()
+}
+
+//Tombstones 物品下已删除但保留回复的评价
+func Tombstones(ctx context.Context, gid int32) ([]*Tombstone, error) {
+	vals, err := db.RedisClient.HVals(ctx, tombstoneKey(gid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Tombstone, 0, len(vals))
+	for _, v := range vals {
+		var t Tombstone
+		if err = json.Unmarshal([]byte(v), &t); err != nil {
+			return nil, err
+		}
+		list = append(list, &t)
+	}
+	return list, nil
+}
+
+//UserReplies 用户发表的回复,按时间排序;已删除但保留楼层的回复内容为空
+func UserReplies(ctx context.Context, uid int32) ([]*Reply, error) {
+	ids, err := db.RedisClient.ZRange(ctx, userKey(uid), 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, fmt.Sprintf("%s:%s", replyPrefix, id))
+	}
+	vals, err := db.RedisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Reply, 0, len(vals))
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var r Reply
+		if err = json.Unmarshal([]byte(s), &r); err != nil {
+			return nil, err
+		}
+		list = append(list, &r)
+	}
+	return list, nil
+}
+
+//PurgeUser 删除用户的全部回复;仍有下级回复的楼层同时清空昵称和头像
+func PurgeUser(ctx context.Context, uid int32) error {
+	ids, err := db.RedisClient.ZRange(ctx, userKey(uid), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, member := range ids {
+		id, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			continue
+		}
+		if err = DeleteReply(ctx, uid, id); err != nil && err != ErrNotFound {
+			return err
+		}
+		r, err := GetReply(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r.Uname = ""
+		r.Uface = ""
+		val, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if err = db.RedisClient.Set(ctx, replyKey(id), val, 0).Err(); err != nil {
+			return err
+		}
+	}
+	return db.RedisClient.Del(ctx, userKey(uid)).Err()
+}
+
+//IndexReplies 根据已有的回复重建用户回复索引
+func IndexReplies(ctx context.Context) error {
+	iter := db.RedisClient.Scan(ctx, 0, replyPrefix+":*", 500).Iterator()
+	for iter.Next(ctx) {
+		// 跳过回复id序列
+		id, err := strconv.ParseInt(strings.TrimPrefix(iter.Val(), replyPrefix+":"), 10, 64)
+		if err != nil {
+			continue
+		}
+		r, err := GetReply(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = db.RedisClient.ZAdd(ctx, userKey(r.Uid), &redis.Z{Score: float64(r.Time), Member: id}).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
@@ -0,0 +1,70 @@
+package comment
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	ErrNotFound     = errors.New("回复不存在")
+	ErrSellerReply  = errors.New("卖家已回复过该评价")
+	ErrParentReply  = errors.New("回复的对象不存在")
+	ErrNotReplyUser = errors.New("只能删除自己的回复")
+)
+
+//Reply 评价下的回复,Parent为0时直接回复评价
+type Reply struct {
+	Id      int64  `json:"id"`
+	Cid     int32  `json:"cid"`
+	Gid     int32  `json:"gid"`
+	Parent  int64  `json:"parent"`
+	Uid     int32  `json:"uid"`
+	Uname   string `json:"userName"`
+	Uface   string `json:"userFace"`
+	Content string `json:"content"`
+	Seller  bool   `json:"seller"`
+	Deleted bool   `json:"deleted"`
+	Time    int64  `json:"time"`
+}
+
+//Node 回复树节点
+type Node struct {
+	*Reply
+	Children []*Node `json:"children"`
+}
+
+//Tombstone 已删除但仍有回复的评价,用于保持楼层结构
+type Tombstone struct {
+	Cid  int32 `json:"cid"`
+	Gid  int32 `json:"gid"`
+	Oid  int32 `json:"oid"`
+	Time int64 `json:"time"`
+}
+
+//BuildTree 将一条评价下的回复组装成树,同层按时间排序
+func BuildTree(replies []*Reply) []*Node {
+	nodes := make(map[int64]*Node, len(replies))
+	for _, r := range replies {
+		nodes[r.Id] = &Node{Reply: r}
+	}
+	var roots []*Node
+	for _, r := range replies {
+		node := nodes[r.Id]
+		if parent, ok := nodes[r.Parent]; ok && r.Parent != 0 {
+			parent.Children = append(parent.Children, node)
+			continue
+		}
+		roots = append(roots, node)
+	}
+	sortNodes(roots)
+	return roots
+}
+
+func sortNodes(nodes []*Node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Time < nodes[j].Time
+	})
+	for _, n := range nodes {
+		sortNodes(n.Children)
+	}
+}
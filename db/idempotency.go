@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	idemKeyPrefix   = "idempotency"
+	idemStatePend   = "pending"
+	idemStateFinish = "finish"
+)
+
+//IdemResponse 保存的首次响应
+type IdemResponse struct {
+	State       string `json:"state"`
+	BodyHash    string `json:"bodyHash"` //请求体摘要,同一个键不能用于不同的请求
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+}
+
+func idemKey(uid int32, route, key string) string {
+	return fmt.Sprintf("%s:%d:%s:%s", idemKeyPrefix, uid, route, key)
+}
+
+//AcquireIdem 占用幂等键,成功返回true;已存在时返回保存的记录
+func AcquireIdem(ctx context.Context, uid int32, route, key, bodyHash string, lockExpire time.Duration) (bool, *IdemResponse, error) {
+	pending, _ := json.Marshal(&IdemResponse{State: idemStatePend, BodyHash: bodyHash})
+	ok, err := RedisClient.SetNX(ctx, idemKey(uid, route, key), pending, lockExpire).Result()
+	if err != nil {
+		return false, nil, err
+	}
+	if ok {
+		return true, nil, nil
+	}
+	val, err := RedisClient.Get(ctx, idemKey(uid, route, key)).Bytes()
+	if err == redis.Nil {
+		// 刚好过期,交给调用方重试
+		return false, &IdemResponse{State: idemStatePend, BodyHash: bodyHash}, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	var res IdemResponse
+	if err = json.Unmarshal(val, &res); err != nil {
+		return false, nil, err
+	}
+	return false, &res, nil
+}
+
+//SaveIdem 保存首次成功的响应,在expire时间内重放
+func SaveIdem(ctx context.Context, uid int32, route, key string, res *IdemResponse, expire time.Duration) error {
+	res.State = idemStateFinish
+	val, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return RedisClient.Set(ctx, idemKey(uid, route, key), val, expire).Err()
+}
+
+//ReleaseIdem 处理失败时释放幂等键,允许客户端重试
+func ReleaseIdem(ctx context.Context, uid int32, route, key string) error {
+	return RedisClient.Del(ctx, idemKey(uid, route, key)).Err()
+}
+
+//IsPending 首次请求是否仍在处理中
+func (r *IdemResponse) IsPending() bool {
+	return r.State == idemStatePend
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const migrationPrefix = "migration"
+
+//RunOnce 执行一次性的数据迁移,完成后记录标记,多个实例同时启动时只有一个会执行。
+//fn返回错误时不记录标记,下次启动重新执行,fn需要能够重复执行
+func RunOnce(ctx context.Context, name string, lockExpire time.Duration, fn func(ctx context.Context) error) (bool, error) {
+	doneKey := fmt.Sprintf("%s:%s", migrationPrefix, name)
+	lockKey := doneKey + ":lock"
+	done, err := RedisClient.Exists(ctx, doneKey).Result()
+	if err != nil {
+		return false, err
+	}
+	if done > 0 {
+		return false, nil
+	}
+	ok, err := RedisClient.SetNX(ctx, lockKey, time.Now().Unix(), lockExpire).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+	defer RedisClient.Del(context.Background(), lockKey)
+	if err = fn(ctx); err != nil {
+		return false, err
+	}
+	if err = RedisClient.Set(ctx, doneKey, time.Now().Unix(), 0).Err(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,58 @@
+package dispute
+
+import (
+	"errors"
+)
+
+// 纠纷状态
+const (
+	StatusOpen      = "open"
+	StatusResolving = "resolving" //已确定处理结果,正在退款或更新订单
+	StatusResolved  = "resolved"
+)
+
+// 处理结果
+const (
+	ResultFull    = "full"    //全额退还押金
+	ResultPartial = "partial" //部分退还押金
+	ResultReject  = "reject"  //驳回,不退款
+)
+
+var (
+	ErrNotFound  = errors.New("纠纷不存在")
+	ErrExist     = errors.New("该订单已存在未处理的纠纷")
+	ErrClosed    = errors.New("纠纷已处理")
+	ErrResolving = errors.New("纠纷正在处理中,重试时需使用相同的处理结果")
+)
+
+//Dispute 订单纠纷
+type Dispute struct {
+	Id         int64    `json:"id"`
+	Oid        int32    `json:"oid"`
+	Gid        int32    `json:"gid"`
+	BuyId      int32    `json:"buyId"`
+	SellId     int32    `json:"sellId"`
+	Creator    int32    `json:"creator"`
+	Reason     string   `json:"reason"`
+	Evidence   []string `json:"evidence"`
+	Status     string   `json:"status"`
+	Result     string   `json:"result"`
+	Refund     int64    `json:"refund"`
+	RefundId   string   `json:"refundId"`   //退款完成后记录,重试时沿用
+	RefundFrom int64    `json:"refundFrom"` //开始处理前支付单已退款的金额,用于判断上次退款是否已完成
+	Remark     string   `json:"remark"`
+	CreateTime int64    `json:"createTime"`
+	ResolveAt  int64    `json:"resolveAt"`
+}
+
+//Message 纠纷沟通记录
+type Message struct {
+	Uid     int32  `json:"uid"`
+	Content string `json:"content"`
+	Time    int64  `json:"time"`
+}
+
+//IsParty 是否为纠纷当事人
+func (d *Dispute) IsParty(uid int32) bool {
+	return d.BuyId == uid || d.SellId == uid
+}
@@ -0,0 +1,59 @@
+package dispute
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var allowExt = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+
+var ErrEvidenceName = errors.New("不支持的凭证格式")
+
+//SaveEvidence 保存凭证图片,返回保存后的文件名
+func SaveEvidence(dir, name string, content []byte) (string, error) {
+	if err := CheckEvidenceName(name); err != nil {
+		return "", err
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	fileName := hex.EncodeToString(b) + ext
+	if err := os.WriteFile(filepath.Join(dir, fileName), content, 0644); err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+//CheckEvidenceName 保存前校验凭证格式
+func CheckEvidenceName(name string) error {
+	if !allowExt[strings.ToLower(filepath.Ext(name))] {
+		return ErrEvidenceName
+	}
+	return nil
+}
+
+//RemoveEvidence 删除已保存的凭证,用于纠纷创建失败时清理
+func RemoveEvidence(dir string, names []string) {
+	for _, name := range names {
+		if path, err := EvidencePath(dir, name); err == nil {
+			_ = os.Remove(path)
+		}
+	}
+}
+
+//EvidencePath 获取凭证文件路径,拒绝越界的文件名
+func EvidencePath(dir, name string) (string, error) {
+	if name != filepath.Base(name) || !allowExt[strings.ToLower(filepath.Ext(name))] {
+		return "", ErrEvidenceName
+	}
+	return filepath.Join(dir, name), nil
+}
@@ -0,0 +1,250 @@
+package dispute
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	seqKey        = "dispute:seq"
+	openKey       = "dispute:open"
+	keyPrefix     = "dispute:item"
+	orderPrefix   = "dispute:order"
+	userPrefix    = "dispute:user"
+	messagePrefix = "dispute:msg"
+)
+
+func itemKey(id int64) string {
+	return fmt.Sprintf("%s:%d", keyPrefix, id)
+}
+
+func orderKey(oid int32) string {
+	return fmt.Sprintf("%s:%d", orderPrefix, oid)
+}
+
+func userKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", userPrefix, uid)
+}
+
+func messageKey(id int64) string {
+	return fmt.Sprintf("%s:%d", messagePrefix, id)
+}
+
+//Create 创建纠纷,同一订单同时只能有一个未处理纠纷。
+//订单占用与纠纷内容在同一个事务中写入,失败时不会留下占用
+func Create(ctx context.Context, d *Dispute) error {
+	id, err := db.RedisClient.Incr(ctx, seqKey).Result()
+	if err != nil {
+		return err
+	}
+	d.Id = id
+	d.Status = StatusOpen
+	d.CreateTime = time.Now().Unix()
+	val, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	score := float64(d.CreateTime)
+	err = db.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, orderKey(d.Oid)).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrExist
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, orderKey(d.Oid), id, 0)
+			pipe.Set(ctx, itemKey(id), val, 0)
+			pipe.ZAdd(ctx, openKey, &redis.Z{Score: score, Member: id})
+			pipe.ZAdd(ctx, userKey(d.BuyId), &redis.Z{Score: score, Member: id})
+			pipe.ZAdd(ctx, userKey(d.SellId), &redis.Z{Score: score, Member: id})
+			return nil
+		})
+		return err
+	}, orderKey(d.Oid))
+	// 并发创建时另一方已经占用了订单
+	if err == redis.TxFailedErr {
+		return ErrExist
+	}
+	return err
+}
+
+func Get(ctx context.Context, id int64) (*Dispute, error) {
+	val, err := db.RedisClient.Get(ctx, itemKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d Dispute
+	if err = json.Unmarshal(val, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+//Update 在锁内修改纠纷
+func Update(ctx context.Context, id int64, fn func(d *Dispute) error) (*Dispute, error) {
+	var d *Dispute
+	txf := func(tx *redis.Tx) error {
+		val, err := tx.Get(ctx, itemKey(id)).Bytes()
+		if err == redis.Nil {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		d = &Dispute{}
+		if err = json.Unmarshal(val, d); err != nil {
+			return err
+		}
+		if err = fn(d); err != nil {
+			return err
+		}
+		val, err = json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, itemKey(id), val, 0)
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		err := db.RedisClient.Watch(ctx, txf, itemKey(id))
+		if err == redis.TxFailedErr {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		return d, err
+	}
+	return nil, redis.TxFailedErr
+}
+
+//BeginResolve 将未处理的纠纷标记为处理中并记录处理结果。
+//已在处理中时只接受相同的处理结果,返回已记录的纠纷供重试沿用
+func BeginResolve(ctx context.Context, id int64, result string, amount int64, remark string, refundFrom int64) (*Dispute, error) {
+	return Update(ctx, id, func(d *Dispute) error {
+		switch d.Status {
+		case StatusOpen:
+		case StatusResolving:
+			if d.Result != result || (result == ResultPartial && d.Refund != amount) {
+				return ErrResolving
+			}
+			return nil
+		default:
+			return ErrClosed
+		}
+		d.Status = StatusResolving
+		d.Result = result
+		d.Refund = amount
+		d.Remark = remark
+		d.RefundFrom = refundFrom
+		return nil
+	})
+}
+
+//Resolve 记录处理结果,释放订单上的纠纷占用
+func Resolve(ctx context.Context, d *Dispute) error {
+	d.Status = StatusResolved
+	d.ResolveAt = time.Now().Unix()
+	val, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.Set(ctx, itemKey(d.Id), val, 0)
+	pipe.ZRem(ctx, openKey, d.Id)
+	pipe.Del(ctx, orderKey(d.Oid))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//Remove 删除纠纷及订单占用,用于纠纷创建后订单状态更新失败时回滚
+func Remove(ctx context.Context, d *Dispute) error {
+	pipe := db.RedisClient.TxPipeline()
+	pipe.Del(ctx, itemKey(d.Id), messageKey(d.Id))
+	pipe.ZRem(ctx, openKey, d.Id)
+	pipe.ZRem(ctx, userKey(d.BuyId), d.Id)
+	pipe.ZRem(ctx, userKey(d.SellId), d.Id)
+	pipe.Del(ctx, orderKey(d.Oid))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+//ListOpen 按创建时间列出未处理纠纷
+func ListOpen(ctx context.Context, page, count int64) ([]*Dispute, error) {
+	ids, err := db.RedisClient.ZRange(ctx, openKey, page*count, (page+1)*count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return mget(ctx, ids)
+}
+
+//ListUser 列出用户作为买家或卖家参与的纠纷,最新的在前
+func ListUser(ctx context.Context, uid int32) ([]*Dispute, error) {
+	ids, err := db.RedisClient.ZRevRange(ctx, userKey(uid), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return mget(ctx, ids)
+}
+
+func AddMessage(ctx context.Context, id int64, msg *Message) error {
+	val, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return db.RedisClient.RPush(ctx, messageKey(id), val).Err()
+}
+
+func Messages(ctx context.Context, id int64) ([]*Message, error) {
+	vals, err := db.RedisClient.LRange(ctx, messageKey(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Message, 0, len(vals))
+	for _, v := range vals {
+		var msg Message
+		if err = json.Unmarshal([]byte(v), &msg); err != nil {
+			return nil, err
+		}
+		list = append(list, &msg)
+	}
+	return list, nil
+}
+
+func mget(ctx context.Context, ids []string) ([]*Dispute, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, fmt.Sprintf("%s:%s", keyPrefix, id))
+	}
+	vals, err := db.RedisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Dispute, 0, len(vals))
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var d Dispute
+		if err = json.Unmarshal([]byte(s), &d); err != nil {
+			return nil, err
+		}
+		list = append(list, &d)
+	}
+	return list, nil
+}
@@ -0,0 +1,183 @@
+package favorite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	goodsPrefix    = "favorite:goods"
+	folderOfPrefix = "favorite:folderof"
+	countKey       = "favorite:count"
+)
+
+//Favorite 用户收藏的一个物品
+type Favorite struct {
+	Gid        int32 `json:"gid"`
+	Folder     int64 `json:"folder"`
+	CreateTime int64 `json:"createTime"`
+}
+
+var (
+	ErrNotFavorited = errors.New("未收藏该物品")
+)
+
+//goodsKey 用户收藏的物品,score为收藏时间
+func goodsKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", goodsPrefix, uid)
+}
+
+//folderOfKey 物品所在收藏夹
+func folderOfKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", folderOfPrefix, uid)
+}
+
+//Claim 标记收藏物品,已收藏时返回false,不重复计数
+func Claim(ctx context.Context, uid, gid int32, folder int64) (bool, error) {
+	n, err := db.RedisClient.ZAddNX(ctx, goodsKey(uid), &redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: gid,
+	}).Result()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.HSet(ctx, folderOfKey(uid), gid, folder)
+	pipe.HIncrBy(ctx, countKey, strconv.Itoa(int(gid)), 1)
+	if _, err = pipe.Exec(ctx); err != nil {
+		db.RedisClient.ZRem(ctx, goodsKey(uid), gid)
+		return false, err
+	}
+	return true, nil
+}
+
+//Unclaim 取消收藏,未收藏时返回false
+func Unclaim(ctx context.Context, uid, gid int32) (bool, error) {
+	n, err := db.RedisClient.ZRem(ctx, goodsKey(uid), gid).Result()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.HDel(ctx, folderOfKey(uid), strconv.Itoa(int(gid)))
+	pipe.HIncrBy(ctx, countKey, strconv.Itoa(int(gid)), -1)
+	_, err = pipe.Exec(ctx)
+	return true, err
+}
+
+//Move 将已收藏的物品移动到folder
+func Move(ctx context.Context, uid, gid int32, folder int64) error {
+	ok, err := IsFavorited(ctx, uid, gid)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotFavorited
+	}
+	return db.RedisClient.HSet(ctx, folderOfKey(uid), gid, folder).Err()
+}
+
+//IsFavorited 用户是否收藏了物品
+func IsFavorited(ctx context.Context, uid, gid int32) (bool, error) {
+	res, err := Favorited(ctx, uid, []int32{gid})
+	if err != nil {
+		return false, err
+	}
+	return res[gid], nil
+}
+
+//Favorited 批量判断用户是否收藏了物品
+func Favorited(ctx context.Context, uid int32, gids []int32) (map[int32]bool, error) {
+	res := make(map[int32]bool)
+	if uid == 0 || len(gids) == 0 {
+		return res, nil
+	}
+	pipe := db.RedisClient.Pipeline()
+	cmds := make([]*redis.FloatCmd, 0, len(gids))
+	for _, gid := range gids {
+		cmds = append(cmds, pipe.ZScore(ctx, goodsKey(uid), strconv.Itoa(int(gid))))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		if cmd.Err() == nil {
+			res[gids[i]] = true
+		}
+	}
+	return res, nil
+}
+
+//Counts 批量获取物品被收藏次数
+func Counts(ctx context.Context, gids []int32) (map[int32]int64, error) {
+	res := make(map[int32]int64)
+	if len(gids) == 0 {
+		return res, nil
+	}
+	fields := make([]string, 0, len(gids))
+	for _, gid := range gids {
+		fields = append(fields, strconv.Itoa(int(gid)))
+	}
+	vals, err := db.RedisClient.HMGet(ctx, countKey, fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, val := range vals {
+		s, ok := val.(string)
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseInt(s, 10, 64)
+		if n > 0 {
+			res[gids[i]] = n
+		}
+	}
+	return res, nil
+}
+
+//List 获取用户收藏,按收藏时间倒序
+func List(ctx context.Context, uid int32) ([]*Favorite, error) {
+	zs, err := db.RedisClient.ZRevRangeWithScores(ctx, goodsKey(uid), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	folders, err := db.RedisClient.HGetAll(ctx, folderOfKey(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Favorite, 0, len(zs))
+	for _, z := range zs {
+		member, _ := z.Member.(string)
+		gid, err := strconv.Atoi(member)
+		if err != nil {
+			continue
+		}
+		folder, _ := strconv.ParseInt(folders[member], 10, 64)
+		list = append(list, &Favorite{
+			Gid:        int32(gid),
+			Folder:     folder,
+			CreateTime: int64(z.Score),
+		})
+	}
+	return list, nil
+}
+
+//Purge 删除用户的收藏和收藏夹,仍在收藏中的物品收藏数减一
+func Purge(ctx context.Context, uid int32) error {
+	gids, err := db.RedisClient.ZRange(ctx, goodsKey(uid), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	for _, gid := range gids {
+		pipe.HIncrBy(ctx, countKey, gid, -1)
+	}
+	pipe.Del(ctx, goodsKey(uid), folderOfKey(uid), foldersKey(uid), folderSeqKey(uid))
+	_, err = pipe.Exec(ctx)
+	return err
+}
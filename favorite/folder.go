@@ -0,0 +1,155 @@
+package favorite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+)
+
+const (
+	foldersPrefix   = "favorite:folders"
+	folderSeqPrefix = "favorite:folder:seq"
+
+	//DefaultFolder 默认收藏夹,不需要创建也不能删除
+	DefaultFolder     int64 = 0
+	DefaultFolderName       = "默认收藏夹"
+
+	maxFolders    = 50
+	maxFolderName = 32
+)
+
+var (
+	ErrFolderNotFound = errors.New("收藏夹不存在")
+	ErrFolderLimit    = errors.New("收藏夹数量已达上限")
+	ErrFolderName     = errors.New("收藏夹名称不合法")
+)
+
+//Folder 收藏夹
+type Folder struct {
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+func foldersKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", foldersPrefix, uid)
+}
+
+func folderSeqKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", folderSeqPrefix, uid)
+}
+
+func checkName(name string) error {
+	n := len([]rune(name))
+	if n == 0 || n > maxFolderName {
+		return ErrFolderName
+	}
+	return nil
+}
+
+//CreateFolder 新建收藏夹
+func CreateFolder(ctx context.Context, uid int32, name string) (*Folder, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	n, err := db.RedisClient.HLen(ctx, foldersKey(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if n >= maxFolders {
+		return nil, ErrFolderLimit
+	}
+	id, err := db.RedisClient.Incr(ctx, folderSeqKey(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if err = db.RedisClient.HSet(ctx, foldersKey(uid), id, name).Err(); err != nil {
+		return nil, err
+	}
+	return &Folder{Id: id, Name: name}, nil
+}
+
+//RenameFolder 重命名收藏夹
+func RenameFolder(ctx context.Context, uid int32, id int64, name string) error {
+	if id == DefaultFolder {
+		return ErrFolderNotFound
+	}
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := CheckFolder(ctx, uid, id); err != nil {
+		return err
+	}
+	return db.RedisClient.HSet(ctx, foldersKey(uid), id, name).Err()
+}
+
+//DeleteFolder 删除收藏夹,其中的物品移回默认收藏夹
+func DeleteFolder(ctx context.Context, uid int32, id int64) error {
+	if id == DefaultFolder {
+		return ErrFolderNotFound
+	}
+	if err := CheckFolder(ctx, uid, id); err != nil {
+		return err
+	}
+	folders, err := db.RedisClient.HGetAll(ctx, folderOfKey(uid)).Result()
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	for gid, folder := range folders {
+		if folder == strconv.FormatInt(id, 10) {
+			pipe.HSet(ctx, folderOfKey(uid), gid, DefaultFolder)
+		}
+	}
+	pipe.HDel(ctx, foldersKey(uid), strconv.FormatInt(id, 10))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//CheckFolder 收藏夹是否存在
+func CheckFolder(ctx context.Context, uid int32, id int64) error {
+	if id == DefaultFolder {
+		return nil
+	}
+	ok, err := db.RedisClient.HExists(ctx, foldersKey(uid), strconv.FormatInt(id, 10)).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrFolderNotFound
+	}
+	return nil
+}
+
+//Folders 获取用户所有收藏夹及其中物品数量,默认收藏夹在最前
+func Folders(ctx context.Context, uid int32) ([]*Folder, error) {
+	names, err := db.RedisClient.HGetAll(ctx, foldersKey(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	folderOf, err := db.RedisClient.HGetAll(ctx, folderOfKey(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int64)
+	for _, folder := range folderOf {
+		id, _ := strconv.ParseInt(folder, 10, 64)
+		counts[id]++
+	}
+	list := []*Folder{{Id: DefaultFolder, Name: DefaultFolderName, Count: counts[DefaultFolder]}}
+	for field, name := range names {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			continue
+		}
+		list = append(list, &Folder{Id: id, Name: name, Count: counts[id]})
+	}
+	sort.Slice(list[1:], func(i, j int) bool {
+		return list[i+1].Id < list[j+1].Id
+	})
+	return list, nil
+}
@@ -0,0 +1,124 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	maxMessageSize   = 4096
+	authorizeTimeout = 5 * time.Second
+)
+
+//Conn 一个websocket连接
+type Conn struct {
+	hub  *Hub
+	ws   *websocket.Conn
+	uid  int32
+	send chan []byte
+
+	ctx    context.Context //连接断开后取消
+	cancel context.CancelFunc
+
+	done   chan struct{}
+	once   sync.Once
+	reason string
+
+	channels map[string]struct{} //由hub.mu保护
+}
+
+//close 断开连接,由writeLoop告知客户端原因后关闭底层连接
+func (c *Conn) close(reason string) {
+	c.once.Do(func() {
+		c.reason = reason
+		c.cancel()
+		c.hub.unregister(c)
+		close(c.done)
+	})
+}
+
+//push 向连接发送事件,发送缓冲已满时断开连接
+func (c *Conn) push(ev *Event) {
+	val, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	select {
+	case c.send <- val:
+	default:
+		c.close("slow consumer")
+	}
+}
+
+func (c *Conn) readLoop(authorize Authorizer) {
+	c.ws.MaxPayloadBytes = maxMessageSize
+	for {
+		// 两个心跳周期内没有收到任何消息视为断开
+		_ = c.ws.SetReadDeadline(time.Now().Add(2 * c.hub.heartbeat))
+		var cmd command
+		if err := websocket.JSON.Receive(c.ws, &cmd); err != nil {
+			return
+		}
+		switch cmd.Type {
+		case cmdPing:
+			c.push(&Event{Type: EventPong})
+		case cmdPong:
+		case cmdSubscribe:
+			ctx, cancel := context.WithTimeout(c.ctx, authorizeTimeout)
+			err := authorize(ctx, c.uid, cmd.Channel)
+			cancel()
+			if err == nil {
+				err = c.hub.subscribe(c, cmd.Channel)
+			}
+			if err != nil {
+				c.push(&Event{Type: EventError, Channel: cmd.Channel, Data: err.Error()})
+				continue
+			}
+			c.push(&Event{Type: EventSubscribed, Channel: cmd.Channel})
+		case cmdUnsubscribe:
+			if cmd.Channel == UserChannel(c.uid) {
+				continue
+			}
+			c.hub.unsubscribe(c, cmd.Channel)
+			c.push(&Event{Type: EventUnsubscribed, Channel: cmd.Channel})
+		default:
+			c.push(&Event{Type: EventError, Data: "unknown command " + cmd.Type})
+		}
+	}
+}
+
+func (c *Conn) writeLoop() {
+	defer c.hub.wg.Done()
+	ticker := time.NewTicker(c.hub.heartbeat)
+	defer ticker.Stop()
+	defer c.ws.Close()
+
+	for {
+		select {
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				c.close("write error")
+				return
+			}
+		case <-ticker.C:
+			val, _ := json.Marshal(&Event{Type: EventPing, Data: time.Now().Unix()})
+			if err := c.write(val); err != nil {
+				c.close("write error")
+				return
+			}
+		case <-c.done:
+			val, _ := json.Marshal(&Event{Type: EventClose, Data: c.reason})
+			_ = c.write(val)
+			return
+		}
+	}
+}
+
+func (c *Conn) write(msg []byte) error {
+	_ = c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return websocket.Message.Send(c.ws, string(msg))
+}
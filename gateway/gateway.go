@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	channelPrefix = "gateway"
+
+	writeWait = 5 * time.Second
+)
+
+// 事件类型
+const (
+	EventPing         = "ping"
+	EventPong         = "pong"
+	EventSubscribed   = "subscribed"
+	EventUnsubscribed = "unsubscribed"
+	EventError        = "error"
+	EventClose        = "close"
+)
+
+// 客户端指令
+const (
+	cmdPing        = "ping"
+	cmdPong        = "pong"
+	cmdSubscribe   = "subscribe"
+	cmdUnsubscribe = "unsubscribe"
+)
+
+var (
+	ErrClosed       = errors.New("gateway已关闭")
+	ErrChannelLimit = errors.New("订阅频道数量已达上限")
+)
+
+//Event 推送给客户端的事件
+type Event struct {
+	Type    string      `json:"type"`
+	Channel string      `json:"channel,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+//command 客户端发送的指令
+type command struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+}
+
+//Authorizer 校验用户能否订阅频道
+type Authorizer func(ctx context.Context, uid int32, channel string) error
+
+//UserChannel 用户私有频道,连接建立后自动订阅
+func UserChannel(uid int32) string {
+	return fmt.Sprintf("user:%d", uid)
+}
+
+//OrderChannel 订单频道,订单双方可以订阅
+func OrderChannel(oid int32) string {
+	return fmt.Sprintf("order:%d", oid)
+}
+
+//Hub 管理本实例的连接,通过redis pub/sub接收所有实例发布的事件
+type Hub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*Conn]struct{}
+	conns    map[*Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+
+	pubsub      *redis.PubSub
+	heartbeat   time.Duration
+	sendBuffer  int
+	maxChannels int
+	gauge       prometheus.Gauge
+}
+
+var Default *Hub
+
+func Init() {
+	Default = NewHub(misc.Conf.Gateway)
+	Default.gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   misc.NAMESPACE,
+		Name:        "gateway_connections",
+		Help:        "Number of open websocket connections",
+		ConstLabels: prometheus.Labels{misc.ServiceName: misc.SERVICE},
+	})
+	prometheus.MustRegister(Default.gauge)
+	go Default.run()
+}
+
+func NewHub(cfg misc.GatewayConf) *Hub {
+	h := &Hub{
+		channels:    make(map[string]map[*Conn]struct{}),
+		conns:       make(map[*Conn]struct{}),
+		heartbeat:   time.Duration(cfg.Heartbeat) * time.Second,
+		sendBuffer:  cfg.SendBuffer,
+		maxChannels: cfg.MaxChannels,
+	}
+	if h.heartbeat <= 0 {
+		h.heartbeat = 30 * time.Second
+	}
+	if h.sendBuffer <= 0 {
+		h.sendBuffer = 64
+	}
+	if h.maxChannels <= 0 {
+		h.maxChannels = 32
+	}
+	h.pubsub = db.RedisClient.PSubscribe(context.Background(), channelPrefix+":*")
+	return h
+}
+
+//Publish 向频道发布事件,所有实例上订阅了该频道的连接都会收到
+func Publish(ctx context.Context, channel string, ev *Event) error {
+	ev.Channel = channel
+	val, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return db.RedisClient.Publish(ctx, channelPrefix+":"+channel, val).Err()
+}
+
+func (h *Hub) run() {
+	for msg := range h.pubsub.Channel() {
+		h.dispatch(strings.TrimPrefix(msg.Channel, channelPrefix+":"), []byte(msg.Payload))
+	}
+}
+
+//dispatch 投递到本实例订阅了频道的连接,发送缓冲已满的连接会被断开
+func (h *Hub) dispatch(channel string, payload []byte) {
+	var slow []*Conn
+	h.mu.RLock()
+	for c := range h.channels[channel] {
+		select {
+		case c.send <- payload:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.mu.RUnlock()
+	for _, c := range slow {
+		misc.Logger.Warn("gateway close slow consumer", zap.Int32("uid", c.uid), zap.String("channel", channel))
+		c.close("slow consumer")
+	}
+}
+
+//Serve 处理一个websocket连接,直到连接断开
+func (h *Hub) Serve(ws *websocket.Conn, uid int32, authorize Authorizer) {
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	c := &Conn{
+		hub:      h,
+		ws:       ws,
+		uid:      uid,
+		send:     make(chan []byte, h.sendBuffer),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		channels: make(map[string]struct{}),
+	}
+	if err := h.register(c); err != nil {
+		cancel()
+		_ = ws.Close()
+		return
+	}
+	_ = h.subscribe(c, UserChannel(uid))
+	go c.writeLoop()
+	c.readLoop(authorize)
+	c.close("client closed")
+}
+
+//Close 关闭所有连接,等待告知客户端后返回
+func (h *Hub) Close() {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	conns := make([]*Conn, 0, len(h.conns))
+	for c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.mu.Unlock()
+
+	_ = h.pubsub.Close()
+	for _, c := range conns {
+		c.close("server shutdown")
+	}
+	h.wg.Wait()
+}
+
+func (h *Hub) register(c *Conn) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+	h.conns[c] = struct{}{}
+	h.wg.Add(1)
+	if h.gauge != nil {
+		h.gauge.Inc()
+	}
+	return nil
+}
+
+func (h *Hub) unregister(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.conns[c]; !ok {
+		return
+	}
+	for channel := range c.channels {
+		h.removeLocked(c, channel)
+	}
+	delete(h.conns, c)
+	if h.gauge != nil {
+		h.gauge.Dec()
+	}
+}
+
+func (h *Hub) subscribe(c *Conn, channel string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := c.channels[channel]; ok {
+		return nil
+	}
+	if len(c.channels) >= h.maxChannels {
+		return ErrChannelLimit
+	}
+	conns, ok := h.channels[channel]
+	if !ok {
+		conns = make(map[*Conn]struct{})
+		h.channels[channel] = conns
+	}
+	conns[c] = struct{}{}
+	c.channels[channel] = struct{}{}
+	return nil
+}
+
+func (h *Hub) unsubscribe(c *Conn, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(c, channel)
+}
+
+func (h *Hub) removeLocked(c *Conn, channel string) {
+	delete(c.channels, channel)
+	if conns, ok := h.channels[channel]; ok {
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(h.channels, channel)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//FileMailer 本地开发使用,将邮件保存为.eml文件
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	if dir == "" {
+		dir = "./outbox"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, mail *Mail) error {
+	to := strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(mail.To)
+	name := fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), to)
+	return os.WriteFile(filepath.Join(m.dir, name), message(m.from, mail), 0644)
+}
+
+//MemoryMailer 将邮件保存在内存中,用于测试
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []*Mail
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, mail *Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cp := *mail
+	m.sent = append(m.sent, &cp)
+	return nil
+}
+
+//Sent 已发送的邮件
+func (m *MemoryMailer) Sent() []*Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*Mail, len(m.sent))
+	copy(list, m.sent)
+	return list
+}
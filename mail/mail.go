@@ -0,0 +1,49 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dopamine-joker/zu_web_server/misc"
+)
+
+const (
+	DriverSMTP   = "smtp"
+	DriverFile   = "file"
+	DriverMemory = "memory"
+)
+
+//Mail 一封纯文本邮件
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+//Mailer 邮件发送
+type Mailer interface {
+	Send(ctx context.Context, m *Mail) error
+}
+
+var Default Mailer
+
+func Init() {
+	var err error
+	Default, err = NewMailer(misc.Conf.Mail)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func NewMailer(cfg misc.MailConf) (Mailer, error) {
+	switch cfg.Driver {
+	case DriverSMTP:
+		return NewSMTPMailer(cfg.Host, cfg.Port, cfg.Username, cfg.Password, cfg.From), nil
+	case DriverFile, "":
+		return NewFileMailer(cfg.Dir, cfg.From)
+	case DriverMemory:
+		return NewMemoryMailer(), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %s", cfg.Driver)
+	}
+}
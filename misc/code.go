@@ -6,7 +6,12 @@ const (
 	CodeFail         = 1
 	CodeUnknownError = -1
 	CodeTokenError   = 400
+	CodeNoPermission = 401
+	CodeSuspended    = 402
 	CodeAPILimit     = 403
+	CodeConflict     = 409
+	CodeSmsRequired  = 410
+	CodeTotpRequired = 411
 )
 
 //MsgCodeMap 默认错误码对应信息
@@ -15,4 +20,9 @@ var MsgCodeMap = map[int]string{
 	CodeFail:         "fail",
 	CodeUnknownError: "unknown error",
 	CodeTokenError:   "Token error",
+	CodeNoPermission: "permission denied",
+	CodeSuspended:    "account suspended",
+	CodeConflict:     "request conflict",
+	CodeSmsRequired:  "sms code required",
+	CodeTotpRequired: "totp code required",
 }
@@ -16,18 +16,44 @@ func Init() {
 	viper.SetConfigType("toml")
 	viper.SetConfigName("config_local")
 	viper.AddConfigPath("./config")
+	// 未配置时默认要求学校认证,没有校园邮箱的部署需要显式关闭
+	viper.SetDefault("campus.required", true)
 	if err = viper.ReadInConfig(); err != nil {
 		panic(err)
 	}
 	if err = viper.Unmarshal(&Conf); err != nil {
 		panic(err)
 	}
+	initSecrets()
+	initRedact()
 	initLogger()
 	initKey()
 	initJaeger()
 	db.InitRedis(Conf.RedisCfg.Address, Conf.RedisCfg.Port, Conf.RedisCfg.Password, Conf.RedisCfg.Db)
 }
 
+//initSecrets 签名密钥不写在仓库的配置文件中,配置为空时从环境变量读取,仍为空时拒绝启动
+func initSecrets() {
+	if Conf.PayCfg.Secret == "" {
+		Conf.PayCfg.Secret = os.Getenv("PAYMENT_SECRET")
+	}
+	if Conf.PayCfg.Secret == "" {
+		panic("payment.secret is empty, set it in config or PAYMENT_SECRET")
+	}
+	if Conf.Account.Secret == "" {
+		Conf.Account.Secret = os.Getenv("ACCOUNT_SECRET")
+	}
+	if Conf.Account.Secret == "" {
+		panic("account.secret is empty, set it in config or ACCOUNT_SECRET")
+	}
+	if Conf.Otp.Secret == "" {
+		Conf.Otp.Secret = os.Getenv("OTP_SECRET")
+	}
+	if Conf.Otp.Secret == "" {
+		panic("otp.secret is empty, set it in config or OTP_SECRET")
+	}
+}
+
 func initKey() {
 	Key = os.Getenv("KEY")
 }
@@ -21,5 +21,10 @@ func initLogger() {
 		zap.DebugLevel,
 	)
 
-	Logger = zap.New(core, zap.AddCaller())
+	Logger = NewLogger(core)
+}
+
+//NewLogger 写入core前按Redact配置脱敏
+func NewLogger(core zapcore.Core) *zap.Logger {
+	return zap.New(newRedactCore(core, Redact), zap.AddCaller())
 }
@@ -0,0 +1,203 @@
+package misc
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	redactMask = "******"
+)
+
+// 未配置时默认脱敏的字段
+var defaultRedactFields = []string{"password", "pwd", "token", "sig", "phone", "email"}
+
+var Redact *Redactor
+
+//Redactor 按字段名对日志字段和span属性脱敏,字段名包含任一配置项即视为敏感
+type Redactor struct {
+	fields []string
+}
+
+func NewRedactor(fields []string) *Redactor {
+	if len(fields) == 0 {
+		fields = defaultRedactFields
+	}
+	r := &Redactor{}
+	for _, f := range fields {
+		r.fields = append(r.fields, strings.ToLower(f))
+	}
+	return r
+}
+
+func initRedact() {
+	Redact = NewRedactor(Conf.Redact.Fields)
+}
+
+//Sensitive 字段名是否需要脱敏
+func (r *Redactor) Sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, f := range r.fields {
+		if strings.Contains(key, f) {
+			return true
+		}
+	}
+	return false
+}
+
+//Mask 手机号和邮箱保留部分内容便于排查,其余敏感值全部隐藏
+func (r *Redactor) Mask(key, val string) string {
+	key = strings.ToLower(key)
+	switch {
+	case val == "":
+		return val
+	case strings.Contains(key, "phone") && len(val) >= 7:
+		return val[:3] + "****" + val[len(val)-4:]
+	case strings.Contains(key, "email") && strings.Contains(val, "@"):
+		at := strings.LastIndex(val, "@")
+		if at == 0 {
+			return redactMask + val[at:]
+		}
+		return val[:1] + "***" + val[at:]
+	default:
+		return redactMask
+	}
+}
+
+//Field 脱敏单个zap字段,非字符串类型的敏感字段整体替换
+func (r *Redactor) Field(f zapcore.Field) zapcore.Field {
+	if !r.Sensitive(f.Key) {
+		return f
+	}
+	switch f.Type {
+	case zapcore.StringType:
+		return zap.String(f.Key, r.Mask(f.Key, f.String))
+	case zapcore.BoolType, zapcore.Int64Type, zapcore.Int32Type, zapcore.Int16Type, zapcore.Int8Type,
+		zapcore.Uint64Type, zapcore.Uint32Type, zapcore.Uint16Type, zapcore.Uint8Type,
+		zapcore.DurationType, zapcore.TimeType, zapcore.TimeFullType:
+		return f
+	default:
+		return zap.String(f.Key, redactMask)
+	}
+}
+
+func (r *Redactor) Fields(fs []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fs))
+	for i, f := range fs {
+		out[i] = r.Field(f)
+	}
+	return out
+}
+
+//Attribute 脱敏单个span属性
+func (r *Redactor) Attribute(kv attribute.KeyValue) attribute.KeyValue {
+	key := string(kv.Key)
+	if !r.Sensitive(key) {
+		// otelgin记录的http.target/http.url带有query参数,SSE和WebSocket的token就在其中
+		if kv.Value.Type() == attribute.STRING && (strings.HasSuffix(key, "target") || strings.HasSuffix(key, "url")) {
+			return kv.Key.String(r.maskQuery(kv.Value.AsString()))
+		}
+		return kv
+	}
+	switch kv.Value.Type() {
+	case attribute.STRING:
+		return kv.Key.String(r.Mask(key, kv.Value.AsString()))
+	case attribute.STRINGSLICE:
+		list := kv.Value.AsStringSlice()
+		masked := make([]string, len(list))
+		for i, v := range list {
+			masked[i] = r.Mask(key, v)
+		}
+		return kv.Key.StringSlice(masked)
+	default:
+		return kv
+	}
+}
+
+//maskQuery 脱敏地址中的敏感query参数
+func (r *Redactor) maskQuery(raw string) string {
+	i := strings.Index(raw, "?")
+	if i < 0 {
+		return raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw[:i]
+	}
+	q := u.Query()
+	for k, vs := range q {
+		if r.Sensitive(k) {
+			for j := range vs {
+				vs[j] = r.Mask(k, vs[j])
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (r *Redactor) Attributes(kvs []attribute.KeyValue) []attribute.KeyValue {
+	out := make([]attribute.KeyValue, len(kvs))
+	for i, kv := range kvs {
+		out[i] = r.Attribute(kv)
+	}
+	return out
+}
+
+//redactCore 写入前脱敏的zap core
+type redactCore struct {
+	zapcore.Core
+	r *Redactor
+}
+
+func newRedactCore(core zapcore.Core, r *Redactor) zapcore.Core {
+	return &redactCore{Core: core, r: r}
+}
+
+func (c *redactCore) With(fs []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(c.r.Fields(fs)), r: c.r}
+}
+
+func (c *redactCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactCore) Write(ent zapcore.Entry, fs []zapcore.Field) error {
+	return c.Core.Write(ent, c.r.Fields(fs))
+}
+
+//redactExporter 导出前脱敏span属性
+type redactExporter struct {
+	tracesdk.SpanExporter
+	r *Redactor
+}
+
+func newRedactExporter(exp tracesdk.SpanExporter, r *Redactor) tracesdk.SpanExporter {
+	return &redactExporter{SpanExporter: exp, r: r}
+}
+
+func (e *redactExporter) ExportSpans(ctx context.Context, spans []tracesdk.ReadOnlySpan) error {
+	redacted := make([]tracesdk.ReadOnlySpan, len(spans))
+	for i, s := range spans {
+		redacted[i] = &redactSpan{ReadOnlySpan: s, attrs: e.r.Attributes(s.Attributes())}
+	}
+	return e.SpanExporter.ExportSpans(ctx, redacted)
+}
+
+type redactSpan struct {
+	tracesdk.ReadOnlySpan
+	attrs []attribute.KeyValue
+}
+
+func (s *redactSpan) Attributes() []attribute.KeyValue {
+	return s.attrs
+}
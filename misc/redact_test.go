@@ -0,0 +1,97 @@
+package misc
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+//canaries 每个敏感字段的样例值,默认字段始终参与检查,配置中漏掉它们时同样报错
+func canaries(r *Redactor) map[string]string {
+	res := make(map[string]string)
+	for _, f := range append(defaultRedactFields, r.fields...) {
+		switch {
+		case strings.Contains(f, "phone"):
+			res[f] = "13812345678"
+		case strings.Contains(f, "email"):
+			res[f] = "redact-canary@example.com"
+		default:
+			res[f] = "redact-canary-" + f
+		}
+	}
+	return res
+}
+
+func TestRedactLogFields(t *testing.T) {
+	r := NewRedactor(nil)
+	values := canaries(r)
+
+	buf := &bytes.Buffer{}
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(buf), zap.DebugLevel)
+	logger := zap.New(newRedactCore(core, r))
+	for f, v := range values {
+		logger.Info("redaction check", zap.String(f, v), zap.Any(f+"Any", v), zap.Strings(f+"List", []string{v}))
+		logger.With(zap.String(f, v)).Info("redaction check with")
+	}
+	_ = logger.Sync()
+	for f, v := range values {
+		if strings.Contains(buf.String(), v) {
+			t.Errorf("log field %s is not redacted", f)
+		}
+	}
+}
+
+func TestRedactSpanAttributes(t *testing.T) {
+	r := NewRedactor(nil)
+	values := canaries(r)
+
+	mem := tracetest.NewInMemoryExporter()
+	tp := tracesdk.NewTracerProvider(tracesdk.WithSyncer(newRedactExporter(mem, r)))
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+	_, span := tp.Tracer("redaction-check").Start(context.Background(), "redaction check")
+	query := url.Values{}
+	for f, v := range values {
+		span.SetAttributes(attribute.String(f, v), attribute.StringSlice(f+"List", []string{v}))
+		query.Set(f, v)
+	}
+	span.SetAttributes(attribute.String("http.target", "/ws?"+query.Encode()))
+	span.End()
+	for _, s := range mem.GetSpans() {
+		for _, kv := range s.Attributes {
+			for f, v := range values {
+				if strings.Contains(kv.Value.Emit(), v) || strings.Contains(kv.Value.Emit(), url.QueryEscape(v)) {
+					t.Errorf("span attribute %s is not redacted: %s", f, kv.Value.Emit())
+				}
+			}
+		}
+	}
+}
+
+func TestMask(t *testing.T) {
+	r := NewRedactor(nil)
+	cases := []struct {
+		key, val, want string
+	}{
+		{"phone", "13812345678", "138****5678"},
+		{"email", "alice@example.com", "a***@example.com"},
+		{"password", "secret", redactMask},
+		{"name", "alice", "alice"},
+	}
+	for _, c := range cases {
+		got := c.val
+		if r.Sensitive(c.key) {
+			got = r.Mask(c.key, c.val)
+		}
+		if got != c.want {
+			t.Errorf("mask %s=%s got %s, want %s", c.key, c.val, got, c.want)
+		}
+	}
+}
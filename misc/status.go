@@ -0,0 +1,12 @@
+package misc
+
+// 订单状态,与logic服务保持一致
+const (
+	OrderStatusCreated  = 1 //待卖家确认
+	OrderStatusAccepted = 2 //卖家已确认,租借中
+	OrderStatusFinished = 3 //已归还,订单完成
+	OrderStatusCanceled = 4 //已取消
+	OrderStatusPaid     = 5 //买家已支付
+	OrderStatusRefunded = 6 //已退款
+	OrderStatusDisputed = 7 //纠纷处理中
+)
@@ -1,10 +1,26 @@
 package misc
 
 type Config struct {
-	RedisCfg  RedisConfig  `mapstructure:"redis"`
-	Api       ApiConfig    `mapstructure:"api"`
-	EtcdCfg   EtcdConfig   `mapstructure:"etcd"`
-	JaegerCfg JaegerConfig `mapstructure:"jaeger"`
+	RedisCfg   RedisConfig    `mapstructure:"redis"`
+	Api        ApiConfig      `mapstructure:"api"`
+	EtcdCfg    EtcdConfig     `mapstructure:"etcd"`
+	JaegerCfg  JaegerConfig   `mapstructure:"jaeger"`
+	IdemCfg    IdemConfig     `mapstructure:"idempotency"`
+	PayCfg     PayConfig      `mapstructure:"payment"`
+	Dispute    DisputeConf    `mapstructure:"dispute"`
+	AdminCfg   AdminConfig    `mapstructure:"admin"`
+	Comment    CommentConf    `mapstructure:"comment"`
+	Rating     RatingConf     `mapstructure:"rating"`
+	Moderation ModerationConf `mapstructure:"moderation"`
+	Gateway    GatewayConf    `mapstructure:"gateway"`
+	Mail       MailConf       `mapstructure:"mail"`
+	Account    AccountConf    `mapstructure:"account"`
+	Campus     CampusConf     `mapstructure:"campus"`
+	Sms        SmsConf        `mapstructure:"sms"`
+	Otp        OtpConf        `mapstructure:"otp"`
+	Totp       TotpConf       `mapstructure:"totp"`
+	Redact     RedactConf     `mapstructure:"redact"`
+	Schools    []SchoolConf   `mapstructure:"school"`
 }
 
 type RedisConfig struct {
@@ -30,3 +46,122 @@ type JaegerConfig struct {
 	Host   string `mapstructure:"host"`
 	Path   string `mapstructure:"path"`
 }
+
+type IdemConfig struct {
+	Expire     int `mapstructure:"expire"`     //响应保存时间,单位秒
+	LockExpire int `mapstructure:"lockExpire"` //处理中状态的最长持有时间,单位秒
+}
+
+type PayConfig struct {
+	Provider  string `mapstructure:"provider"`  //支付渠道,目前支持mock
+	Secret    string `mapstructure:"secret"`    //回调签名密钥
+	NotifyUrl string `mapstructure:"notifyUrl"` //支付回调地址
+	Expire    int    `mapstructure:"expire"`    //支付单有效期,单位秒
+	Tolerance int    `mapstructure:"tolerance"` //回调时间戳允许误差,单位秒
+}
+
+type DisputeConf struct {
+	EvidenceDir string `mapstructure:"evidenceDir"` //凭证图片保存目录
+	MaxEvidence int    `mapstructure:"maxEvidence"` //单次最多上传凭证数
+}
+
+type AdminConfig struct {
+	Uids []int32 `mapstructure:"uids"`
+}
+
+type CommentConf struct {
+	EditWindow int `mapstructure:"editWindow"` //评价可修改时间,单位秒
+}
+
+type RatingConf struct {
+	HalfLife    int     `mapstructure:"halfLife"`    //评价权重半衰期,单位天
+	PriorMean   float64 `mapstructure:"priorMean"`   //信誉先验均分
+	PriorWeight float64 `mapstructure:"priorWeight"` //先验相当于多少条评价
+}
+
+type ModerationConf struct {
+	ContactAction string     `mapstructure:"contactAction"` //链接、手机号的处理方式
+	SpamAction    string     `mapstructure:"spamAction"`    //灌水内容的处理方式
+	MaxRepeat     int        `mapstructure:"maxRepeat"`     //允许连续重复的字符数
+	QueueExpire   int        `mapstructure:"queueExpire"`   //待审核内容保留时间,单位秒
+	Dicts         []DictConf `mapstructure:"dict"`
+}
+
+type DictConf struct {
+	Name   string `mapstructure:"name"`
+	Path   string `mapstructure:"path"`
+	Action string `mapstructure:"action"` //pass,mask,review,reject
+}
+
+type GatewayConf struct {
+	Heartbeat   int      `mapstructure:"heartbeat"`   //心跳间隔,单位秒
+	SendBuffer  int      `mapstructure:"sendBuffer"`  //每个连接的发送缓冲,写满时断开慢连接
+	MaxChannels int      `mapstructure:"maxChannels"` //每个连接最多订阅的频道数
+	Origins     []string `mapstructure:"origins"`     //允许建立连接的网页来源,为空时只允许同域
+}
+
+type MailConf struct {
+	Driver   string `mapstructure:"driver"` //smtp,file,memory
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	From     string `mapstructure:"from"`
+	Dir      string `mapstructure:"dir"` //file驱动保存邮件的目录
+}
+
+type AccountConf struct {
+	Secret         string `mapstructure:"secret"`         //邮件链接token的签名密钥
+	VerifyUrl      string `mapstructure:"verifyUrl"`      //邮箱验证页面地址
+	ResetUrl       string `mapstructure:"resetUrl"`       //重置密码页面地址
+	ChangeEmailUrl string `mapstructure:"changeEmailUrl"` //更换邮箱确认页面地址
+	VerifyExpire   int    `mapstructure:"verifyExpire"`   //验证链接有效期,单位秒
+	ResetExpire    int    `mapstructure:"resetExpire"`    //重置链接有效期,单位秒
+	ResendInterval int    `mapstructure:"resendInterval"` //两次发送的最小间隔,单位秒
+	DailyLimit     int    `mapstructure:"dailyLimit"`     //每天最多发送次数
+	DeleteGrace    int    `mapstructure:"deleteGrace"`    //申请注销后的宽限期,单位秒
+	ExportInterval int    `mapstructure:"exportInterval"` //两次导出数据的最小间隔,单位秒
+}
+
+type CampusConf struct {
+	Required    bool `mapstructure:"required"`    //发布物品和下单是否要求通过学校认证,默认开启
+	CodeExpire  int  `mapstructure:"codeExpire"`  //验证码有效期,单位秒
+	MaxAttempts int  `mapstructure:"maxAttempts"` //验证码最多尝试次数
+}
+
+type SchoolConf struct {
+	Id       int32    `mapstructure:"id"`
+	Name     string   `mapstructure:"name"`
+	Aliases  []string `mapstructure:"aliases"` //简称、英文名等,统一规范为name
+	Province string   `mapstructure:"province"`
+	City     string   `mapstructure:"city"`
+	Domains  []string `mapstructure:"domains"` //学校邮箱域名,包含子域名
+}
+
+type SmsConf struct {
+	Driver string `mapstructure:"driver"` //log
+}
+
+type OtpConf struct {
+	Length      int    `mapstructure:"length"`      //验证码位数
+	Expire      int    `mapstructure:"expire"`      //验证码有效期,单位秒
+	Cooldown    int    `mapstructure:"cooldown"`    //两次发送的最小间隔,单位秒
+	DailyLimit  int    `mapstructure:"dailyLimit"`  //每天最多发送次数
+	MaxAttempts int    `mapstructure:"maxAttempts"` //最多输错次数
+	Secret      string `mapstructure:"secret"`      //验证码摘要的签名密钥
+}
+
+type TotpConf struct {
+	Issuer          string `mapstructure:"issuer"`          //验证器App中显示的名称
+	Skew            int    `mapstructure:"skew"`            //允许前后误差的时间窗口数
+	EnrollExpire    int    `mapstructure:"enrollExpire"`    //未确认密钥的有效期,单位秒
+	ChallengeExpire int    `mapstructure:"challengeExpire"` //登录challenge的有效期,单位秒
+	MaxAttempts     int    `mapstructure:"maxAttempts"`     //每个challenge最多输错次数
+	MaxFailures     int    `mapstructure:"maxFailures"`     //每个用户在锁定窗口内最多输错次数,包括所有challenge和账号内操作
+	Lockout         int    `mapstructure:"lockout"`         //锁定窗口,最后一次输错后开始计算,单位秒
+	RecoveryCodes   int    `mapstructure:"recoveryCodes"`   //恢复码数量
+}
+
+type RedactConf struct {
+	Fields []string `mapstructure:"fields"` //日志字段和span属性名包含这些词时脱敏
+}
@@ -0,0 +1,126 @@
+package moderation
+
+import (
+	"fmt"
+	"regexp"
+	"unicode"
+)
+
+//Action 审核动作,数值越大越严格
+type Action int
+
+const (
+	ActionPass Action = iota
+	ActionMask
+	ActionReview
+	ActionReject
+)
+
+var actionNames = map[Action]string{
+	ActionPass:   "pass",
+	ActionMask:   "mask",
+	ActionReview: "review",
+	ActionReject: "reject",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+//ParseAction 解析配置中的动作名
+func ParseAction(name string) (Action, error) {
+	for a, n := range actionNames {
+		if n == name {
+			return a, nil
+		}
+	}
+	return ActionPass, fmt.Errorf("unknown moderation action %s", name)
+}
+
+//Hit 检查命中结果,Spans为需要打码的区间
+type Hit struct {
+	Action Action
+	Reason string
+	Spans  [][2]int
+}
+
+//Checker 单项内容检查
+type Checker interface {
+	Check(text []rune) []Hit
+}
+
+//WordChecker 敏感词检查
+type WordChecker struct {
+	Name   string
+	Trie   *Trie
+	Action Action
+}
+
+func (w *WordChecker) Check(text []rune) []Hit {
+	spans := w.Trie.Match(text)
+	if len(spans) == 0 {
+		return nil
+	}
+	return []Hit{{Action: w.Action, Reason: "word:" + w.Name, Spans: spans}}
+}
+
+var (
+	urlRegexp   = regexp.MustCompile(`(?i)(https?://|www\.)[^\s]+|[a-z0-9-]+\.(com|cn|net|org|top|xyz|cc)\b[^\s]*`)
+	phoneRegexp = regexp.MustCompile(`(?:\+?86[- ]?)?1[3-9]\d[- ]?\d{4}[- ]?\d{4}`)
+)
+
+//ContactChecker 检测链接和手机号,防止绕过平台交易
+type ContactChecker struct {
+	Action Action
+}
+
+func (c *ContactChecker) Check(text []rune) []Hit {
+	var hits []Hit
+	s := string(text)
+	for reason, re := range map[string]*regexp.Regexp{"url": urlRegexp, "phone": phoneRegexp} {
+		locs := re.FindAllStringIndex(s, -1)
+		if len(locs) == 0 {
+			continue
+		}
+		spans := make([][2]int, 0, len(locs))
+		for _, loc := range locs {
+			spans = append(spans, [2]int{runeIndex(s, loc[0]), runeIndex(s, loc[1])})
+		}
+		hits = append(hits, Hit{Action: c.Action, Reason: reason, Spans: spans})
+	}
+	return hits
+}
+
+//SpamChecker 简单的灌水判断:连续重复字符过多或有效字符占比过低
+type SpamChecker struct {
+	Action    Action
+	MaxRepeat int
+}
+
+func (c *SpamChecker) Check(text []rune) []Hit {
+	if len(text) == 0 {
+		return nil
+	}
+	repeat, valid := 1, 0
+	for i, r := range text {
+		if i > 0 && r == text[i-1] && !unicode.IsSpace(r) {
+			repeat++
+			if c.MaxRepeat > 0 && repeat > c.MaxRepeat {
+				return []Hit{{Action: c.Action, Reason: "spam:repeat"}}
+			}
+		} else {
+			repeat = 1
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			valid++
+		}
+	}
+	if len(text) >= 10 && valid*3 < len(text) {
+		return []Hit{{Action: c.Action, Reason: "spam:symbol"}}
+	}
+	return nil
+}
+
+func runeIndex(s string, byteIndex int) int {
+	return len([]rune(s[:byteIndex]))
+}
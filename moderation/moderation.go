@@ -0,0 +1,135 @@
+package moderation
+
+import (
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	KindComment = "comment"
+	KindGoods   = "goods"
+	KindReply   = "reply"
+	KindMessage = "message"
+
+	maskRune = '*'
+)
+
+//Result 审核结果,Text为打码后的内容
+type Result struct {
+	Action  Action
+	Text    string
+	Reasons []string
+}
+
+//Pipeline 依次执行所有检查,取最严格的动作
+type Pipeline struct {
+	checkers []Checker
+	counter  *prometheus.CounterVec
+}
+
+var Default *Pipeline
+
+func NewPipeline(checkers ...Checker) *Pipeline {
+	return &Pipeline{checkers: checkers}
+}
+
+func Init() {
+	cfg := misc.Conf.Moderation
+	var checkers []Checker
+	for _, dict := range cfg.Dicts {
+		action, err := ParseAction(dict.Action)
+		if err != nil {
+			panic(err)
+		}
+		trie := NewTrie()
+		if err = trie.LoadFile(dict.Path); err != nil {
+			misc.Logger.Error("load moderation dict err", zap.String("path", dict.Path), zap.Error(err))
+			panic(err)
+		}
+		checkers = append(checkers, &WordChecker{Name: dict.Name, Trie: trie, Action: action})
+	}
+	contactAction, err := ParseAction(cfg.ContactAction)
+	if err != nil {
+		panic(err)
+	}
+	spamAction, err := ParseAction(cfg.SpamAction)
+	if err != nil {
+		panic(err)
+	}
+	checkers = append(checkers,
+		&ContactChecker{Action: contactAction},
+		&SpamChecker{Action: spamAction, MaxRepeat: cfg.MaxRepeat},
+	)
+	Default = NewPipeline(checkers...)
+	Default.counter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: misc.NAMESPACE,
+			Name:      "moderation_result_count",
+			Help:      "A counter for content moderation results",
+		},
+		[]string{"kind", "action", misc.ServiceName},
+	)
+	prometheus.MustRegister(Default.counter)
+}
+
+//Check 审核一段文本
+func (p *Pipeline) Check(kind, text string) *Result {
+	res := p.check(text)
+	p.observe(kind, res.Action)
+	return res
+}
+
+//CheckAll 审核多段文本,返回最严格的动作、打码后的文本和命中原因
+func (p *Pipeline) CheckAll(kind string, texts ...string) (Action, []string, []string) {
+	action := ActionPass
+	var masked, reasons []string
+	for _, text := range texts {
+		res := p.check(text)
+		if res.Action > action {
+			action = res.Action
+		}
+		masked = append(masked, res.Text)
+		reasons = append(reasons, res.Reasons...)
+	}
+	p.observe(kind, action)
+	return action, masked, reasons
+}
+
+func (p *Pipeline) observe(kind string, action Action) {
+	if p.counter != nil {
+		p.counter.WithLabelValues(kind, action.String(), misc.SERVICE).Inc()
+	}
+}
+
+func (p *Pipeline) check(text string) *Result {
+	runes := []rune(text)
+	res := &Result{Action: ActionPass}
+	mask := make([]bool, len(runes))
+	for _, checker := range p.checkers {
+		for _, hit := range checker.Check(runes) {
+			if hit.Action == ActionPass {
+				continue
+			}
+			if hit.Action > res.Action {
+				res.Action = hit.Action
+			}
+			res.Reasons = append(res.Reasons, hit.Reason)
+			if hit.Action != ActionMask {
+				continue
+			}
+			for _, span := range hit.Spans {
+				for i := span[0]; i < span[1] && i < len(mask); i++ {
+					mask[i] = true
+				}
+			}
+		}
+	}
+	for i := range runes {
+		if mask[i] {
+			runes[i] = maskRune
+		}
+	}
+	res.Text = string(runes)
+	return res
+}
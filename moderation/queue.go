@@ -0,0 +1,135 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	queueSeqKey = "moderation:seq"
+	queueKey    = "moderation:queue"
+	itemPrefix  = "moderation:item"
+	claimPrefix = "moderation:claim"
+)
+
+var (
+	ErrItemNotFound = errors.New("审核内容不存在或已处理")
+	ErrItemClaimed  = errors.New("该内容正在被其他审核员处理")
+)
+
+//Item 待人工审核的内容,Payload为原始的rpc请求
+type Item struct {
+	Id         int64    `json:"id"`
+	Kind       string   `json:"kind"`
+	Uid        int32    `json:"uid"`
+	Ref        int32    `json:"ref"` //关联id,评论为卖家id
+	Text       []string `json:"text"`
+	Reasons    []string `json:"reasons"`
+	Payload    []byte   `json:"payload,omitempty"`
+	CreateTime int64    `json:"createTime"`
+}
+
+func itemKey(id int64) string {
+	return fmt.Sprintf("%s:%d", itemPrefix, id)
+}
+
+func claimKey(id int64) string {
+	return fmt.Sprintf("%s:%d", claimPrefix, id)
+}
+
+//Enqueue 放入人工审核队列
+func Enqueue(ctx context.Context, item *Item, expire time.Duration) error {
+	id, err := db.RedisClient.Incr(ctx, queueSeqKey).Result()
+	if err != nil {
+		return err
+	}
+	item.Id = id
+	item.CreateTime = time.Now().Unix()
+	val, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.Set(ctx, itemKey(id), val, expire)
+	pipe.ZAdd(ctx, queueKey, &redis.Z{Score: float64(item.CreateTime), Member: id})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//Pending 按提交时间列出待审核内容,不包含Payload
+func Pending(ctx context.Context, page, count int64) ([]*Item, error) {
+	ids, err := db.RedisClient.ZRange(ctx, queueKey, page*count, (page+1)*count-1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, fmt.Sprintf("%s:%s", itemPrefix, id))
+	}
+	vals, err := db.RedisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Item, 0, len(vals))
+	for i, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			// 已过期的内容从队列中移除
+			db.RedisClient.ZRem(ctx, queueKey, ids[i])
+			continue
+		}
+		var item Item
+		if err = json.Unmarshal([]byte(s), &item); err != nil {
+			return nil, err
+		}
+		item.Payload = nil
+		list = append(list, &item)
+	}
+	return list, nil
+}
+
+//Claim 锁定待审核内容,处理完成后调用Finish移出队列,处理失败调用Unclaim释放。
+//锁定期间其他审核员无法处理同一条内容,lockExpire后锁自动失效
+func Claim(ctx context.Context, id int64, lockExpire time.Duration) (*Item, error) {
+	ok, err := db.RedisClient.SetNX(ctx, claimKey(id), time.Now().Unix(), lockExpire).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrItemClaimed
+	}
+	val, err := db.RedisClient.Get(ctx, itemKey(id)).Bytes()
+	if err == redis.Nil {
+		err = ErrItemNotFound
+	}
+	if err != nil {
+		db.RedisClient.Del(ctx, claimKey(id))
+		return nil, err
+	}
+	var item Item
+	if err = json.Unmarshal(val, &item); err != nil {
+		db.RedisClient.Del(ctx, claimKey(id))
+		return nil, err
+	}
+	return &item, nil
+}
+
+//Finish 内容处理完成,移出队列
+func Finish(ctx context.Context, id int64) error {
+	pipe := db.RedisClient.TxPipeline()
+	pipe.ZRem(ctx, queueKey, id)
+	pipe.Del(ctx, itemKey(id), claimKey(id))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+//Unclaim 处理失败,内容留在队列中等待重新处理
+func Unclaim(ctx context.Context, id int64) error {
+	return db.RedisClient.Del(ctx, claimKey(id)).Err()
+}
@@ -0,0 +1,81 @@
+package moderation
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+)
+
+type trieNode struct {
+	children map[rune]*trieNode
+	end      bool
+}
+
+//Trie 敏感词前缀树,匹配时忽略大小写
+type Trie struct {
+	root *trieNode
+}
+
+func NewTrie() *Trie {
+	return &Trie{root: &trieNode{children: make(map[rune]*trieNode)}}
+}
+
+func (t *Trie) Add(word string) {
+	word = strings.TrimSpace(word)
+	if word == "" {
+		return
+	}
+	node := t.root
+	for _, r := range word {
+		r = unicode.ToLower(r)
+		next, ok := node.children[r]
+		if !ok {
+			next = &trieNode{children: make(map[rune]*trieNode)}
+			node.children[r] = next
+		}
+		node = next
+	}
+	node.end = true
+}
+
+//LoadFile 按行加载词典,#开头为注释
+func (t *Trie) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t.Add(line)
+	}
+	return scanner.Err()
+}
+
+//Match 返回所有命中区间[start,end),以rune下标计,同一起点取最长匹配
+func (t *Trie) Match(text []rune) [][2]int {
+	var res [][2]int
+	for i := 0; i < len(text); i++ {
+		node, end := t.root, -1
+		for j := i; j < len(text); j++ {
+			next, ok := node.children[unicode.ToLower(text[j])]
+			if !ok {
+				break
+			}
+			node = next
+			if node.end {
+				end = j + 1
+			}
+		}
+		if end > 0 {
+			res = append(res, [2]int{i, end})
+			i = end - 1
+		}
+	}
+	return res
+}
@@ -0,0 +1,175 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+// 通知类型
+const (
+	TypePriceDrop   = "price_drop"
+	TypePriceChange = "price_change"
+	TypeAvailable   = "available"
+	TypeUnavailable = "unavailable"
+	TypeNewOrder    = "new_order"
+	TypeOrderStatus = "order_status"
+	TypePaid        = "paid"
+	TypeRefund      = "refund"
+	TypeComment     = "comment"
+	TypeReply       = "reply"
+	TypeFavorited   = "favorited"
+	TypeAccount     = "account"
+)
+
+const (
+	seqKey       = "notify:seq"
+	inboxPrefix  = "notify:inbox"
+	msgPrefix    = "notify:msg"
+	unreadPrefix = "notify:unread"
+	pushPrefix   = "notify:push"
+
+	//maxInbox 每个用户最多保留的通知数
+	maxInbox = 500
+)
+
+//Notification 站内通知
+type Notification struct {
+	Id         int64                  `json:"id"`
+	Uid        int32                  `json:"uid"`
+	Type       string                 `json:"type"`
+	Title      string                 `json:"title"`
+	Content    string                 `json:"content"`
+	Data       map[string]interface{} `json:"data"`
+	Read       bool                   `json:"read"`
+	CreateTime int64                  `json:"createTime"`
+}
+
+//inboxKey 用户收件箱,score为通知时间
+func inboxKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", inboxPrefix, uid)
+}
+
+//msgKey 用户通知内容,field为通知id
+func msgKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", msgPrefix, uid)
+}
+
+//unreadKey 用户未读通知id
+func unreadKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", unreadPrefix, uid)
+}
+
+//pushChannel 实时推送频道,所有实例上该用户的连接都会收到
+func pushChannel(uid int32) string {
+	return fmt.Sprintf("%s:%d", pushPrefix, uid)
+}
+
+//Send 投递通知到用户收件箱并实时推送,超出上限时删除最旧的通知
+func Send(ctx context.Context, n *Notification) error {
+	id, err := db.RedisClient.Incr(ctx, seqKey).Result()
+	if err != nil {
+		return err
+	}
+	n.Id = id
+	n.Read = false
+	if n.CreateTime == 0 {
+		n.CreateTime = time.Now().Unix()
+	}
+	val, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.ZAdd(ctx, inboxKey(n.Uid), &redis.Z{Score: float64(n.CreateTime), Member: id})
+	pipe.HSet(ctx, msgKey(n.Uid), id, val)
+	pipe.SAdd(ctx, unreadKey(n.Uid), id)
+	pipe.Publish(ctx, pushChannel(n.Uid), val)
+	if _, err = pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return trim(ctx, n.Uid)
+}
+
+//Subscribe 订阅用户的实时通知,消息内容为通知的json
+func Subscribe(ctx context.Context, uid int32) *redis.PubSub {
+	return db.RedisClient.Subscribe(ctx, pushChannel(uid))
+}
+
+func trim(ctx context.Context, uid int32) error {
+	old, err := db.RedisClient.ZRange(ctx, inboxKey(uid), 0, -maxInbox-1).Result()
+	if err != nil || len(old) == 0 {
+		return err
+	}
+	members := make([]interface{}, 0, len(old))
+	for _, id := range old {
+		members = append(members, id)
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.ZRem(ctx, inboxKey(uid), members...)
+	pipe.HDel(ctx, msgKey(uid), old...)
+	pipe.SRem(ctx, unreadKey(uid), members...)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//List 按时间倒序分页获取通知
+func List(ctx context.Context, uid int32, page, count int64) ([]*Notification, error) {
+	ids, err := db.RedisClient.ZRevRange(ctx, inboxKey(uid), page*count, (page+1)*count-1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	vals, err := db.RedisClient.HMGet(ctx, msgKey(uid), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	unread, err := db.RedisClient.SMembers(ctx, unreadKey(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	unreadSet := make(map[string]bool, len(unread))
+	for _, id := range unread {
+		unreadSet[id] = true
+	}
+	list := make([]*Notification, 0, len(vals))
+	for i, val := range vals {
+		s, ok := val.(string)
+		if !ok {
+			continue
+		}
+		var n Notification
+		if err = json.Unmarshal([]byte(s), &n); err != nil {
+			return nil, err
+		}
+		n.Read = !unreadSet[ids[i]]
+		list = append(list, &n)
+	}
+	return list, nil
+}
+
+//MarkRead 标记通知已读,ids为空时全部标记已读
+func MarkRead(ctx context.Context, uid int32, ids []int64) error {
+	if len(ids) == 0 {
+		return db.RedisClient.Del(ctx, unreadKey(uid)).Err()
+	}
+	members := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		members = append(members, strconv.FormatInt(id, 10))
+	}
+	return db.RedisClient.SRem(ctx, unreadKey(uid), members...).Err()
+}
+
+//UnreadCount 未读通知数
+func UnreadCount(ctx context.Context, uid int32) (int64, error) {
+	return db.RedisClient.SCard(ctx, unreadKey(uid)).Result()
+}
+
+//Purge 删除用户的全部通知
+func Purge(ctx context.Context, uid int32) error {
+	return db.RedisClient.Del(ctx, inboxKey(uid), msgKey(uid), unreadKey(uid)).Err()
+}
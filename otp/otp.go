@@ -0,0 +1,147 @@
+package otp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	codePrefix     = "otp:code"
+	cooldownPrefix = "otp:cooldown"
+	dailyPrefix    = "otp:daily"
+)
+
+var (
+	ErrCooldown   = errors.New("发送太频繁,请稍后再试")
+	ErrDailyLimit = errors.New("今日发送次数已达上限")
+	ErrNoCode     = errors.New("验证码不存在或已过期")
+	ErrWrongCode  = errors.New("验证码错误")
+	ErrTooMany    = errors.New("验证码错误次数过多,请重新获取")
+)
+
+//pending 等待验证的验证码,只保存哈希
+type pending struct {
+	CodeHash string `json:"codeHash"`
+	Attempts int    `json:"attempts"`
+}
+
+func codeKey(scene, target string) string {
+	return fmt.Sprintf("%s:%s:%s", codePrefix, scene, target)
+}
+
+func cooldownKey(scene, target string) string {
+	return fmt.Sprintf("%s:%s:%s", cooldownPrefix, scene, target)
+}
+
+func dailyKey(scene, target string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", dailyPrefix, scene, target, time.Now().Format("20060102"))
+}
+
+//IsUserErr 是否为可以直接返回给用户的错误
+func IsUserErr(err error) bool {
+	return errors.Is(err, ErrCooldown) || errors.Is(err, ErrDailyLimit) ||
+		errors.Is(err, ErrNoCode) || errors.Is(err, ErrWrongCode) || errors.Is(err, ErrTooMany)
+}
+
+//Issue 为scene场景下的target生成验证码,覆盖之前未使用的验证码
+func Issue(ctx context.Context, scene, target string) (string, error) {
+	cfg := misc.Conf.Otp
+	ok, err := db.RedisClient.SetNX(ctx, cooldownKey(scene, target), 1, time.Duration(cfg.Cooldown)*time.Second).Result()
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrCooldown
+	}
+	n, err := db.RedisClient.Incr(ctx, dailyKey(scene, target)).Result()
+	if err != nil {
+		return "", err
+	}
+	if n == 1 {
+		db.RedisClient.Expire(ctx, dailyKey(scene, target), 24*time.Hour)
+	}
+	if cfg.DailyLimit > 0 && n > int64(cfg.DailyLimit) {
+		return "", ErrDailyLimit
+	}
+
+	max := big.NewInt(1)
+	for i := 0; i < cfg.Length; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	r, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%0*d", cfg.Length, r.Int64())
+	val, err := json.Marshal(&pending{CodeHash: hashCode(scene, target, code)})
+	if err != nil {
+		return "", err
+	}
+	if err = db.RedisClient.Set(ctx, codeKey(scene, target), val, time.Duration(cfg.Expire)*time.Second).Err(); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+//Verify 校验验证码,成功后验证码失效,错误次数过多时同样失效
+func Verify(ctx context.Context, scene, target, code string) error {
+	key := codeKey(scene, target)
+	return db.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+		val, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrNoCode
+		}
+		if err != nil {
+			return err
+		}
+		var p pending
+		if err = json.Unmarshal(val, &p); err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(p.CodeHash), []byte(hashCode(scene, target, code))) == 1 {
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, key)
+				return nil
+			})
+			return err
+		}
+		p.Attempts++
+		tooMany := p.Attempts >= misc.Conf.Otp.MaxAttempts
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if tooMany {
+				pipe.Del(ctx, key)
+				return nil
+			}
+			val, _ := json.Marshal(&p)
+			pipe.Set(ctx, key, val, redis.KeepTTL)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if tooMany {
+			return ErrTooMany
+		}
+		return ErrWrongCode
+	}, key)
+}
+
+//hashCode 验证码只有几位,不带密钥的摘要可以被穷举,使用服务端密钥做HMAC
+func hashCode(scene, target, code string) string {
+	mac := hmac.New(sha256.New, []byte(misc.Conf.Otp.Secret))
+	mac.Write([]byte(fmt.Sprintf("%s:%s:%s", scene, target, code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,111 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	MockSignatureHeader = "X-Mock-Signature"
+)
+
+//MockProvider 本地开发使用的支付渠道,回调使用HMAC-SHA256签名
+type MockProvider struct {
+	secret    []byte
+	notifyUrl string
+	tolerance time.Duration
+}
+
+func NewMockProvider(secret, notifyUrl string, tolerance int) *MockProvider {
+	return &MockProvider{
+		secret:    []byte(secret),
+		notifyUrl: notifyUrl,
+		tolerance: time.Duration(tolerance) * time.Second,
+	}
+}
+
+func (p *MockProvider) Name() string {
+	return ProviderMock
+}
+
+func (p *MockProvider) CreateIntent(ctx context.Context, intent *Intent) error {
+	intent.Id = "mock_pi_" + randomHex(12)
+	intent.Provider = p.Name()
+	intent.PayUrl = fmt.Sprintf("mock://pay/%s", intent.Id)
+	return nil
+}
+
+func (p *MockProvider) ParseCallback(r *http.Request) (*Event, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := hex.DecodeString(r.Header.Get(MockSignatureHeader))
+	if err != nil || !hmac.Equal(sig, p.sign(body)) {
+		return nil, ErrBadSignature
+	}
+	var ev Event
+	if err = json.Unmarshal(body, &ev); err != nil {
+		return nil, err
+	}
+	d := time.Since(time.Unix(ev.Timestamp, 0))
+	if d < 0 {
+		d = -d
+	}
+	if p.tolerance > 0 && d > p.tolerance {
+		return nil, ErrExpired
+	}
+	return &ev, nil
+}
+
+func (p *MockProvider) Refund(ctx context.Context, intent *Intent, amount int64) (*Refund, error) {
+	return &Refund{
+		Id:       "mock_re_" + randomHex(12),
+		IntentId: intent.Id,
+		Amount:   amount,
+	}, nil
+}
+
+//Complete 模拟用户完成支付,生成带签名的回调请求,与真实渠道一样过期后不能再支付
+func (p *MockProvider) Complete(intent *Intent, status string) (*http.Request, error) {
+	if intent.Expired() {
+		return nil, ErrExpired
+	}
+	body, err := json.Marshal(&Event{
+		IntentId:  intent.Id,
+		Status:    status,
+		Amount:    intent.Amount,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.notifyUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(MockSignatureHeader, hex.EncodeToString(p.sign(body)))
+	return req, nil
+}
+
+func (p *MockProvider) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,194 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/misc"
+)
+
+const (
+	ProviderMock = "mock"
+)
+
+// 支付单状态
+const (
+	IntentCreated   = "created"
+	IntentSucceeded = "succeeded"
+	IntentFailed    = "failed"
+	IntentRefunded  = "refunded"
+)
+
+const (
+	//refundRetryAfter 退款请求发出后超过该时间仍未完成,认为上次调用已中断,允许用相同的幂等键重试
+	refundRetryAfter = 60
+)
+
+var (
+	ErrBadSignature = errors.New("回调签名校验失败")
+	ErrExpired      = errors.New("回调已过期")
+	ErrNotFound     = errors.New("支付单不存在")
+	ErrStatus       = errors.New("支付单状态错误")
+	ErrAmount       = errors.New("退款金额错误")
+	ErrRefunding    = errors.New("上一笔退款正在处理中")
+)
+
+//Intent 支付单,金额单位为分
+type Intent struct {
+	Id        string `json:"id"`
+	Provider  string `json:"provider"`
+	Oid       int32  `json:"oid"`
+	BuyId     int32  `json:"buyId"`
+	SellId    int32  `json:"sellId"`
+	Amount    int64  `json:"amount"`
+	Refunded  int64  `json:"refunded"`
+	Status    string `json:"status"`
+	PayUrl    string `json:"payUrl"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"` //渠道在该时间后关闭支付,0表示不过期
+
+	PendingRefund int64  `json:"pendingRefund"` //已向渠道发起但尚未确认的退款金额
+	RefundKey     string `json:"refundKey"`     //退款幂等键,重试时渠道不会重复退款
+	RefundAt      int64  `json:"refundAt"`
+	LastRefund    string `json:"lastRefund"` //最近一笔完成的退款单号
+}
+
+//Expired 支付单是否已超过有效期
+func (i *Intent) Expired() bool {
+	return i.ExpiresAt > 0 && time.Now().Unix() >= i.ExpiresAt
+}
+
+//Event 渠道回调事件
+type Event struct {
+	IntentId  string `json:"intentId"`
+	Status    string `json:"status"`
+	Amount    int64  `json:"amount"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+//Refund 退款结果
+type Refund struct {
+	Id       string `json:"id"`
+	IntentId string `json:"intentId"`
+	Amount   int64  `json:"amount"`
+}
+
+//Provider 支付渠道
+type Provider interface {
+	Name() string
+	//CreateIntent 在渠道侧创建支付单,填充Id和PayUrl,渠道需在ExpiresAt后关闭支付
+	CreateIntent(ctx context.Context, intent *Intent) error
+	//ParseCallback 校验回调签名并解析事件
+	ParseCallback(r *http.Request) (*Event, error)
+	//Refund 对已支付的支付单发起退款,intent.RefundKey相同的请求渠道只退款一次
+	Refund(ctx context.Context, intent *Intent, amount int64) (*Refund, error)
+}
+
+var Default Provider
+
+func Init() {
+	var err error
+	Default, err = NewProvider(misc.Conf.PayCfg)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func NewProvider(cfg misc.PayConfig) (Provider, error) {
+	switch cfg.Provider {
+	case ProviderMock, "":
+		return NewMockProvider(cfg.Secret, cfg.NotifyUrl, cfg.Tolerance), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %s", cfg.Provider)
+	}
+}
+
+//Apply 将回调事件应用到支付单,重复回调返回changed=false
+func Apply(ctx context.Context, ev *Event) (intent *Intent, changed bool, err error) {
+	intent, err = UpdateIntent(ctx, ev.IntentId, func(intent *Intent) error {
+		changed = false
+		if intent.Status != IntentCreated {
+			return nil
+		}
+		if ev.Amount != intent.Amount {
+			return ErrAmount
+		}
+		switch ev.Status {
+		case IntentSucceeded, IntentFailed:
+			intent.Status = ev.Status
+			changed = true
+		default:
+			return ErrStatus
+		}
+		return nil
+	})
+	return
+}
+
+//RefundIntent 退款amount分,amount为0时退还剩余全部金额。
+//先在锁内登记待确认的退款,再在锁外调用渠道,避免锁冲突重试时重复退款
+func RefundIntent(ctx context.Context, id string, amount int64) (*Intent, *Refund, error) {
+	var amt int64
+	intent, err := UpdateIntent(ctx, id, func(intent *Intent) error {
+		if intent.Status != IntentSucceeded {
+			return ErrStatus
+		}
+		now := time.Now().Unix()
+		if intent.PendingRefund > 0 {
+			if now-intent.RefundAt < refundRetryAfter {
+				return ErrRefunding
+			}
+			// 上次调用中断,用同一个幂等键重试上次的退款
+			amt = intent.PendingRefund
+			intent.RefundAt = now
+			return nil
+		}
+		left := intent.Amount - intent.Refunded
+		if amt = amount; amt == 0 {
+			amt = left
+		}
+		if amt <= 0 || amt > left {
+			return ErrAmount
+		}
+		intent.PendingRefund = amt
+		intent.RefundKey = randomHex(12)
+		intent.RefundAt = now
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refund, err := Default.Refund(ctx, intent, amt)
+	if err != nil {
+		if _, e := UpdateIntent(ctx, id, func(intent *Intent) error {
+			intent.PendingRefund = 0
+			intent.RefundKey = ""
+			return nil
+		}); e != nil {
+			return nil, nil, e
+		}
+		return nil, nil, err
+	}
+
+	intent, err = UpdateIntent(ctx, id, func(intent *Intent) error {
+		if intent.PendingRefund != amt {
+			return ErrStatus
+		}
+		intent.Refunded += amt
+		intent.LastRefund = refund.Id
+		intent.PendingRefund = 0
+		intent.RefundKey = ""
+		if intent.Refunded == intent.Amount {
+			intent.Status = IntentRefunded
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return intent, refund, nil
+}
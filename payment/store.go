@@ -0,0 +1,103 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	intentKeyPrefix = "payment:intent"
+	orderKeyPrefix  = "payment:order"
+)
+
+func intentKey(id string) string {
+	return fmt.Sprintf("%s:%s", intentKeyPrefix, id)
+}
+
+func orderKey(oid int32) string {
+	return fmt.Sprintf("%s:%d", orderKeyPrefix, oid)
+}
+
+//SaveIntent 保存支付单,同时记录订单到支付单的映射
+func SaveIntent(ctx context.Context, intent *Intent) error {
+	val, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.Set(ctx, intentKey(intent.Id), val, 0)
+	pipe.Set(ctx, orderKey(intent.Oid), intent.Id, 0)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func GetIntent(ctx context.Context, id string) (*Intent, error) {
+	val, err := db.RedisClient.Get(ctx, intentKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var intent Intent
+	if err = json.Unmarshal(val, &intent); err != nil {
+		return nil, err
+	}
+	return &intent, nil
+}
+
+//GetOrderIntent 获取订单最近一次的支付单
+func GetOrderIntent(ctx context.Context, oid int32) (*Intent, error) {
+	id, err := db.RedisClient.Get(ctx, orderKey(oid)).Result()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return GetIntent(ctx, id)
+}
+
+//UpdateIntent 在锁内修改支付单,保证并发回调只生效一次
+func UpdateIntent(ctx context.Context, id string, fn func(intent *Intent) error) (*Intent, error) {
+	var intent *Intent
+	txf := func(tx *redis.Tx) error {
+		val, err := tx.Get(ctx, intentKey(id)).Bytes()
+		if err == redis.Nil {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		intent = &Intent{}
+		if err = json.Unmarshal(val, intent); err != nil {
+			return err
+		}
+		if err = fn(intent); err != nil {
+			return err
+		}
+		val, err = json.Marshal(intent)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, intentKey(id), val, 0)
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		err := db.RedisClient.Watch(ctx, txf, intentKey(id))
+		if err == redis.TxFailedErr {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		return intent, err
+	}
+	return nil, redis.TxFailedErr
+}
@@ -0,0 +1,236 @@
+package rating
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	goodsPrefix  = "rating:goods"
+	sellerPrefix = "rating:seller"
+	ordersPrefix = "rating:orders"
+
+	fieldCount   = "count"
+	fieldSum     = "sum"
+	fieldWeight  = "weight"
+	fieldWeighed = "weighed"
+	fieldBase    = "base"
+
+	maxLevel = 5
+
+	// 权重基准落后超过这么多个半衰期时整体缩放一次,避免权重随时间无限增大
+	renormHalfLives = 4
+)
+
+// 旧数据没有记录权重基准,使用统一的起始时间
+var epoch = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+//GoodsStats 物品评分统计
+type GoodsStats struct {
+	Gid       int32   `json:"gid"`
+	Count     int64   `json:"count"`
+	Average   float64 `json:"average"`
+	Histogram []int64 `json:"histogram"` //下标0对应1星
+}
+
+//SellerStats 卖家信誉
+type SellerStats struct {
+	Uid        int32   `json:"uid"`
+	Count      int64   `json:"count"`
+	Orders     int64   `json:"orders"` //已完成的订单数
+	Average    float64 `json:"average"`
+	Reputation float64 `json:"reputation"`
+}
+
+func goodsKey(gid int32) string {
+	return fmt.Sprintf("%s:%d", goodsPrefix, gid)
+}
+
+func sellerKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", sellerPrefix, uid)
+}
+
+func ordersKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", ordersPrefix, uid)
+}
+
+func levelField(level int32) string {
+	return fmt.Sprintf("l%d", level)
+}
+
+func halfLife() float64 {
+	return float64(misc.Conf.Rating.HalfLife) * 24 * 3600
+}
+
+//weight 评价时间越近权重越高,每过一个半衰期权重翻倍。base为卖家的权重基准时间
+func weight(t, base int64) float64 {
+	h := halfLife()
+	if h <= 0 {
+		return 1
+	}
+	return math.Exp2(float64(t-base) / h)
+}
+
+//Add 新增一条评分
+func Add(ctx context.Context, gid, sellId, level int32, t int64) error {
+	return incr(ctx, gid, sellId, level, t, 1)
+}
+
+//Remove 删除一条评分,t需要与新增时一致
+func Remove(ctx context.Context, gid, sellId, level int32, t int64) error {
+	return incr(ctx, gid, sellId, level, t, -1)
+}
+
+func incr(ctx context.Context, gid, sellId, level int32, t int64, delta int64) error {
+	if level < 1 || level > maxLevel {
+		return fmt.Errorf("invalid level %d", level)
+	}
+	incrGoods := func(pipe redis.Pipeliner) {
+		pipe.HIncrBy(ctx, goodsKey(gid), fieldCount, delta)
+		pipe.HIncrBy(ctx, goodsKey(gid), fieldSum, int64(level)*delta)
+		pipe.HIncrBy(ctx, goodsKey(gid), levelField(level), delta)
+	}
+	if sellId <= 0 {
+		_, err := db.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			incrGoods(pipe)
+			return nil
+		})
+		return err
+	}
+
+	key := sellerKey(sellId)
+	txf := func(tx *redis.Tx) error {
+		vals, err := tx.HMGet(ctx, key, fieldBase, fieldWeight, fieldWeighed).Result()
+		if err != nil {
+			return err
+		}
+		base := epoch.Unix()
+		if s, ok := vals[0].(string); ok {
+			base = parseInt(s)
+		}
+		w, weighed := 0.0, 0.0
+		if s, ok := vals[1].(string); ok {
+			w = parseFloat(s)
+		}
+		if s, ok := vals[2].(string); ok {
+			weighed = parseFloat(s)
+		}
+
+		// 基准过旧时把基准移到当前时间并缩放已有权重,加权均分不变
+		now := time.Now().Unix()
+		rebase := false
+		if h := halfLife(); h > 0 && float64(now-base) > renormHalfLives*h {
+			scale := math.Exp2(float64(base-now) / h)
+			w, weighed = w*scale, weighed*scale
+			base, rebase = now, true
+		}
+		dw := weight(t, base) * float64(delta)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			incrGoods(pipe)
+			pipe.HIncrBy(ctx, key, fieldCount, delta)
+			pipe.HIncrBy(ctx, key, fieldSum, int64(level)*delta)
+			if rebase {
+				pipe.HSet(ctx, key, fieldBase, base, fieldWeight, w+dw, fieldWeighed, weighed+dw*float64(level))
+			} else {
+				pipe.HIncrByFloat(ctx, key, fieldWeight, dw)
+				pipe.HIncrByFloat(ctx, key, fieldWeighed, dw*float64(level))
+			}
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		err := db.RedisClient.Watch(ctx, txf, key)
+		if err == redis.TxFailedErr {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		return err
+	}
+	return redis.TxFailedErr
+}
+
+//AddOrder 记录卖家完成的订单,同一订单重复记录只算一次
+func AddOrder(ctx context.Context, sellId, oid int32) error {
+	return db.RedisClient.SAdd(ctx, ordersKey(sellId), oid).Err()
+}
+
+//Goods 批量获取物品评分统计
+func Goods(ctx context.Context, gids []int32) (map[int32]*GoodsStats, error) {
+	res := make(map[int32]*GoodsStats, len(gids))
+	if len(gids) == 0 {
+		return res, nil
+	}
+	pipe := db.RedisClient.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, 0, len(gids))
+	for _, gid := range gids {
+		cmds = append(cmds, pipe.HGetAll(ctx, goodsKey(gid)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		m := cmd.Val()
+		stats := &GoodsStats{Gid: gids[i], Histogram: make([]int64, maxLevel)}
+		stats.Count = parseInt(m[fieldCount])
+		for l := int32(1); l <= maxLevel; l++ {
+			stats.Histogram[l-1] = parseInt(m[levelField(l)])
+		}
+		if stats.Count > 0 {
+			stats.Average = round(float64(parseInt(m[fieldSum])) / float64(stats.Count))
+		}
+		res[gids[i]] = stats
+	}
+	return res, nil
+}
+
+//Seller 获取卖家信誉,按时间加权后的均分向先验均值收缩。
+//收缩程度取决于完成的订单数,没有评价的订单不影响均分,但成交越多越接近真实均分
+func Seller(ctx context.Context, uid int32) (*SellerStats, error) {
+	pipe := db.RedisClient.Pipeline()
+	statsCmd := pipe.HGetAll(ctx, sellerKey(uid))
+	ordersCmd := pipe.SCard(ctx, ordersKey(uid))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	m := statsCmd.Val()
+	cfg := misc.Conf.Rating
+	stats := &SellerStats{Uid: uid, Count: parseInt(m[fieldCount]), Orders: ordersCmd.Val(), Reputation: cfg.PriorMean}
+	if stats.Count <= 0 {
+		return stats, nil
+	}
+	stats.Average = round(float64(parseInt(m[fieldSum])) / float64(stats.Count))
+	w, weighed := parseFloat(m[fieldWeight]), parseFloat(m[fieldWeighed])
+	if w <= 0 {
+		return stats, nil
+	}
+	// 评价只能针对完成的订单,旧数据缺少订单记录时以评价数为准
+	n := float64(stats.Orders)
+	if stats.Count > stats.Orders {
+		n = float64(stats.Count)
+	}
+	stats.Reputation = round((cfg.PriorWeight*cfg.PriorMean + n*weighed/w) / (cfg.PriorWeight + n))
+	return stats, nil
+}
+
+func parseInt(s string) int64 {
+	v, _ := strconv.ParseInt(s, 10, 64)
+	return v
+}
+
+func parseFloat(s string) float64 {
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
+
+func round(f float64) float64 {
+	return math.Round(f*100) / 100
+}
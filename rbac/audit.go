@@ -0,0 +1,56 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+)
+
+const (
+	auditKey    = "rbac:audit"
+	auditMaxLen = 10000
+)
+
+//AuditLog 管理操作记录
+type AuditLog struct {
+	Uid    int32  `json:"uid"`
+	Role   Role   `json:"role"`
+	Method string `json:"method"`
+	Route  string `json:"route"`
+	Body   string `json:"body"`
+	Status int    `json:"status"` //http状态码
+	Code   int    `json:"code"`   //响应中的业务码,业务错误的http状态码也是200
+	Ip     string `json:"ip"`
+	Time   int64  `json:"time"`
+}
+
+//Audit 记录管理操作,只保留最近auditMaxLen条
+func Audit(ctx context.Context, log *AuditLog) error {
+	val, err := json.Marshal(log)
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.LPush(ctx, auditKey, val)
+	pipe.LTrim(ctx, auditKey, 0, auditMaxLen-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//AuditLogs 按时间倒序分页获取操作记录
+func AuditLogs(ctx context.Context, page, count int64) ([]*AuditLog, error) {
+	vals, err := db.RedisClient.LRange(ctx, auditKey, page*count, (page+1)*count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*AuditLog, 0, len(vals))
+	for _, v := range vals {
+		var log AuditLog
+		if err = json.Unmarshal([]byte(v), &log); err != nil {
+			return nil, err
+		}
+		list = append(list, &log)
+	}
+	return list, nil
+}
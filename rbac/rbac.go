@@ -0,0 +1,92 @@
+package rbac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/go-redis/redis/v8"
+)
+
+type Role string
+
+// 角色
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+type Permission string
+
+// 权限
+const (
+	PermModerate   Permission = "content:moderate" //审核内容、处理举报
+	PermSanction   Permission = "user:sanction"    //封禁用户、下架物品
+	PermDispute    Permission = "order:dispute"    //处理订单纠纷
+	PermManageRole Permission = "role:manage"      //分配角色
+	PermAudit      Permission = "audit:view"       //查看操作日志
+	PermCategory   Permission = "category:manage"  //管理物品分类
+)
+
+const (
+	rolePrefix = "rbac:role"
+)
+
+var ErrRole = errors.New("未知角色")
+
+var rolePermissions = map[Role][]Permission{
+	RoleUser:      {},
+	RoleModerator: {PermModerate, PermSanction},
+	RoleAdmin:     {PermModerate, PermSanction, PermDispute, PermManageRole, PermAudit, PermCategory},
+}
+
+func roleKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", rolePrefix, uid)
+}
+
+// ParseRole 校验角色名
+func ParseRole(name string) (Role, error) {
+	role := Role(name)
+	if _, ok := rolePermissions[role]; !ok {
+		return "", ErrRole
+	}
+	return role, nil
+}
+
+// Has 角色是否拥有权限
+func (r Role) Has(perm Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRole 获取用户角色,配置文件中的管理员始终为admin,未分配角色的为普通用户
+func GetRole(ctx context.Context, uid int32) (Role, error) {
+	for _, id := range misc.Conf.AdminCfg.Uids {
+		if id == uid {
+			return RoleAdmin, nil
+		}
+	}
+	val, err := db.RedisClient.Get(ctx, roleKey(uid)).Result()
+	if err == redis.Nil {
+		return RoleUser, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return Role(val), nil
+}
+
+// SetRole 分配角色,普通用户直接删除记录
+func SetRole(ctx context.Context, uid int32, role Role) error {
+	if role == RoleUser {
+		return db.RedisClient.Del(ctx, roleKey(uid)).Err()
+	}
+	return db.RedisClient.Set(ctx, roleKey(uid), string(role), 0).Err()
+}
@@ -0,0 +1,172 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+// 举报对象
+const (
+	TargetGoods   = "goods"
+	TargetComment = "comment"
+	TargetUser    = "user"
+)
+
+// 举报状态
+const (
+	StatusPending  = "pending"
+	StatusResolved = "resolved"
+)
+
+const (
+	seqKey       = "report:seq"
+	pendingKey   = "report:pending"
+	itemPrefix   = "report:item"
+	dedupPrefix  = "report:dedup"
+	targetPrefix = "report:target"
+)
+
+var (
+	ErrNotFound  = errors.New("举报不存在")
+	ErrDuplicate = errors.New("已经举报过该内容")
+	ErrResolved  = errors.New("举报已处理")
+)
+
+//Report 用户举报
+type Report struct {
+	Id         int64  `json:"id"`
+	Reporter   int32  `json:"reporter"`
+	TargetType string `json:"targetType"`
+	TargetId   int32  `json:"targetId"`
+	TargetUid  int32  `json:"targetUid"` //被举报内容的所有者
+	Gid        int32  `json:"gid"`       //评论所属物品
+	Reason     string `json:"reason"`
+	Status     string `json:"status"`
+	Action     string `json:"action"`
+	Handler    int32  `json:"handler"`
+	Remark     string `json:"remark"`
+	CreateTime int64  `json:"createTime"`
+	ResolveAt  int64  `json:"resolveAt"`
+}
+
+func itemKey(id int64) string {
+	return fmt.Sprintf("%s:%d", itemPrefix, id)
+}
+
+func targetKey(targetType string, targetId int32) string {
+	return fmt.Sprintf("%s:%s:%d", targetPrefix, targetType, targetId)
+}
+
+//Create 创建举报,同一用户对同一对象只能举报一次
+func Create(ctx context.Context, r *Report) error {
+	dedup := fmt.Sprintf("%s:%d:%s:%d", dedupPrefix, r.Reporter, r.TargetType, r.TargetId)
+	ok, err := db.RedisClient.SetNX(ctx, dedup, 1, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDuplicate
+	}
+	id, err := db.RedisClient.Incr(ctx, seqKey).Result()
+	if err != nil {
+		return err
+	}
+	r.Id = id
+	r.Status = StatusPending
+	r.CreateTime = time.Now().Unix()
+	val, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.Set(ctx, itemKey(id), val, 0)
+	pipe.ZAdd(ctx, pendingKey, &redis.Z{Score: float64(r.CreateTime), Member: id})
+	pipe.SAdd(ctx, targetKey(r.TargetType, r.TargetId), id)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func Get(ctx context.Context, id int64) (*Report, error) {
+	val, err := db.RedisClient.Get(ctx, itemKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r Report
+	if err = json.Unmarshal(val, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+//Pending 按时间列出待处理举报
+func Pending(ctx context.Context, page, count int64) ([]*Report, error) {
+	ids, err := db.RedisClient.ZRange(ctx, pendingKey, page*count, (page+1)*count-1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, fmt.Sprintf("%s:%s", itemPrefix, id))
+	}
+	vals, err := db.RedisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Report, 0, len(vals))
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var r Report
+		if err = json.Unmarshal([]byte(s), &r); err != nil {
+			return nil, err
+		}
+		list = append(list, &r)
+	}
+	return list, nil
+}
+
+//Resolve 处理举报,同一对象的其他待处理举报一并关闭
+func Resolve(ctx context.Context, r *Report) error {
+	ids, err := db.RedisClient.SMembers(ctx, targetKey(r.TargetType, r.TargetId)).Result()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	pipe := db.RedisClient.TxPipeline()
+	for _, idStr := range ids {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		item := r
+		if id != r.Id {
+			if item, err = Get(ctx, id); err != nil || item.Status != StatusPending {
+				continue
+			}
+			item.Action, item.Handler, item.Remark = r.Action, r.Handler, r.Remark
+		}
+		item.Status = StatusResolved
+		item.ResolveAt = now
+		val, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, itemKey(id), val, 0)
+		pipe.ZRem(ctx, pendingKey, id)
+	}
+	pipe.Del(ctx, targetKey(r.TargetType, r.TargetId))
+	_, err = pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,76 @@
+package sanction
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	suspendPrefix = "sanction:suspend"
+	hiddenGoods   = "sanction:goods:hidden"
+)
+
+func suspendKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", suspendPrefix, uid)
+}
+
+//SuspendUser 封禁用户,duration为0时永久封禁
+func SuspendUser(ctx context.Context, uid int32, reason string, duration time.Duration) error {
+	return db.RedisClient.Set(ctx, suspendKey(uid), reason, duration).Err()
+}
+
+//UnsuspendUser 解除封禁
+func UnsuspendUser(ctx context.Context, uid int32) error {
+	return db.RedisClient.Del(ctx, suspendKey(uid)).Err()
+}
+
+//IsSuspended 用户是否处于封禁中
+func IsSuspended(ctx context.Context, uid int32) (bool, error) {
+	n, err := db.RedisClient.Exists(ctx, suspendKey(uid)).Result()
+	return n > 0, err
+}
+
+//HideGoods 下架物品,列表和详情中不再展示
+func HideGoods(ctx context.Context, gid int32) error {
+	return db.RedisClient.SAdd(ctx, hiddenGoods, gid).Err()
+}
+
+//UnhideGoods 恢复展示物品
+func UnhideGoods(ctx context.Context, gid int32) error {
+	return db.RedisClient.SRem(ctx, hiddenGoods, gid).Err()
+}
+
+//HiddenGoods 批量判断物品是否被下架,返回被下架的物品
+func HiddenGoods(ctx context.Context, gids []int32) (map[int32]bool, error) {
+	res := make(map[int32]bool)
+	if len(gids) == 0 {
+		return res, nil
+	}
+	pipe := db.RedisClient.Pipeline()
+	cmds := make([]*redis.BoolCmd, 0, len(gids))
+	for _, gid := range gids {
+		cmds = append(cmds, pipe.SIsMember(ctx, hiddenGoods, gid))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	hidden := make([]bool, 0, len(cmds))
+	for _, cmd := range cmds {
+		hidden = append(hidden, cmd.Val())
+	}
+	for i, h := range hidden {
+		if h {
+			res[gids[i]] = true
+		}
+	}
+	return res, nil
+}
+
+//IsGoodsHidden 物品是否被下架
+func IsGoodsHidden(ctx context.Context, gid int32) (bool, error) {
+	return db.RedisClient.SIsMember(ctx, hiddenGoods, gid).Result()
+}
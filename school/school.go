@@ -0,0 +1,212 @@
+package school
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/dopamine-joker/zu_web_server/misc"
+)
+
+const (
+	//maxSearch 联想搜索最多返回的学校数
+	maxSearch = 20
+)
+
+var (
+	ErrUnknown = errors.New("未收录的学校,请从列表中选择")
+)
+
+//School 学校
+type School struct {
+	Id       int32    `json:"id"`
+	Name     string   `json:"name"`
+	Aliases  []string `json:"aliases"`
+	Province string   `json:"province"`
+	City     string   `json:"city"`
+	Domains  []string `json:"domains"`
+}
+
+//Registry 学校名录,按规范化后的名称和别名索引
+type Registry struct {
+	list  []*School
+	byId  map[int32]*School
+	byKey map[string]*School
+}
+
+var Default *Registry
+
+// builtin 内置的学校名录
+//
+//go:embed schools.json
+var builtin []byte
+
+func Init() {
+	list, err := Builtin()
+	if err != nil {
+		panic(err)
+	}
+	Default, err = NewRegistry(Merge(list, misc.Conf.Schools))
+	if err != nil {
+		panic(err)
+	}
+}
+
+//Builtin 解析内置的学校名录
+func Builtin() ([]misc.SchoolConf, error) {
+	var list []misc.SchoolConf
+	if err := json.Unmarshal(builtin, &list); err != nil {
+		return nil, fmt.Errorf("parse builtin schools: %w", err)
+	}
+	return list, nil
+}
+
+//Merge 配置中的学校按id覆盖内置名录,新的id追加到名录末尾
+func Merge(base, extra []misc.SchoolConf) []misc.SchoolConf {
+	list := make([]misc.SchoolConf, len(base))
+	copy(list, base)
+	index := make(map[int32]int, len(list))
+	for i, s := range list {
+		index[s.Id] = i
+	}
+	for _, s := range extra {
+		if i, ok := index[s.Id]; ok {
+			list[i] = s
+			continue
+		}
+		index[s.Id] = len(list)
+		list = append(list, s)
+	}
+	return list
+}
+
+//NewRegistry 加载学校名录,id、名称或别名重复时返回错误
+func NewRegistry(cfgs []misc.SchoolConf) (*Registry, error) {
+	r := &Registry{
+		byId:  make(map[int32]*School, len(cfgs)),
+		byKey: make(map[string]*School, len(cfgs)),
+	}
+	for _, cfg := range cfgs {
+		s := &School{
+			Id:       cfg.Id,
+			Name:     strings.TrimSpace(cfg.Name),
+			Aliases:  cfg.Aliases,
+			Province: cfg.Province,
+			City:     cfg.City,
+			Domains:  cfg.Domains,
+		}
+		if s.Id <= 0 || s.Name == "" {
+			return nil, fmt.Errorf("school %q: id and name are required", cfg.Name)
+		}
+		if _, ok := r.byId[s.Id]; ok {
+			return nil, fmt.Errorf("school %q: duplicate id %d", s.Name, s.Id)
+		}
+		r.byId[s.Id] = s
+		for _, name := range append([]string{s.Name}, s.Aliases...) {
+			key := normalize(name)
+			if key == "" {
+				continue
+			}
+			if other, ok := r.byKey[key]; ok && other != s {
+				return nil, fmt.Errorf("school %q: name %q already used by %q", s.Name, name, other.Name)
+			}
+			r.byKey[key] = s
+		}
+		r.list = append(r.list, s)
+	}
+	sort.Slice(r.list, func(i, j int) bool {
+		return r.list[i].Id < r.list[j].Id
+	})
+	return r, nil
+}
+
+//normalize 忽略大小写、空白和标点,"华南理工大学 "和"South-China University"都能匹配
+func normalize(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		// 全角字母数字转为半角
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+//Get 根据id获取学校
+func (r *Registry) Get(id int32) (*School, error) {
+	s, ok := r.byId[id]
+	if !ok {
+		return nil, ErrUnknown
+	}
+	return s, nil
+}
+
+//Lookup 根据名称或别名查找学校
+func (r *Registry) Lookup(name string) (*School, error) {
+	s, ok := r.byKey[normalize(name)]
+	if !ok {
+		return nil, ErrUnknown
+	}
+	return s, nil
+}
+
+//Search 联想搜索,名称或别名以关键字开头的排在包含关键字的前面,同一组内按id排序
+func (r *Registry) Search(keyword string, count int) []*School {
+	if count <= 0 || count > maxSearch {
+		count = maxSearch
+	}
+	key := normalize(keyword)
+	if key == "" {
+		return nil
+	}
+	var prefix, contain []*School
+	for _, s := range r.list {
+		best := 0
+		for _, name := range append([]string{s.Name}, s.Aliases...) {
+			n := normalize(name)
+			if strings.HasPrefix(n, key) {
+				best = 2
+				break
+			}
+			if strings.Contains(n, key) {
+				best = 1
+			}
+		}
+		switch best {
+		case 2:
+			prefix = append(prefix, s)
+		case 1:
+			contain = append(contain, s)
+		}
+	}
+	list := append(prefix, contain...)
+	if len(list) > count {
+		list = list[:count]
+	}
+	return list
+}
+
+//ByEmail 根据邮箱域名查找学校,子域名同样匹配
+func (r *Registry) ByEmail(email string) (*School, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return nil, ErrUnknown
+	}
+	domain := strings.ToLower(strings.TrimSpace(email[at+1:]))
+	for _, s := range r.list {
+		for _, d := range s.Domains {
+			d = strings.ToLower(d)
+			if domain == d || strings.HasSuffix(domain, "."+d) {
+				return s, nil
+			}
+		}
+	}
+	return nil, ErrUnknown
+}
@@ -0,0 +1,46 @@
+package school
+
+import (
+	"testing"
+
+	"github.com/dopamine-joker/zu_web_server/misc"
+)
+
+func TestBuiltinRegistry(t *testing.T) {
+	list, err := Builtin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRegistry(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"华工":      "华南理工大学",
+		"SYSU":    "中山大学",
+		"  北京大学 ": "北京大学",
+		"ｔｓｉｎｇｈｕａ ｕｎｉｖｅｒｓｉｔｙ": "清华大学",
+		"中国矿业大学(北京)":          "中国矿业大学(北京)",
+	}
+	for name, want := range cases {
+		s, err := r.Lookup(name)
+		if err != nil || s.Name != want {
+			t.Errorf("lookup %q got %v %v, want %s", name, s, err, want)
+		}
+	}
+	s, err := r.ByEmail("someone@mails.tsinghua.edu.cn")
+	if err != nil || s.Name != "清华大学" {
+		t.Errorf("by email got %v %v", s, err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := []misc.SchoolConf{{Id: 1, Name: "甲大学"}, {Id: 2, Name: "乙大学"}}
+	list := Merge(base, []misc.SchoolConf{{Id: 2, Name: "丙大学"}, {Id: 3, Name: "丁大学"}})
+	if len(list) != 3 || list[1].Name != "丙大学" || list[2].Id != 3 {
+		t.Errorf("merge got %+v", list)
+	}
+	if base[1].Name != "乙大学" {
+		t.Error("merge modified base")
+	}
+}
@@ -9,9 +9,17 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/dopamine-joker/zu_web_server/api/handle"
 	"github.com/dopamine-joker/zu_web_server/api/router"
 	"github.com/dopamine-joker/zu_web_server/api/rpc"
+	"github.com/dopamine-joker/zu_web_server/chat"
+	"github.com/dopamine-joker/zu_web_server/gateway"
+	"github.com/dopamine-joker/zu_web_server/mail"
 	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/moderation"
+	"github.com/dopamine-joker/zu_web_server/payment"
+	"github.com/dopamine-joker/zu_web_server/school"
+	"github.com/dopamine-joker/zu_web_server/sms"
 )
 
 func main() {
@@ -19,7 +27,14 @@ func main() {
 	defer stop()
 
 	misc.Init()
+	school.Init()
 	rpc.InitLogicRpcClient()
+	payment.Init()
+	moderation.Init()
+	gateway.Init()
+	chat.Init()
+	mail.Init()
+	sms.Init()
 	r := router.Register()
 	port := misc.Conf.Api.ListenPort
 
@@ -27,6 +42,11 @@ func main() {
 		Addr:    fmt.Sprintf(":%d", port),
 		Handler: r,
 	}
+	srv.RegisterOnShutdown(handle.CloseStreams)
+	go handle.RunAccountDeletion(ctx)
+	go handle.RunMigrations(ctx)
+	go handle.RunPriceWatch(ctx)
+	go handle.RunTotpSweep(ctx)
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && errors.Is(err, http.ErrServerClosed) {
@@ -37,6 +57,9 @@ func main() {
 
 	<-ctx.Done()
 
+	// 被劫持的websocket连接不受Shutdown管理,需要先关闭
+	gateway.Default.Close()
+
 	if err := srv.Shutdown(context.Background()); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
@@ -0,0 +1,72 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"go.uber.org/zap"
+)
+
+const (
+	DriverLog = "log"
+)
+
+var (
+	ErrBadPhone = errors.New("手机号格式错误")
+
+	phoneRegexp = regexp.MustCompile(`^1[3-9]\d{9}$`)
+)
+
+//SMSSender 短信发送
+type SMSSender interface {
+	Send(ctx context.Context, phone, content string) error
+}
+
+var Default SMSSender
+
+func Init() {
+	var err error
+	Default, err = NewSender(misc.Conf.Sms)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func NewSender(cfg misc.SmsConf) (SMSSender, error) {
+	switch cfg.Driver {
+	case DriverLog, "":
+		return &LogSender{}, nil
+	default:
+		return nil, fmt.Errorf("unknown sms driver %s", cfg.Driver)
+	}
+}
+
+//LogSender 未接入短信服务商时使用,只记录发送动作,短信内容含验证码不写入日志
+type LogSender struct{}
+
+func (s *LogSender) Send(ctx context.Context, phone, content string) error {
+	misc.Logger.Info("sms send", zap.String("phone", phone), zap.Int("length", len([]rune(content))))
+	return nil
+}
+
+//NormalizePhone 去掉空白、连字符和+86前缀后校验大陆手机号
+func NormalizePhone(phone string) (string, error) {
+	phone = strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(phone))
+	phone = strings.TrimPrefix(strings.TrimPrefix(phone, "+86"), "86")
+	if !phoneRegexp.MatchString(phone) {
+		return "", ErrBadPhone
+	}
+	return phone, nil
+}
+
+//Mask 隐藏手机号中间四位
+func Mask(phone string) string {
+	if len(phone) != 11 {
+		return phone
+	}
+	return phone[:3] + "****" + phone[7:]
+}
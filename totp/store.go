@@ -0,0 +1,370 @@
+package totp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+const (
+	pendingPrefix   = "totp:pending"
+	secretPrefix    = "totp:secret"
+	recoveryPrefix  = "totp:recovery"
+	usedPrefix      = "totp:used"
+	challengePrefix = "totp:challenge"
+	challengesKey   = "totp:challenges" //未兑换的challenge,score为过期时间
+	failurePrefix   = "totp:failure"
+
+	recoveryLength = 10
+
+	// challenge过期后保留一段时间,等待清理任务吊销其中的token
+	challengeRetain = 24 * time.Hour
+)
+
+var (
+	ErrEnabled      = errors.New("已开启两步验证")
+	ErrNotEnabled   = errors.New("未开启两步验证")
+	ErrNoEnroll     = errors.New("密钥不存在或已过期,请重新获取")
+	ErrWrongCode    = errors.New("验证码错误")
+	ErrBadChallenge = errors.New("登录已过期,请重新登录")
+	ErrTooMany      = errors.New("验证码错误次数过多,请重新登录")
+	ErrLocked       = errors.New("验证码错误次数过多,请稍后再试")
+)
+
+//Challenge 密码校验通过后等待两步验证的登录
+type Challenge struct {
+	Uid       int32  `json:"uid"`
+	Token     string `json:"token"`
+	Attempts  int    `json:"attempts"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+func pendingKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", pendingPrefix, uid)
+}
+
+func secretKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", secretPrefix, uid)
+}
+
+func recoveryKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", recoveryPrefix, uid)
+}
+
+func usedKey(uid int32, step int64) string {
+	return fmt.Sprintf("%s:%d:%d", usedPrefix, uid, step)
+}
+
+func challengeKey(challenge string) string {
+	return challengeHashKey(hash(challenge))
+}
+
+func challengeHashKey(h string) string {
+	return fmt.Sprintf("%s:%s", challengePrefix, h)
+}
+
+func failureKey(uid int32) string {
+	return fmt.Sprintf("%s:%d", failurePrefix, uid)
+}
+
+//Enabled 用户是否开启了两步验证
+func Enabled(ctx context.Context, uid int32) (bool, error) {
+	n, err := db.RedisClient.Exists(ctx, secretKey(uid)).Result()
+	return n > 0, err
+}
+
+//Enroll 生成待确认的密钥,确认前不会生效
+func Enroll(ctx context.Context, uid int32) (string, error) {
+	enabled, err := Enabled(ctx, uid)
+	if err != nil {
+		return "", err
+	}
+	if enabled {
+		return "", ErrEnabled
+	}
+	secret, err := NewSecret()
+	if err != nil {
+		return "", err
+	}
+	expire := time.Duration(misc.Conf.Totp.EnrollExpire) * time.Second
+	if err = db.RedisClient.Set(ctx, pendingKey(uid), secret, expire).Err(); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+//Confirm 使用验证器App上的验证码确认密钥,开启两步验证并返回恢复码
+func Confirm(ctx context.Context, uid int32, code string) ([]string, error) {
+	secret, err := db.RedisClient.Get(ctx, pendingKey(uid)).Result()
+	if err == redis.Nil {
+		return nil, ErrNoEnroll
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := Validate(secret, code, time.Now(), misc.Conf.Totp.Skew); !ok {
+		return nil, ErrWrongCode
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.Set(ctx, secretKey(uid), secret, 0)
+	pipe.Del(ctx, pendingKey(uid), recoveryKey(uid))
+	pipe.SAdd(ctx, recoveryKey(uid), hashes...)
+	if _, err = pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+//Check 校验动态验证码或恢复码,恢复码只能使用一次。
+//同一用户在所有场景下的错误次数合并计算,超过上限后锁定一段时间
+func Check(ctx context.Context, uid int32, code string) error {
+	secret, err := db.RedisClient.Get(ctx, secretKey(uid)).Result()
+	if err == redis.Nil {
+		return ErrNotEnabled
+	}
+	if err != nil {
+		return err
+	}
+	failures, err := db.RedisClient.Get(ctx, failureKey(uid)).Int()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if max := misc.Conf.Totp.MaxFailures; max > 0 && failures >= max {
+		return ErrLocked
+	}
+	err = check(ctx, uid, secret, code)
+	if errors.Is(err, ErrWrongCode) {
+		return recordFailure(ctx, uid)
+	}
+	if err != nil {
+		return err
+	}
+	if err = db.RedisClient.Del(ctx, failureKey(uid)).Err(); err != nil {
+		misc.Logger.Error("reset totp failures err", zap.Error(err))
+	}
+	return nil
+}
+
+func check(ctx context.Context, uid int32, secret, code string) error {
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	if len(code) == recoveryLength {
+		n, err := db.RedisClient.SRem(ctx, recoveryKey(uid), hash(code)).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrWrongCode
+		}
+		return nil
+	}
+	step, ok := Validate(secret, code, time.Now(), misc.Conf.Totp.Skew)
+	if !ok {
+		return ErrWrongCode
+	}
+	// 同一个时间窗口的验证码只能使用一次,防止被截获后重放
+	expire := time.Duration(Period*(2*misc.Conf.Totp.Skew+2)) * time.Second
+	ok, err := db.RedisClient.SetNX(ctx, usedKey(uid, step), 1, expire).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrWrongCode
+	}
+	return nil
+}
+
+//recordFailure 记录一次错误,每次错误都会延长锁定窗口,达到上限时返回ErrLocked
+func recordFailure(ctx context.Context, uid int32) error {
+	pipe := db.RedisClient.TxPipeline()
+	incr := pipe.Incr(ctx, failureKey(uid))
+	pipe.Expire(ctx, failureKey(uid), time.Duration(misc.Conf.Totp.Lockout)*time.Second)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if max := misc.Conf.Totp.MaxFailures; max > 0 && incr.Val() >= int64(max) {
+		return ErrLocked
+	}
+	return ErrWrongCode
+}
+
+//Disable 关闭两步验证
+func Disable(ctx context.Context, uid int32) error {
+	return db.RedisClient.Del(ctx, secretKey(uid), recoveryKey(uid)).Err()
+}
+
+//RegenerateRecovery 重新生成恢复码,旧的恢复码全部失效
+func RegenerateRecovery(ctx context.Context, uid int32) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	pipe := db.RedisClient.TxPipeline()
+	pipe.Del(ctx, recoveryKey(uid))
+	pipe.SAdd(ctx, recoveryKey(uid), hashes...)
+	if _, err = pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+//RecoveryLeft 剩余可用的恢复码数量
+func RecoveryLeft(ctx context.Context, uid int32) (int64, error) {
+	return db.RedisClient.SCard(ctx, recoveryKey(uid)).Result()
+}
+
+//NewChallenge 保存已签发但尚未交给客户端的token,返回用于兑换的challenge
+func NewChallenge(ctx context.Context, uid int32, token string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+	expiresAt := time.Now().Unix() + int64(misc.Conf.Totp.ChallengeExpire)
+	val, err := json.Marshal(&Challenge{Uid: uid, Token: token, ExpiresAt: expiresAt})
+	if err != nil {
+		return "", err
+	}
+	expire := time.Duration(misc.Conf.Totp.ChallengeExpire)*time.Second + challengeRetain
+	pipe := db.RedisClient.TxPipeline()
+	pipe.Set(ctx, challengeKey(challenge), val, expire)
+	pipe.ZAdd(ctx, challengesKey, &redis.Z{Score: float64(expiresAt), Member: hash(challenge)})
+	if _, err = pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+//Exchange 校验验证码后取出challenge对应的token。错误次数过多时challenge失效并返回ErrTooMany,
+//用户被锁定时返回ErrLocked,challenge过期时返回ErrBadChallenge,这些情况下调用方需要吊销token
+func Exchange(ctx context.Context, challenge, code string) (*Challenge, error) {
+	key := challengeKey(challenge)
+	member := hash(challenge)
+	var ch Challenge
+	err := db.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+		val, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrBadChallenge
+		}
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(val, &ch); err != nil {
+			return err
+		}
+		if ch.ExpiresAt > 0 && time.Now().Unix() >= ch.ExpiresAt {
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, key)
+				pipe.ZRem(ctx, challengesKey, member)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return ErrBadChallenge
+		}
+		checkErr := Check(ctx, ch.Uid, code)
+		if checkErr != nil && !errors.Is(checkErr, ErrWrongCode) && !errors.Is(checkErr, ErrLocked) {
+			return checkErr
+		}
+		tooMany := errors.Is(checkErr, ErrLocked)
+		if errors.Is(checkErr, ErrWrongCode) {
+			ch.Attempts++
+			if ch.Attempts >= misc.Conf.Totp.MaxAttempts {
+				tooMany, checkErr = true, ErrTooMany
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if checkErr == nil || tooMany {
+				pipe.Del(ctx, key)
+				pipe.ZRem(ctx, challengesKey, member)
+				return nil
+			}
+			val, _ := json.Marshal(&ch)
+			pipe.Set(ctx, key, val, redis.KeepTTL)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return checkErr
+	}, key)
+	if err != nil {
+		return &ch, err
+	}
+	return &ch, nil
+}
+
+//TakeExpired 取出已过期但没有兑换的challenge,调用方负责吊销其中的token
+func TakeExpired(ctx context.Context, now time.Time, limit int64) ([]*Challenge, error) {
+	members, err := db.RedisClient.ZRangeByScore(ctx, challengesKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: limit,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	var list []*Challenge
+	for _, m := range members {
+		// 从集合中移除成功的实例负责处理,避免多个实例重复处理
+		n, err := db.RedisClient.ZRem(ctx, challengesKey, m).Result()
+		if err != nil {
+			return list, err
+		}
+		if n == 0 {
+			continue
+		}
+		val, err := db.RedisClient.Get(ctx, challengeHashKey(m)).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return list, err
+		}
+		db.RedisClient.Del(ctx, challengeHashKey(m))
+		var ch Challenge
+		if err = json.Unmarshal(val, &ch); err != nil {
+			continue
+		}
+		list = append(list, &ch)
+	}
+	return list, nil
+}
+
+func newRecoveryCodes() ([]string, []interface{}, error) {
+	n := misc.Conf.Totp.RecoveryCodes
+	codes := make([]string, 0, n)
+	hashes := make([]interface{}, 0, n)
+	b := make([]byte, 7)
+	for i := 0; i < n; i++ {
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))[:recoveryLength]
+		codes = append(codes, code[:recoveryLength/2]+"-"+code[recoveryLength/2:])
+		hashes = append(hashes, hash(code))
+	}
+	return codes, hashes, nil
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
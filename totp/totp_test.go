@@ -0,0 +1,69 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录B的SHA1测试向量,密钥为ASCII "12345678901234567890"。
+// RFC给出的是8位验证码,这里只取后6位
+var rfc6238Secret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		got, err := Code(rfc6238Secret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code(%d) err: %v", v.unix, err)
+		}
+		if got != v.code {
+			t.Errorf("Code(%d) = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestCodeLowerCaseSecret(t *testing.T) {
+	lower := []byte(rfc6238Secret)
+	for i, b := range lower {
+		if b >= 'A' && b <= 'Z' {
+			lower[i] = b + 'a' - 'A'
+		}
+	}
+	got, err := Code(string(lower), Step(time.Unix(59, 0)))
+	if err != nil || got != "287082" {
+		t.Errorf("Code with lower case secret = %s, %v", got, err)
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	prev, _ := Code(rfc6238Secret, Step(now)-1)
+	next2, _ := Code(rfc6238Secret, Step(now)+2)
+
+	if step, ok := Validate(rfc6238Secret, "050471", now, 0); !ok || step != Step(now) {
+		t.Errorf("Validate current step = %d, %v", step, ok)
+	}
+	if step, ok := Validate(rfc6238Secret, prev, now, 1); !ok || step != Step(now)-1 {
+		t.Errorf("Validate previous step with skew 1 = %d, %v", step, ok)
+	}
+	if _, ok := Validate(rfc6238Secret, prev, now, 0); ok {
+		t.Error("Validate previous step without skew should fail")
+	}
+	if _, ok := Validate(rfc6238Secret, next2, now, 1); ok {
+		t.Error("Validate step+2 with skew 1 should fail")
+	}
+	if _, ok := Validate(rfc6238Secret, "05047", now, 1); ok {
+		t.Error("Validate short code should fail")
+	}
+}
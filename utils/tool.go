@@ -9,10 +9,14 @@ import (
 	"google.golang.org/grpc/resolver"
 
 	"github.com/dopamine-joker/zu_web_server/misc"
+	"github.com/dopamine-joker/zu_web_server/proto"
+	"github.com/dopamine-joker/zu_web_server/rbac"
 )
 
 const (
-	UserId = "X-UID"
+	UserId   = "X-UID"
+	UserInfo = "X-USER"
+	UserRole = "X-ROLE"
 )
 
 func SuccessWithMsg(c *gin.Context, msg interface{}, data interface{}) {
@@ -24,6 +28,11 @@ func FailWithMsg(c *gin.Context, msg interface{}) {
 }
 
 func ResponseWithCode(c *gin.Context, msgCode int, msg interface{}, data interface{}) {
+	ResponseWithStatus(c, http.StatusOK, msgCode, msg, data)
+}
+
+//ResponseWithStatus 指定http状态码返回
+func ResponseWithStatus(c *gin.Context, status int, msgCode int, msg interface{}, data interface{}) {
 	if msg == nil {
 		if val, ok := misc.MsgCodeMap[msgCode]; ok {
 			msg = val
@@ -31,7 +40,7 @@ func ResponseWithCode(c *gin.Context, msgCode int, msg interface{}, data interfa
 			msg = misc.MsgCodeMap[misc.CodeUnknownError]
 		}
 	}
-	c.AbortWithStatusJSON(http.StatusOK, gin.H{
+	c.AbortWithStatusJSON(status, gin.H{
 		"code":    msgCode,
 		"message": msg,
 		"data":    data,
@@ -52,6 +61,21 @@ func GetContextUserId(c *gin.Context) (uid int32, err error) {
 	return uid, nil
 }
 
+//GetContextUser 获取token对应的用户信息
+func GetContextUser(c *gin.Context) (*proto.User, error) {
+	val, exists := c.Get(UserInfo)
+	if !exists {
+		misc.Logger.Error("Token无法识别用户信息")
+		return nil, errors.New("用户未登陆")
+	}
+	user, ok := val.(*proto.User)
+	if !ok {
+		misc.Logger.Error("gin Context参数错误")
+		return nil, errors.New("服务器内部参数错误")
+	}
+	return user, nil
+}
+
 //GetRpcMsg 提取rpc调用的错误信息
 func GetRpcMsg(errMsg string) string {
 	sli := strings.Split(errMsg, "desc = ")
@@ -81,6 +105,24 @@ func Exist(srvAddrs []resolver.Address, addr resolver.Address) bool {
 	return false
 }
 
+//GetContextRole 获取用户角色,未登录时为普通用户
+func GetContextRole(c *gin.Context) rbac.Role {
+	val, exists := c.Get(UserRole)
+	if !exists {
+		return rbac.RoleUser
+	}
+	role, ok := val.(rbac.Role)
+	if !ok {
+		return rbac.RoleUser
+	}
+	return role
+}
+
+//HasPermission 当前用户是否拥有权限
+func HasPermission(c *gin.Context, perm rbac.Permission) bool {
+	return GetContextRole(c).Has(perm)
+}
+
 func IsContain(list []string, str string) bool {
 	for _, e := range list {
 		if e == str {
@@ -0,0 +1,190 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dopamine-joker/zu_web_server/db"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	subscriberPrefix = "watch:goods"
+	pricePrefix      = "watch:price"
+	availablePrefix  = "watch:available"
+	watchedKey       = "watch:watched" //有订阅用户的物品,定期检查价格
+
+	available   = "1"
+	unavailable = "0"
+)
+
+//Change 物品状态变化
+type Change struct {
+	Gid int32
+	Old string
+	New string
+}
+
+func subscriberKey(gid int32) string {
+	return fmt.Sprintf("%s:%d", subscriberPrefix, gid)
+}
+
+func priceKey(gid int32) string {
+	return fmt.Sprintf("%s:%d", pricePrefix, gid)
+}
+
+func availableKey(gid int32) string {
+	return fmt.Sprintf("%s:%d", availablePrefix, gid)
+}
+
+//Subscribe 订阅物品的价格和可租状态变化
+func Subscribe(ctx context.Context, uid, gid int32) error {
+	pipe := db.RedisClient.TxPipeline()
+	pipe.SAdd(ctx, subscriberKey(gid), uid)
+	pipe.SAdd(ctx, watchedKey, gid)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+//Unsubscribe 取消订阅
+func Unsubscribe(ctx context.Context, uid, gid int32) error {
+	return db.RedisClient.SRem(ctx, subscriberKey(gid), uid).Err()
+}
+
+//Subscribers 获取物品的订阅用户
+func Subscribers(ctx context.Context, gid int32) ([]int32, error) {
+	members, err := db.RedisClient.SMembers(ctx, subscriberKey(gid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	uids := make([]int32, 0, len(members))
+	for _, m := range members {
+		uid, err := strconv.Atoi(m)
+		if err != nil {
+			continue
+		}
+		uids = append(uids, int32(uid))
+	}
+	return uids, nil
+}
+
+//Watched 获取有订阅用户的物品
+func Watched(ctx context.Context) ([]int32, error) {
+	members, err := db.RedisClient.SMembers(ctx, watchedKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	gids := make([]int32, 0, len(members))
+	for _, m := range members {
+		gid, err := strconv.Atoi(m)
+		if err != nil {
+			continue
+		}
+		gids = append(gids, int32(gid))
+	}
+	return gids, nil
+}
+
+//Forget 物品已没有订阅用户时不再检查价格,返回是否已移除
+func Forget(ctx context.Context, gid int32) (bool, error) {
+	removed := false
+	err := db.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.SCard(ctx, subscriberKey(gid)).Result()
+		if err != nil || n > 0 {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SRem(ctx, watchedKey, gid)
+			pipe.Del(ctx, priceKey(gid))
+			return nil
+		})
+		removed = err == nil
+		return err
+	}, subscriberKey(gid))
+	if err == redis.TxFailedErr {
+		// 检查期间有新的订阅,保留
+		return false, nil
+	}
+	return removed, err
+}
+
+//Reindex 根据已有的订阅记录重建待检查物品列表
+func Reindex(ctx context.Context) error {
+	iter := db.RedisClient.Scan(ctx, 0, subscriberPrefix+":*", 500).Iterator()
+	for iter.Next(ctx) {
+		gid, err := strconv.Atoi(strings.TrimPrefix(iter.Val(), subscriberPrefix+":"))
+		if err != nil {
+			continue
+		}
+		if err = db.RedisClient.SAdd(ctx, watchedKey, gid).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+//ObservePrices 记录观察到的物品价格,返回与上次记录不同的物品.
+//首次观察到的物品只记录不返回,并发观察时同一次变化只会返回一次
+func ObservePrices(ctx context.Context, prices map[int32]string) ([]*Change, error) {
+	if len(prices) == 0 {
+		return nil, nil
+	}
+	pipe := db.RedisClient.Pipeline()
+	cmds := make(map[int32]*redis.StringCmd, len(prices))
+	for gid, price := range prices {
+		cmds[gid] = pipe.GetSet(ctx, priceKey(gid), price)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	var changes []*Change
+	for gid, cmd := range cmds {
+		old, err := cmd.Result()
+		if err != nil || old == prices[gid] {
+			continue
+		}
+		changes = append(changes, &Change{Gid: gid, Old: old, New: prices[gid]})
+	}
+	return changes, nil
+}
+
+//SetAvailable 记录物品是否可租,状态发生变化时返回true
+func SetAvailable(ctx context.Context, gid int32, ok bool) (bool, error) {
+	val := unavailable
+	if ok {
+		val = available
+	}
+	old, err := db.RedisClient.GetSet(ctx, availableKey(gid), val).Result()
+	if err == redis.Nil {
+		// 没有记录时物品默认可租
+		return !ok, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return old != val, nil
+}
+
+//Unavailable 批量获取当前不可租的物品
+func Unavailable(ctx context.Context, gids []int32) (map[int32]bool, error) {
+	res := make(map[int32]bool, len(gids))
+	if len(gids) == 0 {
+		return res, nil
+	}
+	keys := make([]string, len(gids))
+	for i, gid := range gids {
+		keys[i] = availableKey(gid)
+	}
+	vals, err := db.RedisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range vals {
+		if s, ok := v.(string); ok && s == unavailable {
+			res[gids[i]] = true
+		}
+	}
+	return res, nil
+}